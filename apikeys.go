@@ -0,0 +1,168 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// apiKeyPrefix starts every API key, which tells them apart from JWTs in the
+// Authorization header
+const apiKeyPrefix = "bk_"
+
+// apiKeyTouchInterval is how often the last-used time of a key is written,
+// so that busy clients don't cause a write per request
+const apiKeyTouchInterval = time.Minute
+
+// APIKey is a long-lived credential for machine clients. It grants only its
+// scopes, which are permissions in the same form roles use.
+type APIKey struct {
+	ID   int    `json:"id"`
+	Name string `json:"name"`
+	// Prefix is the start of the key, shown so keys can be told apart
+	// without storing them
+	Prefix  string   `json:"prefix"`
+	KeyHash string   `json:"-"`
+	Scopes  []string `json:"scopes"`
+	// DailyQuota overrides the configured daily quota when set
+	DailyQuota int        `json:"daily_quota"`
+	CreatedBy  string     `json:"created_by"`
+	CreatedAt  time.Time  `json:"created_at"`
+	LastUsedAt *time.Time `json:"last_used_at"`
+	Revoked    bool       `json:"revoked"`
+}
+
+// authenticateAPIKey looks the API key up and returns the principal it
+// authenticates, answering 401 when the key is unknown or revoked
+func (s *server) authenticateAPIKey(w http.ResponseWriter, r *http.Request, key string) (*Principal, bool) {
+	ctx := r.Context()
+
+	apiKey, err := s.store.GetAPIKeyByHash(ctx, hashToken(key))
+	if err != nil && !errors.Is(err, ErrNotFound) {
+		internalError(w, r, err)
+		return nil, false
+	}
+	if err != nil || apiKey.Revoked {
+		challenge(w, r, http.StatusUnauthorized, "invalid_token", "The API key is invalid or revoked", "")
+		return nil, false
+	}
+
+	now := s.now()
+	if apiKey.LastUsedAt == nil || now.Sub(*apiKey.LastUsedAt) >= apiKeyTouchInterval {
+		if err := s.store.TouchAPIKey(ctx, apiKey.ID, now); err != nil {
+			internalError(w, r, err)
+			return nil, false
+		}
+	}
+
+	quota := apiKey.DailyQuota
+	if quota == 0 {
+		quota = s.apiKeyDailyQuota
+	}
+	return &Principal{APIKeyID: apiKey.ID, Scopes: apiKey.Scopes, DailyQuota: quota}, true
+}
+
+func (s *server) getAllAPIKeys(w http.ResponseWriter, r *http.Request) {
+	keys, err := s.store.AllAPIKeys(r.Context())
+	if err != nil {
+		internalError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(keys)
+}
+
+// createAPIKey issues a new key. The key itself is only part of this
+// response; the store keeps its hash.
+func (s *server) createAPIKey(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		Name       string   `json:"name"`
+		Scopes     []string `json:"scopes"`
+		DailyQuota int      `json:"daily_quota"`
+	}
+	if !s.decodeBody(w, r, &body) {
+		return
+	}
+
+	if body.Name == "" {
+		invalidFields(w, r, FieldError{"name", "is required"})
+		return
+	}
+	if len(body.Scopes) == 0 {
+		invalidFields(w, r, FieldError{"scopes", "must have at least one scope"})
+		return
+	}
+	if body.DailyQuota < 0 {
+		invalidFields(w, r, FieldError{"daily_quota", "must not be negative"})
+		return
+	}
+	for _, scope := range body.Scopes {
+		if !validPermission(scope) {
+			invalidFields(w, r, FieldError{"scopes", fmt.Sprintf("unknown scope %q", scope)})
+			return
+		}
+	}
+	// Keys can't grant more than their creator may do
+	principal, _ := principalFromContext(r.Context())
+	for _, scope := range body.Scopes {
+		if !s.allowed(principal, scope) {
+			writeProblem(w, r, http.StatusForbidden, problemForbidden, fmt.Sprintf("You can't grant the scope %q, which you don't have", scope))
+			return
+		}
+	}
+	createdBy := principal.Username
+	if principal.APIKeyID != 0 {
+		createdBy = "apikey:" + strconv.Itoa(principal.APIKeyID)
+	}
+
+	secret, err := randomToken(32)
+	if err != nil {
+		internalError(w, r, err)
+		return
+	}
+	key := apiKeyPrefix + secret
+
+	apiKey := APIKey{
+		Name:       body.Name,
+		Prefix:     key[:len(apiKeyPrefix)+8],
+		KeyHash:    hashToken(key),
+		Scopes:     body.Scopes,
+		DailyQuota: body.DailyQuota,
+		CreatedBy:  createdBy,
+		CreatedAt:  s.now().UTC().Truncate(time.Second),
+	}
+	err = s.store.CreateAPIKey(r.Context(), &apiKey)
+	if err != nil {
+		internalError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		APIKey
+		Key string `json:"key"`
+	}{apiKey, key})
+}
+
+func (s *server) revokeAPIKey(w http.ResponseWriter, r *http.Request) {
+	id, ok := pathID(w, r)
+	if !ok {
+		return
+	}
+
+	err := s.store.RevokeAPIKey(r.Context(), id)
+	if errors.Is(err, ErrNotFound) {
+		writeProblem(w, r, http.StatusNotFound, problemNotFound, "API key not found")
+		return
+	}
+	if err != nil {
+		internalError(w, r, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// serveWithKey sends a request authenticated with an API key
+func serveWithKey(t *testing.T, router http.Handler, method, url, key string) int {
+	req, err := http.NewRequest(method, url, strings.NewReader(`{"title": "Synced Book"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Authorization", "Bearer "+key)
+
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	return rr.Code
+}
+
+// createTestAPIKey issues an API key as the admin and returns it
+func createTestAPIKey(t *testing.T, router http.Handler, body map[string]interface{}) string {
+	rr := serveJSON(t, router, "POST", "/apikeys", body)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("CreateAPIKey handler returned wrong status code: got %d, expected %d", rr.Code, http.StatusOK)
+	}
+
+	var created struct {
+		Key string `json:"key"`
+	}
+	if err := json.Unmarshal(rr.Body.Bytes(), &created); err != nil {
+		t.Fatal(err)
+	}
+	return created.Key
+}
+
+func TestAPIKeyLifecycle(t *testing.T) {
+	router := newTestServer(t)
+
+	rr := serveJSON(t, router, "POST", "/apikeys", map[string]interface{}{"name": "catalog-sync", "scopes": []string{"read:books", "write:authors"}})
+	if rr.Code != http.StatusOK {
+		t.Fatalf("CreateAPIKey handler returned wrong status code: got %d, expected %d", rr.Code, http.StatusOK)
+	}
+	var created struct {
+		ID     int    `json:"id"`
+		Key    string `json:"key"`
+		Prefix string `json:"prefix"`
+	}
+	if err := json.Unmarshal(rr.Body.Bytes(), &created); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(created.Key, apiKeyPrefix) || !strings.HasPrefix(created.Key, created.Prefix) {
+		t.Fatalf("unexpected key %q with prefix %q", created.Key, created.Prefix)
+	}
+
+	// The key grants its scopes and nothing else
+	if code := serveWithKey(t, router, "GET", "/books", created.Key); code != http.StatusOK {
+		t.Errorf("GET /books with the key returned %d, expected %d", code, http.StatusOK)
+	}
+	if code := serveWithKey(t, router, "POST", "/books", created.Key); code != http.StatusForbidden {
+		t.Errorf("POST /books with the key returned %d, expected %d", code, http.StatusForbidden)
+	}
+	if code := serveWithKey(t, router, "GET", "/apikeys", created.Key); code != http.StatusForbidden {
+		t.Errorf("GET /apikeys with the key returned %d, expected %d", code, http.StatusForbidden)
+	}
+
+	// Listing shows when the key was last used but never the key itself
+	rr = serveJSON(t, router, "GET", "/apikeys", nil)
+	if strings.Contains(rr.Body.String(), created.Key) || strings.Contains(rr.Body.String(), hashToken(created.Key)) {
+		t.Error("GetAllAPIKeys handler exposed the key")
+	}
+	var keys []APIKey
+	if err := json.Unmarshal(rr.Body.Bytes(), &keys); err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 1 || keys[0].LastUsedAt == nil || keys[0].Name != "catalog-sync" {
+		t.Errorf("expected the used key in the list, got %+v", keys)
+	}
+
+	rr = serveJSON(t, router, "DELETE", "/apikeys/"+strconv.Itoa(created.ID), nil)
+	if rr.Code != http.StatusNoContent {
+		t.Errorf("RevokeAPIKey handler returned wrong status code: got %d, expected %d", rr.Code, http.StatusNoContent)
+	}
+	if code := serveWithKey(t, router, "GET", "/books", created.Key); code != http.StatusUnauthorized {
+		t.Errorf("GET /books with a revoked key returned %d, expected %d", code, http.StatusUnauthorized)
+	}
+	rr = serveJSON(t, router, "DELETE", "/apikeys/"+strconv.Itoa(created.ID), nil)
+	if rr.Code != http.StatusNotFound {
+		t.Errorf("revoking twice returned %d, expected %d", rr.Code, http.StatusNotFound)
+	}
+
+	if code := serveWithKey(t, router, "GET", "/books", apiKeyPrefix+"unknown"); code != http.StatusUnauthorized {
+		t.Errorf("GET /books with an unknown key returned %d, expected %d", code, http.StatusUnauthorized)
+	}
+}
+
+func TestCreateAPIKeyValidation(t *testing.T) {
+	router := newTestServer(t)
+
+	bodies := []map[string]interface{}{
+		{"scopes": []string{"read:books"}},
+		{"name": "sync"},
+		{"name": "sync", "scopes": []string{"read:shelves"}},
+	}
+	for _, body := range bodies {
+		rr := serveJSON(t, router, "POST", "/apikeys", body)
+		if rr.Code != http.StatusBadRequest {
+			t.Errorf("CreateAPIKey with %v returned %d, expected %d", body, rr.Code, http.StatusBadRequest)
+		}
+	}
+
+	// Only admins may issue keys
+	req, err := http.NewRequest("POST", "/apikeys", strings.NewReader(`{"name": "sync", "scopes": ["*"]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	authorizeAs(t, req, "librarian", roleLibrarian)
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	if rr.Code != http.StatusForbidden {
+		t.Errorf("CreateAPIKey as a librarian returned %d, expected %d", rr.Code, http.StatusForbidden)
+	}
+}
+
+func TestCreateAPIKeyWithinOwnScopes(t *testing.T) {
+	router := newTestServer(t)
+	key := createTestAPIKey(t, router, map[string]interface{}{"name": "key-manager", "scopes": []string{"write:apikeys", "read:books"}})
+
+	createAs := func(scopes ...string) *httptest.ResponseRecorder {
+		body, err := json.Marshal(map[string]interface{}{"name": "minted", "scopes": scopes})
+		if err != nil {
+			t.Fatal(err)
+		}
+		req, err := http.NewRequest("POST", "/apikeys", bytes.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Authorization", "Bearer "+key)
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		return rr
+	}
+
+	// A key can't mint one with scopes it doesn't have
+	for _, scopes := range [][]string{{"*"}, {"write:*"}, {"read:*"}, {"read:books", "write:books"}} {
+		decodeProblem(t, createAs(scopes...), http.StatusForbidden, problemForbidden)
+	}
+
+	rr := createAs("read:books")
+	if rr.Code != http.StatusOK {
+		t.Fatalf("creating a key within the creator's scopes returned %d, expected %d", rr.Code, http.StatusOK)
+	}
+	var created APIKey
+	if err := json.Unmarshal(rr.Body.Bytes(), &created); err != nil {
+		t.Fatal(err)
+	}
+	keys, err := router.store.AllAPIKeys(t.Context())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if created.CreatedBy != "apikey:"+strconv.Itoa(keys[0].ID) {
+		t.Errorf("key created by key %d has created_by %q", keys[0].ID, created.CreatedBy)
+	}
+}
+
+func TestAPIKeyLastUsedThrottled(t *testing.T) {
+	router := newTestServer(t)
+	now := time.Date(2026, 10, 1, 12, 0, 0, 0, time.UTC)
+	router.now = func() time.Time { return now }
+
+	key := createTestAPIKey(t, router, map[string]interface{}{"name": "sync", "scopes": []string{"read:*"}})
+
+	lastUsed := func() time.Time {
+		key, err := router.store.GetAPIKeyByHash(t.Context(), hashToken(key))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return *key.LastUsedAt
+	}
+
+	serveWithKey(t, router, "GET", "/books", key)
+	first := lastUsed()
+
+	now = now.Add(30 * time.Second)
+	serveWithKey(t, router, "GET", "/books", key)
+	if got := lastUsed(); !got.Equal(first) {
+		t.Errorf("expected last_used_at to stay %v within a minute, got %v", first, got)
+	}
+
+	now = now.Add(time.Minute)
+	serveWithKey(t, router, "GET", "/books", key)
+	if got := lastUsed(); !got.Equal(now) {
+		t.Errorf("expected last_used_at %v, got %v", now, got)
+	}
+}
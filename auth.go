@@ -0,0 +1,249 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/golang-jwt/jwt"
+)
+
+// JWT claims struct
+type Claims struct {
+	Username string `json:"username"`
+	Role     string `json:"role"`
+	jwt.StandardClaims
+}
+
+// RefreshToken is a long-lived credential exchanged for new access tokens.
+// Only the SHA-256 hash of the token is stored.
+type RefreshToken struct {
+	ID        int
+	UserID    int
+	TokenHash string
+	ExpiresAt int64
+	Revoked   bool
+}
+
+// randomToken returns n random bytes encoded as hex
+func randomToken(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// hashToken returns the hex SHA-256 of token, the form in which opaque
+// tokens are stored
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// issueTokens writes a new access token and refresh token for user
+func (s *server) issueTokens(w http.ResponseWriter, r *http.Request, user User) {
+	now := s.now()
+
+	jti, err := randomToken(16)
+	if err != nil {
+		internalError(w, r, err)
+		return
+	}
+
+	expiresAt := now.Add(s.accessTokenTTL)
+	tokenString, err := s.keys.sign(&Claims{
+		Username: user.Username,
+		Role:     user.Role,
+		StandardClaims: jwt.StandardClaims{
+			Id:        jti,
+			IssuedAt:  now.Unix(),
+			ExpiresAt: expiresAt.Unix(),
+		},
+	})
+	if err != nil {
+		internalError(w, r, err)
+		return
+	}
+
+	refreshToken, err := randomToken(32)
+	if err != nil {
+		internalError(w, r, err)
+		return
+	}
+
+	err = s.store.CreateRefreshToken(r.Context(), &RefreshToken{
+		UserID:    user.ID,
+		TokenHash: hashToken(refreshToken),
+		ExpiresAt: now.Add(s.refreshTokenTTL).Unix(),
+	})
+	if err != nil {
+		internalError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{
+		"token":         tokenString,
+		"token_type":    "Bearer",
+		"expires_at":    expiresAt.UTC().Format(time.RFC3339),
+		"refresh_token": refreshToken,
+	})
+}
+
+// Login handles the user login and generates a JWT token
+func (s *server) login(w http.ResponseWriter, r *http.Request) {
+	var creds struct {
+		Username string `json:"username"`
+		Password string `json:"password"`
+	}
+
+	if !s.decodeBody(w, r, &creds) {
+		return
+	}
+
+	if !s.checkLockout(w, r, creds.Username) {
+		return
+	}
+
+	user, err := s.store.GetUserByUsername(r.Context(), creds.Username)
+	if err != nil && !errors.Is(err, ErrNotFound) {
+		internalError(w, r, err)
+		return
+	}
+
+	// Unknown usernames spend the same time as a real password check and
+	// count towards the lockout like wrong passwords
+	hash := user.PasswordHash
+	if err != nil {
+		hash = string(dummyPasswordHash)
+	}
+	if !checkPassword(hash, creds.Password) || err != nil {
+		if err := s.loginFailed(r, creds.Username); err != nil {
+			internalError(w, r, err)
+			return
+		}
+		writeProblem(w, r, http.StatusUnauthorized, problemUnauthorized, "Invalid username or password")
+		return
+	}
+
+	// A correct password ends the failures of the username
+	if err := s.store.ClearLoginFailures(r.Context(), usernameLockoutKey+user.Username); err != nil {
+		internalError(w, r, err)
+		return
+	}
+	if user.Disabled {
+		writeProblem(w, r, http.StatusUnauthorized, problemUnauthorized, "Invalid username or password")
+		return
+	}
+
+	s.issueTokens(w, r, user)
+}
+
+// refreshToken exchanges a refresh token for a new access token and a new
+// refresh token. Each refresh token can be used once; presenting one that
+// was already used revokes every refresh token of its user, since it means
+// the token has leaked.
+func (s *server) refreshToken(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		RefreshToken string `json:"refresh_token"`
+	}
+
+	if !s.decodeBody(w, r, &body) {
+		return
+	}
+	if body.RefreshToken == "" {
+		invalidFields(w, r, FieldError{"refresh_token", "is required"})
+		return
+	}
+
+	ctx := r.Context()
+	stored, err := s.store.GetRefreshToken(ctx, hashToken(body.RefreshToken))
+	if errors.Is(err, ErrNotFound) {
+		writeProblem(w, r, http.StatusUnauthorized, problemUnauthorized, "Invalid or expired refresh token")
+		return
+	}
+	if err != nil {
+		internalError(w, r, err)
+		return
+	}
+
+	if stored.Revoked {
+		if err := s.store.RevokeUserRefreshTokens(ctx, stored.UserID); err != nil {
+			internalError(w, r, err)
+			return
+		}
+		writeProblem(w, r, http.StatusUnauthorized, problemUnauthorized, "Invalid or expired refresh token")
+		return
+	}
+	if s.now().Unix() >= stored.ExpiresAt {
+		writeProblem(w, r, http.StatusUnauthorized, problemUnauthorized, "Invalid or expired refresh token")
+		return
+	}
+
+	// Revoking first means only one of two concurrent refreshes wins
+	err = s.store.RevokeRefreshToken(ctx, stored.ID)
+	if errors.Is(err, ErrNotFound) {
+		writeProblem(w, r, http.StatusUnauthorized, problemUnauthorized, "Invalid or expired refresh token")
+		return
+	}
+	if err != nil {
+		internalError(w, r, err)
+		return
+	}
+
+	user, err := s.store.GetUser(ctx, stored.UserID)
+	if errors.Is(err, ErrNotFound) || (err == nil && user.Disabled) {
+		writeProblem(w, r, http.StatusUnauthorized, problemUnauthorized, "Invalid or expired refresh token")
+		return
+	}
+	if err != nil {
+		internalError(w, r, err)
+		return
+	}
+
+	s.issueTokens(w, r, user)
+}
+
+// logout revokes the access token used for the request and, when given,
+// the refresh token in the body
+func (s *server) logout(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		RefreshToken string `json:"refresh_token"`
+	}
+	if r.ContentLength != 0 {
+		if !s.decodeBody(w, r, &body) {
+			return
+		}
+	}
+
+	ctx := r.Context()
+	principal, _ := principalFromContext(ctx)
+	if principal.APIKeyID != 0 {
+		writeProblem(w, r, http.StatusBadRequest, problemBadRequest, "API keys are revoked with DELETE /apikeys/{id}")
+		return
+	}
+
+	err := s.store.RevokeToken(ctx, principal.TokenID, principal.ExpiresAt)
+	if err != nil {
+		internalError(w, r, err)
+		return
+	}
+
+	if body.RefreshToken != "" {
+		stored, err := s.store.GetRefreshToken(ctx, hashToken(body.RefreshToken))
+		if err == nil {
+			err = s.store.RevokeRefreshToken(ctx, stored.ID)
+		}
+		if err != nil && !errors.Is(err, ErrNotFound) {
+			internalError(w, r, err)
+			return
+		}
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt"
+)
+
+// postJSON sends a POST request with body and the given access token
+func postJSON(t *testing.T, router http.Handler, url, token string, body interface{}) *httptest.ResponseRecorder {
+	var buf bytes.Buffer
+	if body != nil {
+		if err := json.NewEncoder(&buf).Encode(body); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	req, err := http.NewRequest("POST", url, &buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	return rr
+}
+
+// loginTokens logs in as the seeded admin and returns the response body
+func loginTokens(t *testing.T, router http.Handler) map[string]string {
+	rr := postJSON(t, router, "/login", "", map[string]string{"username": "admin", "password": "password"})
+	if rr.Code != http.StatusOK {
+		t.Fatalf("login returned %d, expected %d", rr.Code, http.StatusOK)
+	}
+
+	var tokens map[string]string
+	if err := json.Unmarshal(rr.Body.Bytes(), &tokens); err != nil {
+		t.Fatal(err)
+	}
+	return tokens
+}
+
+// getBooksStatus requests /books with token and returns the status code
+func getBooksStatus(t *testing.T, router http.Handler, token string) int {
+	req, err := http.NewRequest("GET", "/books", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	return rr.Code
+}
+
+func TestLoginTokenClaims(t *testing.T) {
+	router := newTestServer(t)
+	tokens := loginTokens(t, router)
+
+	claims := &Claims{}
+	_, err := jwt.ParseWithClaims(tokens["token"], claims, func(token *jwt.Token) (interface{}, error) {
+		return []byte(testConfig.JWTSecret), nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if claims.Id == "" || claims.IssuedAt == 0 {
+		t.Errorf("expected jti and iat to be set, got %+v", claims.StandardClaims)
+	}
+	if ttl := time.Duration(claims.ExpiresAt-claims.IssuedAt) * time.Second; ttl != testConfig.AccessTokenTTL {
+		t.Errorf("expected the token to live %v, got %v", testConfig.AccessTokenTTL, ttl)
+	}
+	if tokens["refresh_token"] == "" {
+		t.Error("login didn't return a refresh token")
+	}
+}
+
+func TestRefreshTokenRotation(t *testing.T) {
+	router := newTestServer(t)
+	first := loginTokens(t, router)
+
+	rr := postJSON(t, router, "/token/refresh", "", map[string]string{"refresh_token": first["refresh_token"]})
+	if rr.Code != http.StatusOK {
+		t.Fatalf("refresh returned %d, expected %d", rr.Code, http.StatusOK)
+	}
+	var second map[string]string
+	if err := json.Unmarshal(rr.Body.Bytes(), &second); err != nil {
+		t.Fatal(err)
+	}
+	if second["refresh_token"] == first["refresh_token"] {
+		t.Error("refresh didn't rotate the refresh token")
+	}
+	if code := getBooksStatus(t, router, second["token"]); code != http.StatusOK {
+		t.Errorf("refreshed access token was rejected with %d", code)
+	}
+
+	// Reusing the first refresh token revokes the rotated one as well
+	rr = postJSON(t, router, "/token/refresh", "", map[string]string{"refresh_token": first["refresh_token"]})
+	if rr.Code != http.StatusUnauthorized {
+		t.Errorf("reused refresh token returned %d, expected %d", rr.Code, http.StatusUnauthorized)
+	}
+	rr = postJSON(t, router, "/token/refresh", "", map[string]string{"refresh_token": second["refresh_token"]})
+	if rr.Code != http.StatusUnauthorized {
+		t.Errorf("refresh token of a compromised family returned %d, expected %d", rr.Code, http.StatusUnauthorized)
+	}
+}
+
+func TestRefreshTokenExpiry(t *testing.T) {
+	router := newTestServer(t)
+	tokens := loginTokens(t, router)
+
+	router.now = func() time.Time { return time.Now().Add(testConfig.RefreshTokenTTL + time.Minute) }
+	rr := postJSON(t, router, "/token/refresh", "", map[string]string{"refresh_token": tokens["refresh_token"]})
+	if rr.Code != http.StatusUnauthorized {
+		t.Errorf("expired refresh token returned %d, expected %d", rr.Code, http.StatusUnauthorized)
+	}
+}
+
+func TestLogout(t *testing.T) {
+	router := newTestServer(t)
+	tokens := loginTokens(t, router)
+
+	rr := postJSON(t, router, "/logout", tokens["token"], map[string]string{"refresh_token": tokens["refresh_token"]})
+	if rr.Code != http.StatusNoContent {
+		t.Fatalf("logout returned %d, expected %d", rr.Code, http.StatusNoContent)
+	}
+
+	if code := getBooksStatus(t, router, tokens["token"]); code != http.StatusUnauthorized {
+		t.Errorf("revoked access token returned %d, expected %d", code, http.StatusUnauthorized)
+	}
+	rr = postJSON(t, router, "/token/refresh", "", map[string]string{"refresh_token": tokens["refresh_token"]})
+	if rr.Code != http.StatusUnauthorized {
+		t.Errorf("revoked refresh token returned %d, expected %d", rr.Code, http.StatusUnauthorized)
+	}
+}
+
+func TestValidateTokenRejectsExpiredAndNonExpiring(t *testing.T) {
+	router := newTestServer(t)
+
+	for name, claims := range map[string]jwt.StandardClaims{
+		"expired":      {Id: "expired", ExpiresAt: time.Now().Add(-time.Minute).Unix()},
+		"non-expiring": {Id: "forever"},
+	} {
+		token := jwt.NewWithClaims(jwt.SigningMethodHS256, &Claims{Username: "admin", StandardClaims: claims})
+		token.Header["kid"] = hmacKeyID
+		tokenString, err := token.SignedString([]byte(testConfig.JWTSecret))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if code := getBooksStatus(t, router, tokenString); code != http.StatusUnauthorized {
+			t.Errorf("%s token returned %d, expected %d", name, code, http.StatusUnauthorized)
+		}
+	}
+}
@@ -0,0 +1,296 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Config holds the settings needed to run the server.
+//
+// Values are resolved in this order, later sources overriding earlier ones:
+//  1. built-in defaults
+//  2. the YAML file named by -config or BOOKAPI_CONFIG
+//  3. BOOKAPI_* environment variables
+//  4. command-line flags
+type Config struct {
+	// Addr is the address the HTTP server listens on.
+	Addr string `yaml:"addr"`
+	// Store selects the storage backend: mysql, postgres, sqlite or memory.
+	Store string `yaml:"store"`
+	// DSN is the database connection string, or the file for sqlite. When
+	// empty the backend's default is used.
+	DSN string `yaml:"dsn"`
+	// JWTSecret is an HMAC key used to sign and verify tokens. It signs
+	// tokens only when no JWTKeys are configured.
+	JWTSecret string `yaml:"jwt_secret"`
+	// JWTKeys are RSA or ECDSA keys loaded from PEM files. Several keys may
+	// be listed to rotate them; all of them verify tokens.
+	JWTKeys []JWTKeyConfig `yaml:"jwt_keys"`
+	// JWTSigningKey is the id of the key new tokens are signed with. It
+	// defaults to the first key with a private key.
+	JWTSigningKey string `yaml:"jwt_signing_key"`
+	// AccessTokenTTL is how long an access token stays valid.
+	AccessTokenTTL time.Duration `yaml:"access_token_ttl"`
+	// RefreshTokenTTL is how long a refresh token can be exchanged for a new
+	// access token.
+	RefreshTokenTTL time.Duration `yaml:"refresh_token_ttl"`
+	// Roles maps each role to the permissions it grants. Setting it
+	// replaces the built-in reader, librarian and admin roles.
+	Roles Roles `yaml:"roles"`
+	// AdminUsername and AdminPassword describe an account created at startup
+	// when no user with that name exists yet. Leave AdminPassword empty once
+	// the first admin has been set up.
+	AdminUsername string `yaml:"admin_username"`
+	AdminPassword string `yaml:"admin_password"`
+	// Lockout throttles repeated failed logins per username and client IP.
+	Lockout LockoutConfig `yaml:"lockout"`
+	// AuditLog is the file security events such as lockouts are appended
+	// to. When empty they go to standard error.
+	AuditLog string `yaml:"audit_log"`
+	// RateLimits are the token buckets of the route groups auth, read and
+	// write, applied per user, API key or client IP. Groups without a
+	// limit are not limited.
+	RateLimits map[string]RateLimit `yaml:"rate_limits"`
+	// APIKeyDailyQuota limits the requests per day of API keys that don't
+	// set their own quota; zero means unlimited.
+	APIKeyDailyQuota int `yaml:"api_key_daily_quota"`
+	// OIDC enables logging in through an external identity provider next
+	// to the local accounts.
+	OIDC OIDCConfig `yaml:"oidc"`
+	// StrictJSON rejects request bodies with fields the endpoint doesn't
+	// know, which are otherwise ignored.
+	StrictJSON bool `yaml:"strict_json"`
+	// MaxPageSize is the most items a page of a list can have.
+	MaxPageSize int `yaml:"max_page_size"`
+	// SearchIndex is the file the search index is saved to, with its
+	// changes logged to SearchIndex + ".log". When empty the index is built
+	// from the store at every start and kept in memory.
+	SearchIndex string `yaml:"search_index"`
+}
+
+// minSecretLength is the shortest JWT secret accepted at startup.
+const minSecretLength = 16
+
+// defaultConfig returns the settings used when nothing else is configured.
+func defaultConfig() Config {
+	return Config{
+		Addr:          ":8000",
+		Store:         "mysql",
+		AdminUsername: "admin",
+		Roles:         defaultRoles(),
+
+		MaxPageSize: 100,
+
+		AccessTokenTTL:  15 * time.Minute,
+		RefreshTokenTTL: 30 * 24 * time.Hour,
+
+		Lockout: LockoutConfig{
+			Attempts:   5,
+			IPAttempts: 20,
+			BaseDelay:  30 * time.Second,
+			MaxDelay:   time.Hour,
+			ResetAfter: 24 * time.Hour,
+		},
+
+		RateLimits: map[string]RateLimit{
+			rateGroupAuth:  {Requests: 10, Per: time.Minute},
+			rateGroupRead:  {Requests: 20, Per: time.Second, Burst: 100},
+			rateGroupWrite: {Requests: 5, Per: time.Second, Burst: 20},
+		},
+
+		OIDC: OIDCConfig{
+			Scopes:        []string{"openid", "profile", "email"},
+			UsernameClaim: "preferred_username",
+			GroupsClaim:   "groups",
+		},
+	}
+}
+
+// loadConfig resolves the configuration from a config file, the environment
+// and the command-line arguments, then validates it. It returns the
+// arguments left over after the flags.
+func loadConfig(args []string, getenv func(string) string) (Config, []string, error) {
+	cfg := defaultConfig()
+
+	fs := flag.NewFlagSet("bookapi", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	configFile := fs.String("config", getenv("BOOKAPI_CONFIG"), "path to a YAML config file (env BOOKAPI_CONFIG)")
+	var flags Config
+	fs.StringVar(&flags.Addr, "addr", "", "listen address (env BOOKAPI_ADDR)")
+	fs.StringVar(&flags.Store, "store", "", "storage backend: mysql, postgres, sqlite or memory (env BOOKAPI_STORE)")
+	fs.StringVar(&flags.DSN, "dsn", "", "database data source name, or the database file for sqlite (env BOOKAPI_DSN)")
+	fs.StringVar(&flags.JWTSecret, "jwt-secret", "", "secret used to sign tokens (env BOOKAPI_JWT_SECRET)")
+	if err := fs.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			fs.SetOutput(os.Stderr)
+			fs.PrintDefaults()
+		}
+		return cfg, nil, err
+	}
+
+	if *configFile != "" {
+		if err := cfg.loadFile(*configFile); err != nil {
+			return cfg, nil, err
+		}
+	}
+
+	if err := cfg.loadEnv(getenv); err != nil {
+		return cfg, nil, err
+	}
+
+	// Only flags given explicitly override the other sources
+	fs.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "addr":
+			cfg.Addr = flags.Addr
+		case "store":
+			cfg.Store = flags.Store
+		case "dsn":
+			cfg.DSN = flags.DSN
+		case "jwt-secret":
+			cfg.JWTSecret = flags.JWTSecret
+		}
+	})
+
+	if err := cfg.validate(); err != nil {
+		return cfg, nil, err
+	}
+	return cfg, fs.Args(), nil
+}
+
+// loadFile merges the YAML file at path into cfg. Unknown keys are an error
+// so that typos don't silently fall back to defaults.
+func (cfg *Config) loadFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	// Decoding merges into maps, so clear the default roles and rate limits
+	// first and put them back only if the file doesn't define its own
+	defaults, defaultLimits := cfg.Roles, cfg.RateLimits
+	cfg.Roles, cfg.RateLimits = nil, nil
+
+	decoder := yaml.NewDecoder(f)
+	decoder.KnownFields(true)
+	if err := decoder.Decode(cfg); err != nil && err != io.EOF {
+		return fmt.Errorf("config file %s: %w", path, err)
+	}
+
+	if cfg.Roles == nil {
+		cfg.Roles = defaults
+	}
+	if cfg.RateLimits == nil {
+		cfg.RateLimits = defaultLimits
+	}
+	return nil
+}
+
+// loadEnv merges the BOOKAPI_* environment variables into cfg.
+func (cfg *Config) loadEnv(getenv func(string) string) error {
+	for name, field := range map[string]*string{
+		"BOOKAPI_ADDR":            &cfg.Addr,
+		"BOOKAPI_STORE":           &cfg.Store,
+		"BOOKAPI_DSN":             &cfg.DSN,
+		"BOOKAPI_JWT_SECRET":      &cfg.JWTSecret,
+		"BOOKAPI_JWT_SIGNING_KEY": &cfg.JWTSigningKey,
+		"BOOKAPI_ADMIN_USERNAME":  &cfg.AdminUsername,
+		"BOOKAPI_ADMIN_PASSWORD":  &cfg.AdminPassword,
+		"BOOKAPI_AUDIT_LOG":       &cfg.AuditLog,
+		"BOOKAPI_SEARCH_INDEX":    &cfg.SearchIndex,
+
+		"BOOKAPI_OIDC_ISSUER":        &cfg.OIDC.Issuer,
+		"BOOKAPI_OIDC_CLIENT_ID":     &cfg.OIDC.ClientID,
+		"BOOKAPI_OIDC_CLIENT_SECRET": &cfg.OIDC.ClientSecret,
+		"BOOKAPI_OIDC_REDIRECT_URL":  &cfg.OIDC.RedirectURL,
+	} {
+		if value := getenv(name); value != "" {
+			*field = value
+		}
+	}
+
+	for name, field := range map[string]*time.Duration{
+		"BOOKAPI_ACCESS_TOKEN_TTL":  &cfg.AccessTokenTTL,
+		"BOOKAPI_REFRESH_TOKEN_TTL": &cfg.RefreshTokenTTL,
+	} {
+		if value := getenv(name); value != "" {
+			d, err := time.ParseDuration(value)
+			if err != nil {
+				return fmt.Errorf("%s: %w", name, err)
+			}
+			*field = d
+		}
+	}
+
+	if value := getenv("BOOKAPI_STRICT_JSON"); value != "" {
+		strict, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("BOOKAPI_STRICT_JSON: %w", err)
+		}
+		cfg.StrictJSON = strict
+	}
+	return nil
+}
+
+// validate reports every problem with cfg at once.
+func (cfg *Config) validate() error {
+	var problems []string
+
+	if cfg.Addr == "" {
+		problems = append(problems, "addr must not be empty")
+	}
+	if _, ok := defaultDSNs[cfg.Store]; !ok && cfg.Store != "memory" {
+		problems = append(problems, fmt.Sprintf("unknown store %q", cfg.Store))
+	}
+	if cfg.JWTSecret != "" || len(cfg.JWTKeys) == 0 {
+		if len(cfg.JWTSecret) < minSecretLength {
+			problems = append(problems, fmt.Sprintf("jwt_secret must be at least %d characters", minSecretLength))
+		}
+	}
+	if len(cfg.JWTKeys) > 0 {
+		if _, err := loadKeySet(*cfg); err != nil {
+			problems = append(problems, err.Error())
+		}
+	}
+	if cfg.AccessTokenTTL <= 0 {
+		problems = append(problems, "access_token_ttl must be positive")
+	}
+	if cfg.RefreshTokenTTL < cfg.AccessTokenTTL {
+		problems = append(problems, "refresh_token_ttl must not be shorter than access_token_ttl")
+	}
+	problems = append(problems, cfg.Roles.validate()...)
+	if _, ok := cfg.Roles[roleAdmin]; !ok {
+		problems = append(problems, fmt.Sprintf("roles must define the %q role", roleAdmin))
+	}
+	problems = append(problems, cfg.Lockout.validate()...)
+	problems = append(problems, validateRateLimits(cfg.RateLimits)...)
+	if cfg.MaxPageSize <= 0 {
+		problems = append(problems, "max_page_size must be positive")
+	}
+	if cfg.APIKeyDailyQuota < 0 {
+		problems = append(problems, "api_key_daily_quota must not be negative")
+	}
+	problems = append(problems, cfg.OIDC.validate(cfg.Roles)...)
+	if cfg.AdminPassword != "" {
+		if cfg.AdminUsername == "" {
+			problems = append(problems, "admin_username must not be empty")
+		}
+		if len(cfg.AdminPassword) < minPasswordLength {
+			problems = append(problems, fmt.Sprintf("admin_password must be at least %d characters", minPasswordLength))
+		}
+	}
+
+	if len(problems) > 0 {
+		return errors.New("invalid configuration: " + strings.Join(problems, "; "))
+	}
+	return nil
+}
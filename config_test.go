@@ -0,0 +1,183 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// env returns a getenv function backed by vars
+func env(vars map[string]string) func(string) string {
+	return func(name string) string { return vars[name] }
+}
+
+func TestLoadConfigPrecedence(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "bookapi.yaml")
+	file := `
+addr: ":9000"
+store: sqlite
+dsn: file.db
+jwt_secret: file-secret-0123456789
+admin_username: root
+admin_password: from-file
+`
+	if err := os.WriteFile(path, []byte(file), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	vars := map[string]string{
+		"BOOKAPI_CONFIG":         path,
+		"BOOKAPI_DSN":            "env.db",
+		"BOOKAPI_ADMIN_PASSWORD": "from-env-password",
+		"BOOKAPI_STRICT_JSON":    "true",
+	}
+	cfg, args, err := loadConfig([]string{"-dsn", "flag.db", "migrate", "up"}, env(vars))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if cfg.Addr != ":9000" || cfg.Store != "sqlite" || cfg.JWTSecret != "file-secret-0123456789" {
+		t.Errorf("expected values from the config file, got %+v", cfg)
+	}
+	if cfg.DSN != "flag.db" {
+		t.Errorf("expected the flag to override the environment, got dsn %q", cfg.DSN)
+	}
+	if cfg.AdminUsername != "root" || cfg.AdminPassword != "from-env-password" {
+		t.Errorf("expected the environment to override the admin password, got %q/%q", cfg.AdminUsername, cfg.AdminPassword)
+	}
+	if !cfg.StrictJSON {
+		t.Error("expected BOOKAPI_STRICT_JSON to enable strict mode")
+	}
+	if strings.Join(args, " ") != "migrate up" {
+		t.Errorf("expected remaining arguments \"migrate up\", got %q", args)
+	}
+}
+
+func TestLoadConfigDefaults(t *testing.T) {
+	cfg, _, err := loadConfig(nil, env(map[string]string{"BOOKAPI_JWT_SECRET": "env-secret-0123456789"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Addr != ":8000" || cfg.Store != "mysql" || cfg.AdminUsername != "admin" {
+		t.Errorf("expected defaults, got %+v", cfg)
+	}
+}
+
+func TestLoadConfigValidation(t *testing.T) {
+	_, _, err := loadConfig([]string{"-store", "oracle", "-jwt-secret", "short"}, env(nil))
+	if err == nil {
+		t.Fatal("expected an invalid configuration error")
+	}
+	for _, problem := range []string{`unknown store "oracle"`, "jwt_secret must be at least"} {
+		if !strings.Contains(err.Error(), problem) {
+			t.Errorf("expected error to mention %q, got %v", problem, err)
+		}
+	}
+}
+
+func TestLoadConfigUnknownKey(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "bookapi.yaml")
+	if err := os.WriteFile(path, []byte("adr: \":9000\"\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, _, err := loadConfig([]string{"-config", path}, env(nil)); err == nil {
+		t.Error("expected an error for an unknown config key")
+	}
+}
+
+func TestLoadConfigRoles(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "bookapi.yaml")
+	file := `
+jwt_secret: file-secret-0123456789
+roles:
+  admin: ["*"]
+  cataloguer: ["read:*", "write:books"]
+`
+	if err := os.WriteFile(path, []byte(file), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg, _, err := loadConfig([]string{"-config", path}, env(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cfg.Roles) != 2 || !cfg.Roles.allows("cataloguer", permWriteBooks) {
+		t.Errorf("expected the configured roles to replace the defaults, got %v", cfg.Roles)
+	}
+
+	if err := os.WriteFile(path, []byte("jwt_secret: file-secret-0123456789\nroles:\n  reader: [\"read:books\"]\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := loadConfig([]string{"-config", path}, env(nil)); err == nil || !strings.Contains(err.Error(), `"admin" role`) {
+		t.Errorf("expected an error for a missing admin role, got %v", err)
+	}
+}
+
+func TestLoadConfigOIDC(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "bookapi.yaml")
+	file := `
+jwt_secret: file-secret-0123456789
+oidc:
+  issuer: https://sso.example.com
+  client_id: bookapi
+  role_mappings:
+    - group: staff
+      role: curator
+`
+	if err := os.WriteFile(path, []byte(file), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	vars := map[string]string{"BOOKAPI_OIDC_CLIENT_SECRET": "from-env"}
+	_, _, err := loadConfig([]string{"-config", path}, env(vars))
+	if err == nil {
+		t.Fatal("expected an invalid configuration error")
+	}
+	for _, problem := range []string{"oidc.redirect_url must not be empty", `unknown role "curator"`} {
+		if !strings.Contains(err.Error(), problem) {
+			t.Errorf("expected error to mention %q, got %v", problem, err)
+		}
+	}
+
+	vars["BOOKAPI_OIDC_REDIRECT_URL"] = "https://books.example.com/login/oidc/callback"
+	file = strings.Replace(file, "curator", "librarian", 1)
+	if err := os.WriteFile(path, []byte(file), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	cfg, _, err := loadConfig([]string{"-config", path}, env(vars))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.OIDC.ClientSecret != "from-env" || cfg.OIDC.UsernameClaim != "preferred_username" || len(cfg.OIDC.Scopes) != 3 {
+		t.Errorf("expected the secret from the environment and default claims, got %+v", cfg.OIDC)
+	}
+}
+
+func TestLoadConfigRateLimits(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "bookapi.yaml")
+	file := `
+jwt_secret: file-secret-0123456789
+rate_limits:
+  read: {requests: 100, per: 1m}
+`
+	if err := os.WriteFile(path, []byte(file), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg, _, err := loadConfig([]string{"-config", path}, env(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cfg.RateLimits) != 1 || cfg.RateLimits[rateGroupRead].capacity() != 100 {
+		t.Errorf("expected only the configured read limit, got %+v", cfg.RateLimits)
+	}
+
+	if err := os.WriteFile(path, []byte("jwt_secret: file-secret-0123456789\nrate_limits:\n  search: {requests: 1, per: 1s}\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := loadConfig([]string{"-config", path}, env(nil)); err == nil || !strings.Contains(err.Error(), `unknown route group "search"`) {
+		t.Errorf("expected an error for an unknown route group, got %v", err)
+	}
+}
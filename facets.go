@@ -0,0 +1,115 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// Facets books can be counted by
+const (
+	facetYear          = "year"
+	facetDecade        = "decade"
+	facetLanguage      = "language"
+	facetGenre         = "genre"
+	facetAuthorCountry = "author_country"
+)
+
+var bookFacets = []string{facetYear, facetDecade, facetLanguage, facetGenre, facetAuthorCountry}
+
+// maxFacetIDs is the number of books a search counts facets over in one
+// query, which keeps its "id IN" list within what every database accepts
+const maxFacetIDs = 500
+
+// FacetCount is the number of items with a value of a facet
+type FacetCount struct {
+	Value string `json:"value"`
+	Count int    `json:"count"`
+}
+
+// Facets holds the counts of each facet asked for
+type Facets map[string][]FacetCount
+
+// facetCounter counts the items that pass filters by each value of the
+// named facets
+type facetCounter func(ctx context.Context, names []string, filters []Filter) (Facets, error)
+
+// facetedPage is the body of a page sent with facet counts
+type facetedPage[T any] struct {
+	Items  []T    `json:"items"`
+	Facets Facets `json:"facets"`
+}
+
+// decade returns the decade of a year, such as 1990s for 1994, or "" if
+// the year is empty
+func decade(year string) string {
+	if len(year) != 4 {
+		return ""
+	}
+	return year[:3] + "0s"
+}
+
+// facetCounts orders the counts of a facet: years and decades in time
+// order, and other values most common first
+func facetCounts(name string, counts map[string]int) []FacetCount {
+	buckets := []FacetCount{}
+	for value, count := range counts {
+		buckets = append(buckets, FacetCount{value, count})
+	}
+	slices.SortFunc(buckets, func(a, b FacetCount) int {
+		if name == facetYear || name == facetDecade {
+			return strings.Compare(a.Value, b.Value)
+		}
+		return cmp.Or(cmp.Compare(b.Count, a.Count), strings.Compare(a.Value, b.Value))
+	})
+	return buckets
+}
+
+// parseFacets reads a comma separated list of facets to count
+func parseFacets(value string) ([]string, []FieldError) {
+	var names []string
+	for _, name := range strings.Split(value, ",") {
+		if !slices.Contains(bookFacets, name) {
+			return nil, []FieldError{{"facets", fmt.Sprintf("must be a list of %s", strings.Join(bookFacets, ", "))}}
+		}
+		if !slices.Contains(names, name) {
+			names = append(names, name)
+		}
+	}
+	return names, nil
+}
+
+// searchFacets counts the books among results by the named facets, asking
+// the store about maxFacetIDs books at a time and adding up the counts
+func (s *server) searchFacets(ctx context.Context, names []string, results []SearchResult) (Facets, error) {
+	var ids []any
+	for _, result := range results {
+		if result.Type == searchBook {
+			ids = append(ids, result.ID)
+		}
+	}
+
+	sums := make(map[string]map[string]int)
+	for _, name := range names {
+		sums[name] = make(map[string]int)
+	}
+	for chunk := range slices.Chunk(ids, maxFacetIDs) {
+		facets, err := s.store.BookFacets(ctx, names, []Filter{{Field: "id", Op: opIn, Values: chunk}})
+		if err != nil {
+			return nil, err
+		}
+		for name, counts := range facets {
+			for _, count := range counts {
+				sums[name][count.Value] += count.Count
+			}
+		}
+	}
+
+	facets := make(Facets)
+	for name, counts := range sums {
+		facets[name] = facetCounts(name, counts)
+	}
+	return facets, nil
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"testing"
+)
+
+// newFacetTestServer returns a test server with these books besides the
+// two seeded ones. Book 5 has two British authors and book 6 shares the
+// Indonesian author of book 2.
+func newFacetTestServer(t *testing.T) *server {
+	s := newTestServer(t)
+	for _, book := range []Book{
+		{Title: "Dune: A Novel", PublishedYear: "1965", Language: "en", Genre: "science fiction"},
+		{Title: "Solaris: A Novel", PublishedYear: "1961", Language: "pl", Genre: "science fiction"},
+		{Title: "Emma: A Novel", PublishedYear: "1815", Language: "en", Genre: "romance"},
+		{Title: "Cantik Itu Luka", PublishedYear: "2002", Language: "id"},
+	} {
+		if rr := serveJSON(t, s, "POST", "/books", book); rr.Code != http.StatusOK {
+			t.Fatalf("POST /books: got %d, expected %d", rr.Code, http.StatusOK)
+		}
+	}
+
+	ctx := context.Background()
+	for _, author := range []Author{
+		{Name: "Frank Herbert", Country: "US"},
+		{Name: "Stanisław Lem", Country: "PL"},
+		{Name: "Jane Austen", Country: "GB"},
+		{Name: "Cassandra Austen", Country: "GB"},
+	} {
+		if err := s.store.CreateAuthor(ctx, &author); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, link := range [][2]int{{2, 3}, {3, 4}, {4, 5}, {5, 5}, {1, 6}} {
+		if err := s.store.CreateAuthorBook(ctx, &AuthorBook{AuthorID: link[0], BookID: link[1]}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return s
+}
+
+// getFacets requests a list with facets and returns its facets and the
+// number of items on its page
+func getFacets(t *testing.T, s *server, target string) (Facets, int) {
+	t.Helper()
+
+	rr := serveJSON(t, s, "GET", target, nil)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("GET %s: got %d, expected %d", target, rr.Code, http.StatusOK)
+	}
+	var page struct {
+		Items  []json.RawMessage `json:"items"`
+		Facets Facets            `json:"facets"`
+	}
+	if err := json.NewDecoder(rr.Body).Decode(&page); err != nil {
+		t.Fatal(err)
+	}
+	return page.Facets, len(page.Items)
+}
+
+func TestBookFacets(t *testing.T) {
+	s := newFacetTestServer(t)
+
+	facets, items := getFacets(t, s, "/books?facets=year,decade,language,genre,author_country&limit=2")
+	expected := Facets{
+		facetYear:          {{"1815", 1}, {"1961", 1}, {"1965", 1}, {"2001", 1}, {"2002", 2}},
+		facetDecade:        {{"1810s", 1}, {"1960s", 2}, {"2000s", 3}},
+		facetLanguage:      {{"en", 2}, {"id", 1}, {"pl", 1}},
+		facetGenre:         {{"science fiction", 2}, {"romance", 1}},
+		facetAuthorCountry: {{"ID", 2}, {"GB", 1}, {"PL", 1}, {"US", 1}},
+	}
+	if !reflect.DeepEqual(facets, expected) {
+		t.Errorf("got facets %v, expected %v", facets, expected)
+	}
+	if items != 2 {
+		t.Errorf("got %d items, expected a page of 2", items)
+	}
+
+	// Facets count the books that pass the filters
+	tests := []struct {
+		target string
+		facets Facets
+	}{
+		{"/books?genre=science+fiction&facets=decade,author_country", Facets{
+			facetDecade:        {{"1960s", 2}},
+			facetAuthorCountry: {{"PL", 1}, {"US", 1}},
+		}},
+		{"/books?author_country=GB&facets=language", Facets{facetLanguage: {{"en", 1}}}},
+		{"/books?language[in]=id,pl&facets=genre,genre", Facets{facetGenre: {{"science fiction", 1}}}},
+		{"/books?published_year[gt]=2002&facets=year", Facets{facetYear: {}}},
+	}
+	for _, test := range tests {
+		if facets, _ := getFacets(t, s, test.target); !reflect.DeepEqual(facets, test.facets) {
+			t.Errorf("GET %s: got facets %v, expected %v", test.target, facets, test.facets)
+		}
+	}
+}
+
+func TestBookFacetsAcrossStores(t *testing.T) {
+	for _, kind := range testStoreKinds() {
+		t.Run(kind, func(t *testing.T) {
+			store := newTestStore(t, kind)
+			ctx := context.Background()
+
+			// Years from before they were validated may be short, and only
+			// those of four digits have a decade
+			for _, year := range []string{"1999", "199", "", "2001", "2005"} {
+				if err := store.CreateBook(ctx, &Book{Title: "Old", PublishedYear: year}); err != nil {
+					t.Fatal(err)
+				}
+			}
+			facets, err := store.BookFacets(ctx, []string{facetYear, facetDecade}, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			expected := Facets{
+				facetYear:   {{"199", 1}, {"1999", 1}, {"2001", 1}, {"2005", 1}},
+				facetDecade: {{"1990s", 1}, {"2000s", 2}},
+			}
+			if !reflect.DeepEqual(facets, expected) {
+				t.Errorf("got facets %v, expected %v", facets, expected)
+			}
+		})
+	}
+}
+
+func TestSearchFacets(t *testing.T) {
+	s := newFacetTestServer(t)
+
+	facets, items := getFacets(t, s, "/search?q=novel&facets=genre,language&limit=1")
+	expected := Facets{
+		facetGenre:    {{"science fiction", 2}, {"romance", 1}},
+		facetLanguage: {{"en", 2}, {"pl", 1}},
+	}
+	if !reflect.DeepEqual(facets, expected) {
+		t.Errorf("got facets %v, expected %v", facets, expected)
+	}
+	if items != 1 {
+		t.Errorf("got %d results, expected a page of 1", items)
+	}
+
+	if facets, _ := getFacets(t, s, "/search?q=austen&facets=year"); !reflect.DeepEqual(facets, Facets{facetYear: {}}) {
+		t.Errorf("search for authors: got facets %v, expected none", facets)
+	}
+}
+
+func TestInvalidFacets(t *testing.T) {
+	s := newFacetTestServer(t)
+
+	for _, target := range []string{"/books?facets=", "/books?facets=year,colour", "/authors?facets=year", "/search?q=novel&facets=title"} {
+		decodeProblem(t, serveJSON(t, s, "GET", target, nil), http.StatusBadRequest, problemValidation)
+	}
+
+	// Without facets lists stay plain arrays
+	rr := serveJSON(t, s, "GET", "/books", nil)
+	var books []Book
+	if err := json.NewDecoder(rr.Body).Decode(&books); err != nil || len(books) != 6 {
+		t.Errorf("got %d books, %v, expected an array of 6", len(books), err)
+	}
+}
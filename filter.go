@@ -0,0 +1,268 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"maps"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// Filter operators. A query parameter without an operator, such as
+// ?country=ID, tests for equality.
+const (
+	opEq     = "eq"
+	opIn     = "in"
+	opPrefix = "prefix"
+	opGt     = "gt"
+	opGte    = "gte"
+	opLt     = "lt"
+	opLte    = "lte"
+)
+
+var (
+	rangeOps = []string{opEq, opIn, opGt, opGte, opLt, opLte}
+	textOps  = []string{opEq, opIn, opPrefix}
+)
+
+// Filter keeps the items of a list whose field compares to Values with Op.
+// Only the "in" operator has more than one value. Range operators never
+// match an empty text field.
+type Filter struct {
+	Field  string
+	Op     string
+	Values []any
+}
+
+// SortKey orders a list by a field
+type SortKey struct {
+	Field string
+	Desc  bool
+}
+
+// Position is the place of an item in a sorted list: its values of the
+// sort keys, followed by its ID, which breaks ties.
+type Position struct {
+	Values []any
+	ID     int
+}
+
+// listField is a field lists can be filtered and sorted by
+type listField[T any] struct {
+	// column is the SQL expression of the field
+	column string
+	// value returns the field of an item, an int when number is set and
+	// a string otherwise
+	value  func(T) any
+	number bool
+	// parse checks and normalises a value to filter by, if set
+	parse func(string) (any, error)
+	ops   []string
+	// subquery selects the IDs of the items with a value of the field
+	// when it is held in another table, with column naming it there. An
+	// item can then have several values, which value returns as a []any,
+	// so the field can be filtered by but not sorted by.
+	subquery string
+}
+
+// listFields are the fields of a list that can be filtered and sorted by.
+// Names and operators from a query are only looked up here, so they never
+// reach SQL themselves.
+type listFields[T any] map[string]listField[T]
+
+var bookFields = listFields[Book]{
+	"id":             {column: "id", value: func(b Book) any { return b.ID }, number: true, ops: rangeOps},
+	"title":          {column: "title", value: func(b Book) any { return b.Title }, ops: textOps},
+	"published_year": {column: "published_year", value: func(b Book) any { return b.PublishedYear }, parse: parseYear, ops: rangeOps},
+	"isbn":           {column: "COALESCE(isbn, '')", value: func(b Book) any { return string(b.ISBN) }, parse: parseISBNFilter, ops: textOps},
+	"language":       {column: "language", value: func(b Book) any { return b.Language }, parse: parseLanguage, ops: []string{opEq, opIn}},
+	"genre":          {column: "genre", value: func(b Book) any { return b.Genre }, ops: textOps},
+	// The memory store sets the value of author_country, which needs the
+	// authors of a book
+	"author_country": {
+		column:   "a.country",
+		subquery: "SELECT ab.book_id FROM author_books ab JOIN authors a ON a.id = ab.author_id",
+		value:    func(Book) any { return []any{} },
+		parse:    parseCountry,
+		ops:      []string{opEq, opIn},
+	},
+}
+
+var authorFields = listFields[Author]{
+	"id":      {column: "id", value: func(a Author) any { return a.ID }, number: true, ops: rangeOps},
+	"name":    {column: "name", value: func(a Author) any { return a.Name }, ops: textOps},
+	"country": {column: "country", value: func(a Author) any { return a.Country }, parse: parseCountry, ops: []string{opEq, opIn}},
+}
+
+// parseYear reads a year. Years are stored as text, which only compares
+// like numbers between years of four digits, so it must be one from
+// minPublishedYear to 9999 and is returned as text.
+func parseYear(s string) (any, error) {
+	year, err := strconv.Atoi(s)
+	if err != nil || year < minPublishedYear || year > 9999 {
+		return nil, fmt.Errorf("must be a year from %d to 9999", minPublishedYear)
+	}
+	return strconv.Itoa(year), nil
+}
+
+// parseISBNFilter reads a whole ISBN, which is turned into an ISBN-13, or
+// the digits an ISBN starts with
+func parseISBNFilter(s string) (any, error) {
+	if isbn, err := ParseISBN(s); err == nil {
+		return string(isbn), nil
+	}
+	digits := strings.NewReplacer("-", "", " ", "").Replace(s)
+	if digits == "" || !allDigits(digits) {
+		return nil, errors.New("must be an ISBN or its first digits")
+	}
+	return digits, nil
+}
+
+func parseCountry(s string) (any, error) {
+	code := strings.ToUpper(s)
+	if msg := countryCode(code); msg != "" {
+		return nil, errors.New(msg)
+	}
+	return code, nil
+}
+
+func parseLanguage(s string) (any, error) {
+	code := strings.ToLower(s)
+	if msg := languageCode(code); msg != "" {
+		return nil, errors.New(msg)
+	}
+	return code, nil
+}
+
+// parseValue reads a value to filter the field by
+func (f listField[T]) parseValue(s string) (any, error) {
+	if f.parse != nil {
+		return f.parse(s)
+	}
+	return f.cursorValue(s)
+}
+
+// cursorValue reads a value of the field back from a cursor. Unlike
+// parseValue it accepts anything the field can hold.
+func (f listField[T]) cursorValue(s string) (any, error) {
+	if !f.number {
+		return s, nil
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil {
+		return nil, errors.New("must be a number")
+	}
+	return n, nil
+}
+
+// column returns the SQL expression of a field that check accepted
+func (fields listFields[T]) column(name string) string {
+	return fields[name].column
+}
+
+func (fields listFields[T]) subquery(name string) string {
+	return fields[name].subquery
+}
+
+// sortable tells whether a list can be sorted by a field
+func (fields listFields[T]) sortable(name string) bool {
+	f, ok := fields[name]
+	return ok && f.subquery == ""
+}
+
+// check returns an error unless every filter and sort key of opts uses a
+// field and operator that fields allows
+func (fields listFields[T]) check(opts ListOptions) error {
+	for _, filter := range opts.Filters {
+		f, ok := fields[filter.Field]
+		if !ok || !slices.Contains(f.ops, filter.Op) {
+			return fmt.Errorf("can't filter by %q with %q", filter.Field, filter.Op)
+		}
+	}
+	for _, key := range opts.Sort {
+		if !fields.sortable(key.Field) {
+			return fmt.Errorf("can't sort by %q", key.Field)
+		}
+	}
+	return nil
+}
+
+// position returns the position of item in a list sorted by keys
+func (fields listFields[T]) position(item T, keys []SortKey) Position {
+	pos := Position{ID: fields["id"].value(item).(int)}
+	for _, key := range keys {
+		pos.Values = append(pos.Values, fields[key.Field].value(item))
+	}
+	return pos
+}
+
+// listParameters are the query parameters of a list that aren't filters
+var listParameters = map[string]bool{"limit": true, "offset": true, "cursor": true, "sort": true, "facets": true}
+
+// parseFilters reads every query parameter that isn't one of
+// listParameters as a filter: field=value, field[op]=value or, for the
+// "in" operator, field[in]=value,value
+func parseFilters[T any](query url.Values, fields listFields[T]) ([]Filter, []FieldError) {
+	var filters []Filter
+	var errs []FieldError
+
+	for _, key := range slices.Sorted(maps.Keys(query)) {
+		if listParameters[key] {
+			continue
+		}
+		name, op := key, opEq
+		if i := strings.IndexByte(key, '['); i > 0 && strings.HasSuffix(key, "]") {
+			name, op = key[:i], key[i+1:len(key)-1]
+		}
+		f, ok := fields[name]
+		if !ok {
+			errs = append(errs, FieldError{key, "isn't a field that can be filtered by"})
+			continue
+		}
+		if !slices.Contains(f.ops, op) {
+			errs = append(errs, FieldError{key, fmt.Sprintf("%s can only be filtered with %s", name, strings.Join(f.ops, ", "))})
+			continue
+		}
+
+	values:
+		for _, value := range query[key] {
+			parts := []string{value}
+			if op == opIn {
+				parts = strings.Split(value, ",")
+			}
+			filter := Filter{Field: name, Op: op}
+			for _, part := range parts {
+				v, err := f.parseValue(part)
+				if err != nil {
+					errs = append(errs, FieldError{key, err.Error()})
+					break values
+				}
+				filter.Values = append(filter.Values, v)
+			}
+			filters = append(filters, filter)
+		}
+	}
+	return filters, errs
+}
+
+// parseSort reads a comma separated list of fields to sort by, each
+// descending when it starts with "-"
+func parseSort[T any](value string, fields listFields[T]) ([]SortKey, []FieldError) {
+	if value == "" {
+		return nil, nil
+	}
+
+	var keys []SortKey
+	var errs []FieldError
+	for _, name := range strings.Split(value, ",") {
+		key := SortKey{Field: strings.TrimPrefix(name, "-"), Desc: strings.HasPrefix(name, "-")}
+		if !fields.sortable(key.Field) {
+			errs = append(errs, FieldError{"sort", fmt.Sprintf("%q isn't a field that can be sorted by", key.Field)})
+			continue
+		}
+		keys = append(keys, key)
+	}
+	return keys, errs
+}
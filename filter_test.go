@@ -0,0 +1,160 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"reflect"
+	"strconv"
+	"testing"
+)
+
+// newFilterTestServer returns a test server with these books besides the
+// two seeded ones, and authors from Indonesia and Great Britain
+func newFilterTestServer(t *testing.T) *server {
+	s := newTestServer(t)
+	ctx := context.Background()
+	books := []Book{
+		{Title: "The Hobbit", PublishedYear: "1937"},
+		{Title: "Lowland", PublishedYear: "1995"},
+		{Title: "Beauty Is a Wound", PublishedYear: "2002", ISBN: "9780811223638"},
+		{Title: "100% Book", PublishedYear: "1990"},
+		{Title: "Anthology", PublishedYear: "1998"},
+		{Title: "the Last Word"},
+		{Title: "Anthology", PublishedYear: "2000"},
+	}
+	for i := range books {
+		if err := s.store.CreateBook(ctx, &books[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, author := range []Author{{Name: "Eka Kurniawan", Country: "ID"}, {Name: "Zadie Smith", Country: "GB"}} {
+		if err := s.store.CreateAuthor(ctx, &author); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return s
+}
+
+// listIDs requests a list and returns the IDs of its items, their total
+// count and the links to other pages
+func listIDs(t *testing.T, s *server, rawURL string) ([]int, string, map[string]string) {
+	t.Helper()
+
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u.RawQuery = u.Query().Encode()
+	rr := serveJSON(t, s, "GET", u.String(), nil)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("GET %s: got %d, expected %d", rawURL, rr.Code, http.StatusOK)
+	}
+
+	var items []struct {
+		ID int `json:"id"`
+	}
+	if err := json.NewDecoder(rr.Body).Decode(&items); err != nil {
+		t.Fatal(err)
+	}
+	ids := []int{}
+	for _, item := range items {
+		ids = append(ids, item.ID)
+	}
+	return ids, rr.Header().Get("X-Total-Count"), parseLinks(rr.Header().Get("Link"))
+}
+
+func TestFilters(t *testing.T) {
+	s := newFilterTestServer(t)
+
+	tests := []struct {
+		url string
+		ids []int
+	}{
+		{"/books?published_year[gte]=1990&published_year[lte]=2000&sort=title", []int{6, 7, 9, 4}},
+		{"/books?published_year[lt]=1990", []int{3}},
+		{"/books?published_year=2002&sort=-id", []int{5, 2}},
+		{"/books?title[prefix]=the", []int{3, 8}},
+		{"/books?title[prefix]=100%25", []int{6}},
+		{"/books?title[prefix]=_", []int{}},
+		{"/books?title[in]=Lowland,Anthology", []int{4, 7, 9}},
+		{"/books?isbn=0-8112-2363-9", []int{5}},
+		{"/books?isbn[prefix]=978-1", []int{1}},
+		{"/books?title=' OR 1=1 --", []int{}},
+		{"/books?author_country=id", []int{2}},
+		{"/books?author_country[in]=GB,US", []int{}},
+		{"/authors?country=id", []int{1, 2}},
+		{"/authors?country[in]=GB,ID&sort=-name", []int{3, 1, 2}},
+		{"/authors?name[prefix]=eka&country=ID", []int{2}},
+	}
+	for _, test := range tests {
+		ids, total, _ := listIDs(t, s, test.url)
+		if !reflect.DeepEqual(ids, test.ids) {
+			t.Errorf("GET %s: got %v, expected %v", test.url, ids, test.ids)
+		}
+		if total != strconv.Itoa(len(test.ids)) {
+			t.Errorf("GET %s: got X-Total-Count %s, expected %d", test.url, total, len(test.ids))
+		}
+	}
+}
+
+func TestSortedCursorPagination(t *testing.T) {
+	s := newFilterTestServer(t)
+
+	// The two Anthologies tie on title, so the newer comes first
+	expected := []int{6, 9, 7, 5, 1, 4, 2, 3, 8}
+	var ids []int
+	url := "/books?sort=title,-published_year&limit=2"
+	for url != "" && len(ids) < len(expected) {
+		page, total, links := listIDs(t, s, url)
+		if total != "9" {
+			t.Errorf("GET %s: got X-Total-Count %s, expected 9", url, total)
+		}
+		ids = append(ids, page...)
+		url = links["next"]
+	}
+	if !reflect.DeepEqual(ids, expected) {
+		t.Errorf("got %v, expected %v", ids, expected)
+	}
+
+	_, _, links := listIDs(t, s, "/books?sort=title,-published_year&limit=3")
+	_, _, links = listIDs(t, s, links["next"])
+	page, _, _ := listIDs(t, s, links["prev"])
+	if !reflect.DeepEqual(page, expected[:3]) {
+		t.Errorf("got previous page %v, expected %v", page, expected[:3])
+	}
+}
+
+func TestInvalidFilters(t *testing.T) {
+	s := newFilterTestServer(t)
+
+	// A cursor is only valid with the sort it was made for
+	_, _, links := listIDs(t, s, "/books?sort=title&limit=2")
+	next, err := url.Parse(links["next"])
+	if err != nil {
+		t.Fatal(err)
+	}
+	query := next.Query()
+	query.Set("sort", "-title")
+
+	for _, target := range []string{
+		"/books?subtitle=x",
+		"/books?title[gt]=A",
+		"/books?title[regex]=.*",
+		"/books?published_year[gte]=soon",
+		"/books?published_year[gt]=999",
+		"/books?published_year[lt]=10000",
+		"/books?id[in]=1,two",
+		"/books?isbn=abc",
+		"/authors?country=Indonesia",
+		"/books?language=english",
+		"/books?author_country[gt]=GB",
+		"/books?sort=author_country",
+		"/books?sort=" + url.QueryEscape("title;DROP TABLE books"),
+		"/books?sort=-subtitle",
+		"/books?" + query.Encode(),
+	} {
+		decodeProblem(t, serveJSON(t, s, "GET", target, nil), http.StatusBadRequest, problemValidation)
+	}
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// ISBN is an International Standard Book Number in its 13 digit form,
+// without hyphens. The zero value means a book has no ISBN.
+type ISBN string
+
+var errInvalidISBN = errors.New("invalid ISBN")
+
+// ParseISBN parses an ISBN-10 or ISBN-13, plain or with hyphens or spaces,
+// checks its check digit and returns it as an ISBN-13.
+func ParseISBN(s string) (ISBN, error) {
+	digits := strings.Map(func(r rune) rune {
+		switch {
+		case r == '-' || r == ' ':
+			return -1
+		case r == 'x':
+			return 'X'
+		}
+		return r
+	}, s)
+
+	switch len(digits) {
+	case 10:
+		if !isbn10Valid(digits) {
+			return "", fmt.Errorf("%w %q: wrong check digit or not an ISBN-10", errInvalidISBN, s)
+		}
+		return isbn13("978" + digits[:9]), nil
+	case 13:
+		if !allDigits(digits) || isbn13(digits[:12]) != ISBN(digits) {
+			return "", fmt.Errorf("%w %q: wrong check digit or not an ISBN-13", errInvalidISBN, s)
+		}
+		if !strings.HasPrefix(digits, "978") && !strings.HasPrefix(digits, "979") {
+			return "", fmt.Errorf("%w %q: an ISBN-13 starts with 978 or 979", errInvalidISBN, s)
+		}
+		return ISBN(digits), nil
+	}
+	return "", fmt.Errorf("%w %q: must have 10 or 13 digits", errInvalidISBN, s)
+}
+
+// isbn10Valid checks an ISBN-10, whose digits are weighted 10 down to 1 and
+// sum to a multiple of 11. The check digit X stands for 10.
+func isbn10Valid(digits string) bool {
+	sum := 0
+	for i, d := range digits {
+		value := int(d - '0')
+		if d == 'X' && i == 9 {
+			value = 10
+		} else if d < '0' || d > '9' {
+			return false
+		}
+		sum += (10 - i) * value
+	}
+	return sum%11 == 0
+}
+
+// isbn13 completes the first 12 digits of an ISBN-13 with its check digit.
+// The digits are weighted 1, 3, 1, 3... and sum to a multiple of 10.
+func isbn13(first12 string) ISBN {
+	sum := 0
+	for i, d := range first12 {
+		sum += (1 + 2*(i%2)) * int(d-'0')
+	}
+	return ISBN(first12 + strconv.Itoa((10-sum%10)%10))
+}
+
+func allDigits(s string) bool {
+	for _, d := range s {
+		if d < '0' || d > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// String returns the ISBN-13
+func (i ISBN) String() string {
+	return string(i)
+}
+
+// ISBN10 returns the ISBN-10 form. Only ISBNs starting with 978 have one.
+func (i ISBN) ISBN10() (string, bool) {
+	if len(i) != 13 || !strings.HasPrefix(string(i), "978") {
+		return "", false
+	}
+
+	first9 := string(i[3:12])
+	sum := 0
+	for n, d := range first9 {
+		sum += (10 - n) * int(d-'0')
+	}
+	check := (11 - sum%11) % 11
+	if check == 10 {
+		return first9 + "X", true
+	}
+	return first9 + strconv.Itoa(check), true
+}
+
+// valid reports whether i is a parsed ISBN-13
+func (i ISBN) valid() bool {
+	parsed, err := ParseISBN(string(i))
+	return err == nil && parsed == i
+}
+
+func (i ISBN) MarshalJSON() ([]byte, error) {
+	if i == "" {
+		return []byte("null"), nil
+	}
+	return json.Marshal(string(i))
+}
+
+// UnmarshalJSON accepts an ISBN as a string or, as earlier versions of the
+// API sent it, a number, where 0 meant no ISBN. A value that doesn't parse is kept as it was sent
+// so that validation can report it with the other invalid fields.
+func (i *ISBN) UnmarshalJSON(data []byte) error {
+	var s string
+	switch {
+	case string(data) == "null":
+	case len(data) > 0 && data[0] == '"':
+		if err := json.Unmarshal(data, &s); err != nil {
+			return err
+		}
+	default:
+		var n json.Number
+		if err := json.Unmarshal(data, &n); err != nil {
+			return err
+		}
+		// Older clients sent 0 for no ISBN, and numbers lose the leading
+		// zeros of an ISBN-10
+		s = n.String()
+		if s == "0" {
+			s = ""
+		} else if len(s) < 10 {
+			s = strings.Repeat("0", 10-len(s)) + s
+		}
+	}
+
+	*i = ISBN(s)
+	if parsed, err := ParseISBN(s); err == nil {
+		*i = parsed
+	}
+	return nil
+}
+
+// Value stores a book without an ISBN as NULL, which the unique constraint
+// on the column allows any number of times
+func (i ISBN) Value() (driver.Value, error) {
+	if i == "" {
+		return nil, nil
+	}
+	return string(i), nil
+}
+
+func (i *ISBN) Scan(src any) error {
+	switch src := src.(type) {
+	case nil:
+		*i = ""
+	case string:
+		*i = ISBN(src)
+	case []byte:
+		*i = ISBN(src)
+	default:
+		return fmt.Errorf("cannot scan %T into an ISBN", src)
+	}
+	return nil
+}
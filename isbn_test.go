@@ -0,0 +1,138 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"testing"
+)
+
+func TestParseISBN(t *testing.T) {
+	tests := []struct {
+		input string
+		isbn  ISBN
+	}{
+		{"0306406152", "9780306406157"},
+		{"0-306-40615-2", "9780306406157"},
+		{"978-0-306-40615-7", "9780306406157"},
+		{"978 0 306 40615 7", "9780306406157"},
+		{"080442957X", "9780804429573"},
+		{"080442957x", "9780804429573"},
+		{"9791090636071", "9791090636071"},
+	}
+	for _, test := range tests {
+		isbn, err := ParseISBN(test.input)
+		if err != nil || isbn != test.isbn {
+			t.Errorf("ParseISBN(%q) = %q, %v; expected %q", test.input, isbn, err, test.isbn)
+		}
+	}
+
+	for _, input := range []string{"", "0306406153", "9780306406158", "12345", "X306406152", "9771234567003", "97803064061a7"} {
+		if isbn, err := ParseISBN(input); !errors.Is(err, errInvalidISBN) {
+			t.Errorf("ParseISBN(%q) = %q, %v; expected an invalid ISBN", input, isbn, err)
+		}
+	}
+}
+
+func TestISBN10(t *testing.T) {
+	tests := []struct {
+		isbn   ISBN
+		isbn10 string
+		ok     bool
+	}{
+		{"9780306406157", "0306406152", true},
+		{"9780804429573", "080442957X", true},
+		{"9791090636071", "", false},
+	}
+	for _, test := range tests {
+		isbn10, ok := test.isbn.ISBN10()
+		if isbn10 != test.isbn10 || ok != test.ok {
+			t.Errorf("%s.ISBN10() = %q, %v; expected %q, %v", test.isbn, isbn10, ok, test.isbn10, test.ok)
+		}
+	}
+}
+
+func TestISBNJSON(t *testing.T) {
+	tests := []struct {
+		input string
+		isbn  ISBN
+	}{
+		{`"0-306-40615-2"`, "9780306406157"},
+		{`306406152`, "9780306406157"},
+		{`9780306406157`, "9780306406157"},
+		{`null`, ""},
+		{`0`, ""},
+		{`""`, ""},
+		{`"not an isbn"`, "not an isbn"},
+	}
+	for _, test := range tests {
+		var isbn ISBN
+		if err := json.Unmarshal([]byte(test.input), &isbn); err != nil || isbn != test.isbn {
+			t.Errorf("unmarshal %s = %q, %v; expected %q", test.input, isbn, err, test.isbn)
+		}
+	}
+
+	data, err := json.Marshal(Book{Title: "Book", ISBN: "9780306406157"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := `{"id":0,"title":"Book","published_year":"","isbn":"9780306406157","language":"","genre":""}`; string(data) != expected {
+		t.Errorf("marshal: got %s, expected %s", data, expected)
+	}
+}
+
+func TestGetBookByISBN(t *testing.T) {
+	s := newTestServer(t)
+
+	tests := []struct {
+		isbn   string
+		status int
+	}{
+		{"9781111111113", http.StatusOK},
+		{"1111111111", http.StatusOK},
+		{"978-1-111-11111-3", http.StatusOK},
+		{"9780306406157", http.StatusNotFound},
+		{"1111111112", http.StatusBadRequest},
+	}
+	for _, test := range tests {
+		rr := serveJSON(t, s, "GET", "/books/isbn/"+test.isbn, nil)
+		if rr.Code != test.status {
+			t.Errorf("GET /books/isbn/%s: got %d, expected %d", test.isbn, rr.Code, test.status)
+			continue
+		}
+		if test.status != http.StatusOK {
+			continue
+		}
+		var book Book
+		if err := json.NewDecoder(rr.Body).Decode(&book); err != nil {
+			t.Fatal(err)
+		}
+		if book.Title != "First Book" {
+			t.Errorf("GET /books/isbn/%s: got %q, expected First Book", test.isbn, book.Title)
+		}
+	}
+}
+
+func TestDuplicateISBN(t *testing.T) {
+	s := newTestServer(t)
+
+	rr := serveJSON(t, s, "POST", "/books", map[string]string{"title": "Copy", "isbn": "1-111-11111-1"})
+	decodeProblem(t, rr, http.StatusConflict, problemConflict)
+
+	rr = serveJSON(t, s, "PUT", "/books/2", map[string]string{"title": "Copy", "isbn": "9781111111113"})
+	decodeProblem(t, rr, http.StatusConflict, problemConflict)
+
+	// Books without an ISBN don't conflict with each other, including
+	// those older clients send with the ISBN 0
+	for _, body := range []map[string]any{{"title": "No ISBN"}, {"title": "No ISBN"}, {"title": "Zero ISBN", "isbn": 0}, {"title": "Zero ISBN", "isbn": 0}} {
+		rr := serveJSON(t, s, "POST", "/books", body)
+		if rr.Code != http.StatusOK {
+			t.Errorf("POST /books with %v: got %d, expected %d", body, rr.Code, http.StatusOK)
+			continue
+		}
+		var book Book
+		if err := json.NewDecoder(rr.Body).Decode(&book); err != nil || book.ISBN != "" {
+			t.Errorf("POST /books with %v: got ISBN %q, %v, expected none", body, book.ISBN, err)
+		}
+	}
+}
@@ -0,0 +1,293 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"os"
+
+	"github.com/golang-jwt/jwt"
+)
+
+// hmacKeyID is the kid given to the shared jwt_secret key
+const hmacKeyID = "hs256"
+
+// JWTKeyConfig describes one token signing key. A key with a private key
+// file can sign and verify; one with only a public key file can only verify,
+// which is how retired keys are kept until the tokens they signed expire.
+type JWTKeyConfig struct {
+	ID             string `yaml:"id"`
+	Algorithm      string `yaml:"algorithm"`
+	PrivateKeyFile string `yaml:"private_key_file"`
+	PublicKeyFile  string `yaml:"public_key_file"`
+}
+
+// supportedAlgorithms lists the JWT algorithms keys may be configured with,
+// with the elliptic curve each ECDSA algorithm requires
+var supportedAlgorithms = map[string]elliptic.Curve{
+	"RS256": nil,
+	"RS384": nil,
+	"RS512": nil,
+	"ES256": elliptic.P256(),
+	"ES384": elliptic.P384(),
+	"ES512": elliptic.P521(),
+}
+
+// signingKey is a key tokens are signed or verified with
+type signingKey struct {
+	id     string
+	method jwt.SigningMethod
+	// private is nil for verify-only keys
+	private interface{}
+	public  interface{}
+}
+
+// keySet holds every key a token may be verified with and the one new
+// tokens are signed with
+type keySet struct {
+	signing *signingKey
+	keys    map[string]*signingKey
+	// order preserves the configured order for the JWKS document
+	order []string
+}
+
+// loadKeySet builds the key set from the configuration. The jwt_secret, if
+// set, is added as an HS256 key; it signs tokens only when no other key is
+// configured.
+func loadKeySet(cfg Config) (*keySet, error) {
+	ks := &keySet{keys: make(map[string]*signingKey)}
+
+	for _, kc := range cfg.JWTKeys {
+		key, err := loadSigningKey(kc)
+		if err != nil {
+			return nil, fmt.Errorf("jwt key %q: %w", kc.ID, err)
+		}
+		if err := ks.add(key); err != nil {
+			return nil, err
+		}
+	}
+
+	if cfg.JWTSecret != "" {
+		secret := []byte(cfg.JWTSecret)
+		if err := ks.add(&signingKey{id: hmacKeyID, method: jwt.SigningMethodHS256, private: secret, public: secret}); err != nil {
+			return nil, err
+		}
+	}
+
+	signingID := cfg.JWTSigningKey
+	if signingID == "" {
+		// Default to the first key able to sign
+		for _, id := range ks.order {
+			if ks.keys[id].private != nil {
+				signingID = id
+				break
+			}
+		}
+	}
+
+	key, ok := ks.keys[signingID]
+	if !ok {
+		return nil, fmt.Errorf("jwt_signing_key %q is not a configured key", signingID)
+	}
+	if key.private == nil {
+		return nil, fmt.Errorf("jwt_signing_key %q has no private key", signingID)
+	}
+	ks.signing = key
+	return ks, nil
+}
+
+func (ks *keySet) add(key *signingKey) error {
+	if _, ok := ks.keys[key.id]; ok {
+		return fmt.Errorf("duplicate jwt key id %q", key.id)
+	}
+	ks.keys[key.id] = key
+	ks.order = append(ks.order, key.id)
+	return nil
+}
+
+// loadSigningKey reads the PEM files of one configured key
+func loadSigningKey(kc JWTKeyConfig) (*signingKey, error) {
+	if kc.ID == "" {
+		return nil, errors.New("id must not be empty")
+	}
+	curve, ok := supportedAlgorithms[kc.Algorithm]
+	if !ok {
+		return nil, fmt.Errorf("unsupported algorithm %q", kc.Algorithm)
+	}
+
+	key := &signingKey{id: kc.ID, method: jwt.GetSigningMethod(kc.Algorithm)}
+	isRSA := curve == nil
+
+	switch {
+	case kc.PrivateKeyFile != "":
+		pem, err := os.ReadFile(kc.PrivateKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		if isRSA {
+			private, err := jwt.ParseRSAPrivateKeyFromPEM(pem)
+			if err != nil {
+				return nil, err
+			}
+			key.private, key.public = private, &private.PublicKey
+		} else {
+			private, err := jwt.ParseECPrivateKeyFromPEM(pem)
+			if err != nil {
+				return nil, err
+			}
+			key.private, key.public = private, &private.PublicKey
+		}
+	case kc.PublicKeyFile != "":
+		pem, err := os.ReadFile(kc.PublicKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		if isRSA {
+			key.public, err = jwt.ParseRSAPublicKeyFromPEM(pem)
+		} else {
+			key.public, err = jwt.ParseECPublicKeyFromPEM(pem)
+		}
+		if err != nil {
+			return nil, err
+		}
+	default:
+		return nil, errors.New("private_key_file or public_key_file is required")
+	}
+
+	if public, ok := key.public.(*ecdsa.PublicKey); ok && public.Curve != curve {
+		return nil, fmt.Errorf("%s requires curve %s, key uses %s", kc.Algorithm, curve.Params().Name, public.Curve.Params().Name)
+	}
+	return key, nil
+}
+
+// sign returns the signed token string for claims, with the signing key's
+// kid in the header
+func (ks *keySet) sign(claims jwt.Claims) (string, error) {
+	token := jwt.NewWithClaims(ks.signing.method, claims)
+	token.Header["kid"] = ks.signing.id
+	return token.SignedString(ks.signing.private)
+}
+
+// keyFunc selects the verification key by the token's kid. A token whose
+// algorithm differs from its key's, including "none", is rejected, which
+// also stops an RSA public key being used as an HMAC secret.
+func (ks *keySet) keyFunc(token *jwt.Token) (interface{}, error) {
+	kid, _ := token.Header["kid"].(string)
+	key, ok := ks.keys[kid]
+	if !ok {
+		return nil, fmt.Errorf("unknown key id %q", kid)
+	}
+	if token.Method == nil || token.Method.Alg() != key.method.Alg() {
+		return nil, fmt.Errorf("unexpected signing algorithm %v", token.Header["alg"])
+	}
+	return key.public, nil
+}
+
+// jwk is a public key in JSON Web Key form (RFC 7517)
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	N   string `json:"n,omitempty"`
+	E   string `json:"e,omitempty"`
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+	Y   string `json:"y,omitempty"`
+}
+
+// jwkCurves maps the crv of an EC JSON Web Key to its curve
+var jwkCurves = map[string]elliptic.Curve{
+	"P-256": elliptic.P256(),
+	"P-384": elliptic.P384(),
+	"P-521": elliptic.P521(),
+}
+
+// publicKey returns the RSA or ECDSA public key k describes
+func (k jwk) publicKey() (interface{}, error) {
+	decode := func(field, value string) (*big.Int, error) {
+		b, err := base64.RawURLEncoding.DecodeString(value)
+		if err != nil || len(b) == 0 {
+			return nil, fmt.Errorf("jwk %q: invalid %s", k.Kid, field)
+		}
+		return new(big.Int).SetBytes(b), nil
+	}
+
+	switch k.Kty {
+	case "RSA":
+		n, err := decode("n", k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decode("e", k.E)
+		if err != nil {
+			return nil, err
+		}
+		if !e.IsInt64() || e.Int64() > 1<<31-1 {
+			return nil, fmt.Errorf("jwk %q: invalid e", k.Kid)
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		curve, ok := jwkCurves[k.Crv]
+		if !ok {
+			return nil, fmt.Errorf("jwk %q: unsupported curve %q", k.Kid, k.Crv)
+		}
+		x, err := decode("x", k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decode("y", k.Y)
+		if err != nil {
+			return nil, err
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	default:
+		return nil, fmt.Errorf("jwk %q: unsupported key type %q", k.Kid, k.Kty)
+	}
+}
+
+// jwks returns the public keys of the set. Shared HMAC secrets are never
+// published.
+func (ks *keySet) jwks() []jwk {
+	keys := []jwk{}
+	for _, id := range ks.order {
+		key := ks.keys[id]
+		switch public := key.public.(type) {
+		case *rsa.PublicKey:
+			keys = append(keys, jwk{
+				Kty: "RSA",
+				Kid: key.id,
+				Use: "sig",
+				Alg: key.method.Alg(),
+				N:   base64.RawURLEncoding.EncodeToString(public.N.Bytes()),
+				E:   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(public.E)).Bytes()),
+			})
+		case *ecdsa.PublicKey:
+			size := (public.Curve.Params().BitSize + 7) / 8
+			keys = append(keys, jwk{
+				Kty: "EC",
+				Kid: key.id,
+				Use: "sig",
+				Alg: key.method.Alg(),
+				Crv: public.Curve.Params().Name,
+				X:   base64.RawURLEncoding.EncodeToString(public.X.FillBytes(make([]byte, size))),
+				Y:   base64.RawURLEncoding.EncodeToString(public.Y.FillBytes(make([]byte, size))),
+			})
+		}
+	}
+	return keys
+}
+
+// getJWKS serves the public verification keys so that other services can
+// check BookAPI tokens
+func (s *server) getJWKS(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	json.NewEncoder(w).Encode(map[string][]jwk{"keys": s.keys.jwks()})
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt"
+)
+
+// writePEM writes der as a PEM block of type kind to a temporary file
+func writePEM(t *testing.T, kind string, der []byte) string {
+	path := filepath.Join(t.TempDir(), "key.pem")
+	data := pem.EncodeToMemory(&pem.Block{Type: kind, Bytes: der})
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// getJWKSKeys fetches the JWKS document from router
+func getJWKSKeys(t *testing.T, router http.Handler) []jwk {
+	req, err := http.NewRequest("GET", "/.well-known/jwks.json", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("jwks returned %d, expected %d", rr.Code, http.StatusOK)
+	}
+
+	var body struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := json.Unmarshal(rr.Body.Bytes(), &body); err != nil {
+		t.Fatal(err)
+	}
+	return body.Keys
+}
+
+func TestAsymmetricSigningAndRotation(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecDER, err := x509.MarshalECPrivateKey(ecKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsaPublicDER, err := x509.MarshalPKIXPublicKey(&rsaKey.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The EC key signs; the RSA key is retired and may only verify
+	cfg := testConfig
+	cfg.JWTSecret = ""
+	cfg.JWTKeys = []JWTKeyConfig{
+		{ID: "2026-10", Algorithm: "ES256", PrivateKeyFile: writePEM(t, "EC PRIVATE KEY", ecDER)},
+		{ID: "2026-04", Algorithm: "RS256", PublicKeyFile: writePEM(t, "PUBLIC KEY", rsaPublicDER)},
+	}
+	router := newTestServerWith(t, cfg)
+
+	tokens := loginTokens(t, router)
+	claims := &Claims{}
+	token, _, err := new(jwt.Parser).ParseUnverified(tokens["token"], claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token.Header["kid"] != "2026-10" || token.Header["alg"] != "ES256" {
+		t.Errorf("expected an ES256 token with kid 2026-10, got header %v", token.Header)
+	}
+	if status := getBooksStatus(t, router, tokens["token"]); status != http.StatusOK {
+		t.Errorf("ES256 token: got %d, expected %d", status, http.StatusOK)
+	}
+
+	keys := getJWKSKeys(t, router)
+	if len(keys) != 2 {
+		t.Fatalf("expected 2 published keys, got %+v", keys)
+	}
+	published := keys[0]
+	if published.Kty != "EC" || published.Kid != "2026-10" || published.Crv != "P-256" || published.Use != "sig" {
+		t.Errorf("unexpected EC key %+v", published)
+	}
+	x, _ := base64.RawURLEncoding.DecodeString(published.X)
+	y, _ := base64.RawURLEncoding.DecodeString(published.Y)
+	publicKey := &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+	_, err = jwt.Parse(tokens["token"], func(*jwt.Token) (interface{}, error) { return publicKey, nil })
+	if err != nil {
+		t.Errorf("expected the token to verify with the published key: %v", err)
+	}
+	if keys[1].Kty != "RSA" || keys[1].Kid != "2026-04" || keys[1].E != "AQAB" {
+		t.Errorf("unexpected RSA key %+v", keys[1])
+	}
+
+	// A token signed before the rotation is still accepted
+	old := jwt.NewWithClaims(jwt.SigningMethodRS256, &Claims{
+		Username: "admin",
+		Role:     roleAdmin,
+		StandardClaims: jwt.StandardClaims{
+			Id:        "old-token",
+			ExpiresAt: time.Now().Add(time.Hour).Unix(),
+		},
+	})
+	old.Header["kid"] = "2026-04"
+	oldString, err := old.SignedString(rsaKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status := getBooksStatus(t, router, oldString); status != http.StatusOK {
+		t.Errorf("token from the retired key: got %d, expected %d", status, http.StatusOK)
+	}
+
+	// The RSA public key must not be usable as an HMAC secret
+	pemBytes, _ := os.ReadFile(cfg.JWTKeys[1].PublicKeyFile)
+	forged := jwt.NewWithClaims(jwt.SigningMethodHS256, old.Claims)
+	forged.Header["kid"] = "2026-04"
+	forgedString, err := forged.SignedString(pemBytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status := getBooksStatus(t, router, forgedString); status != http.StatusUnauthorized {
+		t.Errorf("HS256 token forged with the public key: got %d, expected %d", status, http.StatusUnauthorized)
+	}
+}
+
+func TestRejectsUnsignedAndUnknownKeys(t *testing.T) {
+	router := newTestServer(t)
+	claims := &Claims{
+		Username: "admin",
+		Role:     roleAdmin,
+		StandardClaims: jwt.StandardClaims{
+			Id:        "test-token",
+			ExpiresAt: time.Now().Add(time.Hour).Unix(),
+		},
+	}
+
+	unsigned := jwt.NewWithClaims(jwt.SigningMethodNone, claims)
+	unsigned.Header["kid"] = hmacKeyID
+	unsignedString, err := unsigned.SignedString(jwt.UnsafeAllowNoneSignatureType)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	unknown := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+	unknown.Header["kid"] = "missing"
+	unknownString, err := unknown.SignedString([]byte(testConfig.JWTSecret))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for name, token := range map[string]string{"alg none": unsignedString, "unknown kid": unknownString} {
+		if status := getBooksStatus(t, router, token); status != http.StatusUnauthorized {
+			t.Errorf("%s: got %d, expected %d", name, status, http.StatusUnauthorized)
+		}
+	}
+
+	// The HMAC secret is never published
+	if keys := getJWKSKeys(t, router); len(keys) != 0 {
+		t.Errorf("expected no published keys, got %+v", keys)
+	}
+}
+
+func TestLoadKeySetErrors(t *testing.T) {
+	ecKey, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecDER, err := x509.MarshalECPrivateKey(ecKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p384 := writePEM(t, "EC PRIVATE KEY", ecDER)
+
+	tests := []struct {
+		name string
+		cfg  Config
+		want string
+	}{
+		{"wrong curve", Config{JWTKeys: []JWTKeyConfig{{ID: "a", Algorithm: "ES256", PrivateKeyFile: p384}}}, "requires curve P-256"},
+		{"unsupported", Config{JWTKeys: []JWTKeyConfig{{ID: "a", Algorithm: "PS256", PrivateKeyFile: p384}}}, "unsupported algorithm"},
+		{"no files", Config{JWTKeys: []JWTKeyConfig{{ID: "a", Algorithm: "ES384"}}}, "is required"},
+		{"unknown signer", Config{JWTSecret: "secret", JWTSigningKey: "b"}, "not a configured key"},
+		{"duplicate", Config{JWTKeys: []JWTKeyConfig{
+			{ID: "a", Algorithm: "ES384", PrivateKeyFile: p384},
+			{ID: "a", Algorithm: "ES384", PrivateKeyFile: p384},
+		}}, "duplicate"},
+	}
+	for _, test := range tests {
+		_, err := loadKeySet(test.cfg)
+		if err == nil || !strings.Contains(err.Error(), test.want) {
+			t.Errorf("%s: expected error containing %q, got %v", test.name, test.want, err)
+		}
+	}
+}
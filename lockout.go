@@ -0,0 +1,170 @@
+package main
+
+import (
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+)
+
+// LockoutConfig sets how failed logins are throttled. Once a username or a
+// client IP has failed more than its number of attempts, it is locked for
+// BaseDelay, doubling with every further failure up to MaxDelay. Failures
+// are forgotten ResetAfter the last one, and a successful login clears the
+// failures of the username.
+type LockoutConfig struct {
+	Attempts   int           `yaml:"attempts"`
+	IPAttempts int           `yaml:"ip_attempts"`
+	BaseDelay  time.Duration `yaml:"base_delay"`
+	MaxDelay   time.Duration `yaml:"max_delay"`
+	ResetAfter time.Duration `yaml:"reset_after"`
+}
+
+// validate checks that the lockout settings are usable.
+func (c LockoutConfig) validate() []string {
+	var problems []string
+	if c.Attempts <= 0 || c.IPAttempts <= 0 {
+		problems = append(problems, "lockout.attempts and lockout.ip_attempts must be positive")
+	}
+	if c.BaseDelay <= 0 || c.MaxDelay < c.BaseDelay {
+		problems = append(problems, "lockout.base_delay must be positive and not longer than lockout.max_delay")
+	}
+	if c.ResetAfter <= 0 {
+		problems = append(problems, "lockout.reset_after must be positive")
+	}
+	return problems
+}
+
+// delay returns how long to lock after the given number of failures, or
+// zero while they are within the allowed attempts
+func (c LockoutConfig) delay(failures, attempts int) time.Duration {
+	if failures <= attempts {
+		return 0
+	}
+
+	delay := c.BaseDelay
+	for i := attempts + 1; i < failures && delay < c.MaxDelay; i++ {
+		delay *= 2
+	}
+	return min(delay, c.MaxDelay)
+}
+
+// LoginFailures is the failed login count of a username or client IP.
+type LoginFailures struct {
+	Failures    int
+	LastFailure time.Time
+	LockedUntil time.Time
+}
+
+// Failed logins are tracked under these key prefixes
+const (
+	usernameLockoutKey = "user:"
+	ipLockoutKey       = "ip:"
+)
+
+// clientIP returns the address the request came from, without the port
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// checkLockout answers with 429 when the client IP is locked or 423 when the
+// username is, returning false
+func (s *server) checkLockout(w http.ResponseWriter, r *http.Request, username string) bool {
+	ctx := r.Context()
+	now := s.now()
+
+	for _, key := range []string{ipLockoutKey + clientIP(r), usernameLockoutKey + username} {
+		failures, err := s.store.GetLoginFailures(ctx, key)
+		if err != nil {
+			internalError(w, r, err)
+			return false
+		}
+		if !now.Before(failures.LockedUntil) {
+			continue
+		}
+
+		retry := int(failures.LockedUntil.Sub(now).Round(time.Second) / time.Second)
+		w.Header().Set("Retry-After", strconv.Itoa(max(retry, 1)))
+		if key == usernameLockoutKey+username {
+			writeProblem(w, r, http.StatusLocked, problemLocked, "Account is temporarily locked after too many failed logins")
+		} else {
+			writeProblem(w, r, http.StatusTooManyRequests, problemRateLimited, "Too many failed logins from this address")
+		}
+		return false
+	}
+	return true
+}
+
+// loginFailed counts a failed login against the username and the client IP
+// and locks either once it has failed too often
+func (s *server) loginFailed(r *http.Request, username string) error {
+	ctx := r.Context()
+	ip := clientIP(r)
+	now := s.now()
+
+	limits := []struct {
+		key      string
+		attempts int
+		event    string
+		attrs    []any
+	}{
+		{usernameLockoutKey + username, s.lockout.Attempts, "login locked", []any{"username", username, "ip", ip}},
+		{ipLockoutKey + ip, s.lockout.IPAttempts, "ip locked", []any{"ip", ip}},
+	}
+	for _, limit := range limits {
+		failures, err := s.store.AddLoginFailure(ctx, limit.key, now, s.lockout.ResetAfter)
+		if err != nil {
+			return err
+		}
+
+		delay := s.lockout.delay(failures, limit.attempts)
+		if delay == 0 {
+			continue
+		}
+		until := now.Add(delay)
+		if err := s.store.LockLogin(ctx, limit.key, until); err != nil {
+			return err
+		}
+		s.audit.Warn(limit.event, append(limit.attrs, "failures", failures, "until", until)...)
+	}
+	return nil
+}
+
+// unlockUser clears the failed logins and lockout of an account
+func (s *server) unlockUser(w http.ResponseWriter, r *http.Request) {
+	user, ok := s.userFromPath(w, r)
+	if !ok {
+		return
+	}
+
+	err := s.store.ClearLoginFailures(r.Context(), usernameLockoutKey+user.Username)
+	if err != nil {
+		internalError(w, r, err)
+		return
+	}
+
+	principal, _ := principalFromContext(r.Context())
+	s.audit.Info("login unlocked", "username", user.Username, "by", principal.Username)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// newAuditLogger returns the logger security events are written to, as JSON
+// lines appended to path or on standard error when path is empty
+func newAuditLogger(path string) (*slog.Logger, error) {
+	var w io.Writer = os.Stderr
+	if path != "" {
+		f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+		if err != nil {
+			return nil, err
+		}
+		w = f
+	}
+	return slog.New(slog.NewJSONHandler(w, nil)).With("log", "audit"), nil
+}
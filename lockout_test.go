@@ -0,0 +1,139 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// loginFrom posts credentials to /login from the client address ip
+func loginFrom(t *testing.T, router http.Handler, ip, username, password string) *httptest.ResponseRecorder {
+	body, _ := json.Marshal(map[string]string{"username": username, "password": password})
+	req, err := http.NewRequest("POST", "/login", bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.RemoteAddr = ip + ":41234"
+
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	return rr
+}
+
+// newLockoutTestServer returns a test server with a controllable clock whose
+// audit log is written to the returned buffer
+func newLockoutTestServer(t *testing.T) (*server, *time.Time, *bytes.Buffer) {
+	router := newTestServer(t)
+	now := time.Date(2026, 10, 1, 12, 0, 0, 0, time.UTC)
+	router.now = func() time.Time { return now }
+
+	var audit bytes.Buffer
+	router.audit = slog.New(slog.NewJSONHandler(&audit, nil))
+	return router, &now, &audit
+}
+
+func TestLoginLockout(t *testing.T) {
+	router, now, audit := newLockoutTestServer(t)
+
+	for i := 0; i < testConfig.Lockout.Attempts; i++ {
+		if rr := loginFrom(t, router, "10.0.0.1", "admin", "wrong"); rr.Code != http.StatusUnauthorized {
+			t.Fatalf("failed login %d returned %d, expected %d", i+1, rr.Code, http.StatusUnauthorized)
+		}
+	}
+	if audit.Len() != 0 {
+		t.Errorf("expected no lockout within the allowed attempts, got %s", audit)
+	}
+
+	// The next failure locks the account, even against the right password
+	// and from another address
+	loginFrom(t, router, "10.0.0.1", "admin", "wrong")
+	rr := loginFrom(t, router, "10.0.0.2", "admin", "password")
+	if rr.Code != http.StatusLocked {
+		t.Fatalf("login to a locked account returned %d, expected %d", rr.Code, http.StatusLocked)
+	}
+	if retry := rr.Header().Get("Retry-After"); retry != "30" {
+		t.Errorf("expected Retry-After 30, got %q", retry)
+	}
+	if !strings.Contains(audit.String(), `"msg":"login locked"`) || !strings.Contains(audit.String(), `"username":"admin"`) {
+		t.Errorf("expected the lockout in the audit log, got %s", audit)
+	}
+
+	// Every further failure doubles the lockout
+	*now = now.Add(30 * time.Second)
+	loginFrom(t, router, "10.0.0.1", "admin", "wrong")
+	if retry := loginFrom(t, router, "10.0.0.1", "admin", "password").Header().Get("Retry-After"); retry != "60" {
+		t.Errorf("expected Retry-After 60 after another failure, got %q", retry)
+	}
+
+	*now = now.Add(time.Minute)
+	if rr := loginFrom(t, router, "10.0.0.1", "admin", "password"); rr.Code != http.StatusOK {
+		t.Errorf("login after the lockout returned %d, expected %d", rr.Code, http.StatusOK)
+	}
+
+	// The successful login reset the count
+	loginFrom(t, router, "10.0.0.1", "admin", "wrong")
+	if rr := loginFrom(t, router, "10.0.0.1", "admin", "password"); rr.Code != http.StatusOK {
+		t.Errorf("login after one new failure returned %d, expected %d", rr.Code, http.StatusOK)
+	}
+}
+
+func TestLoginLockoutByIP(t *testing.T) {
+	router, _, audit := newLockoutTestServer(t)
+
+	// Spreading guesses over many usernames is caught per address
+	for i := 0; i <= testConfig.Lockout.IPAttempts; i++ {
+		loginFrom(t, router, "10.0.0.9", "user"+strconv.Itoa(i), "guess")
+	}
+	rr := loginFrom(t, router, "10.0.0.9", "admin", "password")
+	if rr.Code != http.StatusTooManyRequests || rr.Header().Get("Retry-After") == "" {
+		t.Errorf("login from a locked address returned %d, expected %d with Retry-After", rr.Code, http.StatusTooManyRequests)
+	}
+	if !strings.Contains(audit.String(), `"msg":"ip locked"`) {
+		t.Errorf("expected the address lockout in the audit log, got %s", audit)
+	}
+
+	if rr := loginFrom(t, router, "10.0.0.10", "admin", "password"); rr.Code != http.StatusOK {
+		t.Errorf("login from another address returned %d, expected %d", rr.Code, http.StatusOK)
+	}
+}
+
+func TestUnlockUser(t *testing.T) {
+	router, _, audit := newLockoutTestServer(t)
+
+	for i := 0; i <= testConfig.Lockout.Attempts; i++ {
+		loginFrom(t, router, "10.0.0.1", "admin", "wrong")
+	}
+	if rr := loginFrom(t, router, "10.0.0.1", "admin", "password"); rr.Code != http.StatusLocked {
+		t.Fatalf("login to a locked account returned %d, expected %d", rr.Code, http.StatusLocked)
+	}
+
+	rr := serveJSON(t, router, "POST", "/users/1/unlock", nil)
+	if rr.Code != http.StatusNoContent {
+		t.Fatalf("UnlockUser handler returned %d, expected %d", rr.Code, http.StatusNoContent)
+	}
+	if rr := loginFrom(t, router, "10.0.0.1", "admin", "password"); rr.Code != http.StatusOK {
+		t.Errorf("login after unlocking returned %d, expected %d", rr.Code, http.StatusOK)
+	}
+	if !strings.Contains(audit.String(), `"msg":"login unlocked"`) {
+		t.Errorf("expected the unlock in the audit log, got %s", audit)
+	}
+
+	if rr := serveJSON(t, router, "POST", "/users/99/unlock", nil); rr.Code != http.StatusNotFound {
+		t.Errorf("unlocking an unknown user returned %d, expected %d", rr.Code, http.StatusNotFound)
+	}
+}
+
+func TestLockoutDelay(t *testing.T) {
+	cfg := LockoutConfig{BaseDelay: time.Second, MaxDelay: 5 * time.Second}
+	for failures, want := range map[int]time.Duration{3: 0, 4: time.Second, 5: 2 * time.Second, 6: 4 * time.Second, 7: 5 * time.Second, 40: 5 * time.Second} {
+		if got := cfg.delay(failures, 3); got != want {
+			t.Errorf("delay(%d, 3) = %v, expected %v", failures, got, want)
+		}
+	}
+}
@@ -1,14 +1,18 @@
 package main
 
 import (
-	"database/sql"
+	"context"
 	"encoding/json"
-	_ "github.com/go-sql-driver/mysql"
-	"github.com/golang-jwt/jwt"
+	"errors"
+	"fmt"
 	"github.com/gorilla/mux"
 	"log"
+	"log/slog"
 	"net/http"
+	"os"
+	"slices"
 	"strconv"
+	"time"
 )
 
 // Book represents a book in the library
@@ -16,7 +20,9 @@ type Book struct {
 	ID            int    `json:"id"`
 	Title         string `json:"title"`
 	PublishedYear string `json:"published_year"`
-	ISBN          int    `json:"isbn"`
+	ISBN          ISBN   `json:"isbn"`
+	Language      string `json:"language"`
+	Genre         string `json:"genre"`
 }
 
 // Author represents an author of a book
@@ -32,469 +38,670 @@ type AuthorBook struct {
 	BookID       int `json:"book_id"`
 }
 
-// JWT claims struct
-type Claims struct {
-	Username string `json:"username"`
-	jwt.StandardClaims
+// BookAuthors is the body of PUT /books/{id}/authors, which sets every
+// author of a book at once
+type BookAuthors struct {
+	AuthorIDs []int `json:"author_ids"`
 }
 
-var (
-	db              *sql.DB
-	secretKey       = []byte("your-secret-key")
-	authorizedUsers = map[string]string{
-		"admin": "password",
-		"user":  "password",
+// server holds the dependencies shared by the HTTP handlers
+type server struct {
+	store   Store
+	router  *mux.Router
+	keys    *keySet
+	roles   Roles
+	lockout LockoutConfig
+	audit   *slog.Logger
+
+	// strictJSON rejects request bodies with unknown fields
+	strictJSON  bool
+	maxPageSize int
+
+	// searchIndex and suggester are kept in sync by the handlers that
+	// change books and authors
+	searchIndex *searchIndex
+	suggester   *suggester
+
+	limiter          RateLimitStore
+	rateLimits       map[string]RateLimit
+	apiKeyDailyQuota int
+
+	// oidc is nil unless login through an identity provider is configured
+	oidc *oidcProvider
+
+	accessTokenTTL  time.Duration
+	refreshTokenTTL time.Duration
+	now             func() time.Time
+}
+
+// newServer creates a server backed by store and registers its routes
+func newServer(cfg Config, store Store) (*server, error) {
+	keys, err := loadKeySet(cfg)
+	if err != nil {
+		return nil, err
+	}
+	audit, err := newAuditLogger(cfg.AuditLog)
+	if err != nil {
+		return nil, err
+	}
+	searchIndex, err := openSearchIndex(context.Background(), cfg.SearchIndex, store)
+	if err != nil {
+		return nil, err
+	}
+	suggester, err := buildSuggester(context.Background(), store)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &server{
+		store:  store,
+		router: mux.NewRouter(),
+		keys:   keys,
+		roles:  cfg.Roles,
+
+		lockout: cfg.Lockout,
+		audit:   audit,
+
+		strictJSON:  cfg.StrictJSON,
+		maxPageSize: cfg.MaxPageSize,
+		searchIndex: searchIndex,
+		suggester:   suggester,
+
+		limiter:          newMemoryRateLimiter(),
+		rateLimits:       cfg.RateLimits,
+		apiKeyDailyQuota: cfg.APIKeyDailyQuota,
+
+		accessTokenTTL:  cfg.AccessTokenTTL,
+		refreshTokenTTL: cfg.RefreshTokenTTL,
+		now:             time.Now,
+	}
+	if cfg.OIDC.Issuer != "" {
+		s.oidc = newOIDCProvider(cfg.OIDC)
+	}
+	s.routes()
+	return s, nil
+}
+
+func (s *server) routes() {
+	s.router.NotFoundHandler = http.HandlerFunc(notFound)
+	s.router.MethodNotAllowedHandler = http.HandlerFunc(methodNotAllowed)
+
+	// Routes anyone can call
+	public := s.router.NewRoute().Subrouter()
+	public.Use(s.rateLimit(func(*http.Request) string { return rateGroupAuth }))
+	public.HandleFunc("/login", s.login).Methods("POST")
+	public.HandleFunc("/token/refresh", s.refreshToken).Methods("POST")
+	public.HandleFunc("/.well-known/jwks.json", s.getJWKS).Methods("GET")
+	if s.oidc != nil {
+		public.HandleFunc("/login/oidc", s.oidcLogin).Methods("GET")
+		public.HandleFunc("/login/oidc/callback", s.oidcCallback).Methods("GET")
 	}
-)
+
+	// Routes that need a valid access token, each with the permission it
+	// requires
+	protected := s.router.NewRoute().Subrouter()
+	protected.Use(s.authenticate, s.rateLimit(methodRateGroup))
+	protected.HandleFunc("/logout", s.logout).Methods("POST")
+	protected.HandleFunc("/books", s.require(permReadBooks, s.getAllBooks)).Methods("GET")
+	protected.HandleFunc("/books", s.require(permWriteBooks, s.createBook)).Methods("POST")
+	protected.HandleFunc("/books/isbn/{isbn}", s.require(permReadBooks, s.getBookByISBN)).Methods("GET")
+	protected.HandleFunc("/books/{id}", s.require(permReadBooks, s.getBook)).Methods("GET")
+	protected.HandleFunc("/books/{id}", s.require(permWriteBooks, s.updateBook)).Methods("PUT")
+	protected.HandleFunc("/books/{id}", s.require(permDeleteBooks, s.deleteBook)).Methods("DELETE")
+	protected.HandleFunc("/authors", s.require(permReadAuthors, s.getAllAuthors)).Methods("GET")
+	protected.HandleFunc("/authors", s.require(permWriteAuthors, s.createAuthor)).Methods("POST")
+	protected.HandleFunc("/authors/{id}", s.require(permReadAuthors, s.getAuthor)).Methods("GET")
+	protected.HandleFunc("/authors/{id}", s.require(permWriteAuthors, s.updateAuthor)).Methods("PUT")
+	protected.HandleFunc("/authors/{id}", s.require(permDeleteAuthors, s.deleteAuthor)).Methods("DELETE")
+	protected.HandleFunc("/authorbooks", s.require(permWriteAuthorBooks, s.CreateAuthorBook)).Methods("POST")
+	protected.HandleFunc("/authorbooks/{id}", s.require(permReadAuthorBooks, s.GetAuthorBook)).Methods("GET")
+	protected.HandleFunc("/authorbooks/{id}", s.require(permWriteAuthorBooks, s.UpdateAuthorBook)).Methods("PUT")
+	protected.HandleFunc("/authorbooks/{id}", s.require(permDeleteAuthorBooks, s.DeleteAuthorBook)).Methods("DELETE")
+	protected.HandleFunc("/authors/{id}/books", s.require(permReadAuthorBooks, s.require(permReadBooks, s.getAuthorBooks))).Methods("GET")
+	protected.HandleFunc("/books/{id}/authors", s.require(permReadAuthorBooks, s.require(permReadAuthors, s.getBookAuthors))).Methods("GET")
+	// Replacing the authors of a book deletes the links it no longer needs
+	protected.HandleFunc("/books/{id}/authors", s.require(permWriteAuthorBooks, s.require(permDeleteAuthorBooks, s.setBookAuthors))).Methods("PUT")
+	protected.HandleFunc("/search", s.require(permReadBooks, s.search)).Methods("GET")
+	protected.HandleFunc("/suggest", s.require(permReadBooks, s.suggest)).Methods("GET")
+	protected.HandleFunc("/users", s.require(permReadUsers, s.getAllUsers)).Methods("GET")
+	protected.HandleFunc("/users", s.require(permWriteUsers, s.createUser)).Methods("POST")
+	protected.HandleFunc("/users/{id}/disable", s.require(permWriteUsers, s.setUserDisabled(true))).Methods("POST")
+	protected.HandleFunc("/users/{id}/enable", s.require(permWriteUsers, s.setUserDisabled(false))).Methods("POST")
+	protected.HandleFunc("/users/{id}/password", s.changePassword).Methods("PUT")
+	protected.HandleFunc("/users/{id}/role", s.require(permWriteUsers, s.setUserRole)).Methods("PUT")
+	protected.HandleFunc("/users/{id}/unlock", s.require(permWriteUsers, s.unlockUser)).Methods("POST")
+	protected.HandleFunc("/apikeys", s.require(permReadAPIKeys, s.getAllAPIKeys)).Methods("GET")
+	protected.HandleFunc("/apikeys", s.require(permWriteAPIKeys, s.createAPIKey)).Methods("POST")
+	protected.HandleFunc("/apikeys/{id}", s.require(permDeleteAPIKeys, s.revokeAPIKey)).Methods("DELETE")
+}
+
+func (s *server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	r = withRequestID(w, r)
+	s.router.ServeHTTP(w, r)
+}
 
 func main() {
-	var err error
-	db, err = sql.Open("mysql", "username:password@tcp(localhost:3306)/library")
+	cfg, args, err := loadConfig(os.Args[1:], os.Getenv)
 	if err != nil {
 		log.Fatal(err)
 	}
-	defer db.Close()
 
-	err = db.Ping()
+	store, err := openStore(cfg.Store, cfg.DSN)
 	if err != nil {
 		log.Fatal(err)
 	}
+	defer store.Close()
+
+	if len(args) > 0 && args[0] == "migrate" {
+		if err := runMigrate(context.Background(), store, args[1:], os.Stdout); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	if len(args) > 0 && args[0] == "set-role" {
+		if err := runSetRole(context.Background(), store, cfg.Roles, args[1:], os.Stdout); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	if len(args) > 0 && args[0] == "reindex" {
+		if err := runReindex(context.Background(), store, cfg.SearchIndex, os.Stdout); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	if cfg.AdminPassword != "" {
+		if err := ensureUser(context.Background(), store, cfg.AdminUsername, cfg.AdminPassword, roleAdmin); err != nil {
+			log.Fatal(err)
+		}
+	}
 
-	router := mux.NewRouter()
-
-	router.HandleFunc("/login", login).Methods("POST")
-	router.HandleFunc("/books", getAllBooks).Methods("GET")
-	router.HandleFunc("/books", createBook).Methods("POST")
-	router.HandleFunc("/books/{id}", getBook).Methods("GET")
-	router.HandleFunc("/books/{id}", updateBook).Methods("PUT")
-	router.HandleFunc("/books/{id}", deleteBook).Methods("DELETE")
-	router.HandleFunc("/authors", getAllAuthors).Methods("GET")
-	router.HandleFunc("/authors", createAuthor).Methods("POST")
-	router.HandleFunc("/authors/{id}", getAuthor).Methods("GET")
-	router.HandleFunc("/authors/{id}", updateAuthor).Methods("PUT")
-	router.HandleFunc("/authors/{id}", deleteAuthor).Methods("DELETE")
-	router.HandleFunc("/authorbooks", CreateAuthorBook).Methods("POST")
-	router.HandleFunc("/authorbooks/{id}", GetAuthorBook).Methods("GET")
-	router.HandleFunc("/authorbooks/{id}", UpdateAuthorBook).Methods("PUT")
-	router.HandleFunc("/authorbooks/{id}", DeleteAuthorBook).Methods("DELETE")
-
-	log.Fatal(http.ListenAndServe(":8000", router))
+	srv, err := newServer(cfg, store)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	log.Fatal(http.ListenAndServe(cfg.Addr, srv))
+}
+
+// pathID reads the numeric {id} route variable, answering 400 and returning
+// false when it isn't a number
+func pathID(w http.ResponseWriter, r *http.Request) (int, bool) {
+	value := mux.Vars(r)["id"]
+	id, err := strconv.Atoi(value)
+	if err != nil {
+		writeProblem(w, r, http.StatusBadRequest, problemBadRequest, fmt.Sprintf("ID %q is not a number", value))
+		return 0, false
+	}
+	return id, true
 }
 
-// Login handles the user login and generates a JWT token
-func login(w http.ResponseWriter, r *http.Request) {
-	var creds struct {
-		Username string `json:"username"`
-		Password string `json:"password"`
+// CRUD operations for books
+
+func (s *server) getAllBooks(w http.ResponseWriter, r *http.Request) {
+	servePage(w, r, s.maxPageSize, bookFields, s.store.ListBooks, s.store.BookFacets)
+}
+
+func (s *server) createBook(w http.ResponseWriter, r *http.Request) {
+	var book Book
+	if !s.decodeBody(w, r, &book) {
+		return
+	}
+	if errs := book.validate(); len(errs) > 0 {
+		invalidFields(w, r, errs...)
+		return
 	}
 
-	err := json.NewDecoder(r.Body).Decode(&creds)
+	err := s.store.CreateBook(r.Context(), &book)
+	if errors.Is(err, ErrConflict) {
+		writeProblem(w, r, http.StatusConflict, problemConflict, "A book with ISBN "+book.ISBN.String()+" already exists")
+		return
+	}
 	if err != nil {
-		w.WriteHeader(http.StatusBadRequest)
+		internalError(w, r, err)
 		return
 	}
+	s.indexBook(book)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(book)
+}
 
-	password, ok := authorizedUsers[creds.Username]
-	if !ok || password != creds.Password {
-		w.WriteHeader(http.StatusUnauthorized)
+func (s *server) getBook(w http.ResponseWriter, r *http.Request) {
+	id, ok := pathID(w, r)
+	if !ok {
 		return
 	}
 
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, &Claims{
-		Username: creds.Username,
-	})
+	book, err := s.store.GetBook(r.Context(), id)
+	if errors.Is(err, ErrNotFound) {
+		writeProblem(w, r, http.StatusNotFound, problemNotFound, "Book not found")
+		return
+	}
+	if err != nil {
+		internalError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(book)
+}
 
-	tokenString, err := token.SignedString(secretKey)
+// getBookByISBN looks a book up by an ISBN-10 or ISBN-13
+func (s *server) getBookByISBN(w http.ResponseWriter, r *http.Request) {
+	isbn, err := ParseISBN(mux.Vars(r)["isbn"])
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
+		writeProblem(w, r, http.StatusBadRequest, problemBadRequest, err.Error())
+		return
+	}
+
+	book, err := s.store.GetBookByISBN(r.Context(), isbn)
+	if errors.Is(err, ErrNotFound) {
+		writeProblem(w, r, http.StatusNotFound, problemNotFound, "No book has ISBN "+isbn.String())
+		return
+	}
+	if err != nil {
+		internalError(w, r, err)
 		return
 	}
 
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(map[string]string{
-		"token": tokenString,
-	})
+	json.NewEncoder(w).Encode(book)
 }
 
-// Middleware to validate JWT token
-func validateToken(next http.HandlerFunc) http.HandlerFunc {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		tokenString := r.Header.Get("Authorization")
-		if tokenString == "" {
-			w.WriteHeader(http.StatusUnauthorized)
-			return
-		}
+func (s *server) updateBook(w http.ResponseWriter, r *http.Request) {
+	id, ok := pathID(w, r)
+	if !ok {
+		return
+	}
 
-		token, err := jwt.ParseWithClaims(tokenString, &Claims{}, func(token *jwt.Token) (interface{}, error) {
-			return secretKey, nil
-		})
+	var book Book
+	if !s.decodeBody(w, r, &book) {
+		return
+	}
+	if errs := book.validate(); len(errs) > 0 {
+		invalidFields(w, r, errs...)
+		return
+	}
 
-		if err != nil || !token.Valid {
-			w.WriteHeader(http.StatusUnauthorized)
-			return
-		}
+	book.ID = id
+
+	err := s.store.UpdateBook(r.Context(), &book)
+	if errors.Is(err, ErrConflict) {
+		writeProblem(w, r, http.StatusConflict, problemConflict, "A book with ISBN "+book.ISBN.String()+" already exists")
+		return
+	}
+	if errors.Is(err, ErrNotFound) {
+		writeProblem(w, r, http.StatusNotFound, problemNotFound, "Book not found")
+		return
+	}
+	if err != nil {
+		internalError(w, r, err)
+		return
+	}
+	s.indexBook(book)
 
-		next.ServeHTTP(w, r)
-	})
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(book)
 }
 
-// CRUD operations for books
-// CRUD operations for books
+func (s *server) deleteBook(w http.ResponseWriter, r *http.Request) {
+	id, ok := pathID(w, r)
+	if !ok {
+		return
+	}
 
-func getAllBooks(w http.ResponseWriter, r *http.Request) {
-	// Token validation middleware
-	validateToken(func(w http.ResponseWriter, r *http.Request) {
-		rows, err := db.Query("SELECT id, title, published_year, isbn FROM books")
-		if err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
-			return
-		}
-		defer rows.Close()
-
-		books := []Book{}
-		for rows.Next() {
-			var book Book
-			err := rows.Scan(&book.ID, &book.Title, &book.PublishedYear, &book.ISBN)
-			if err != nil {
-				w.WriteHeader(http.StatusInternalServerError)
-				return
-			}
-			books = append(books, book)
-		}
+	err := s.store.DeleteBook(r.Context(), id)
+	if errors.Is(err, ErrNotFound) {
+		writeProblem(w, r, http.StatusNotFound, problemNotFound, "Book not found")
+		return
+	}
+	if err != nil {
+		internalError(w, r, err)
+		return
+	}
+	s.unindex(searchBook, id)
 
-		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(books)
-	})(w, r)
+	w.WriteHeader(http.StatusNoContent)
 }
 
-func createBook(w http.ResponseWriter, r *http.Request) {
-	// Token validation middleware
-	validateToken(func(w http.ResponseWriter, r *http.Request) {
-		var book Book
-		err := json.NewDecoder(r.Body).Decode(&book)
-		if err != nil {
-			w.WriteHeader(http.StatusBadRequest)
-			return
-		}
+func (s *server) getAllAuthors(w http.ResponseWriter, r *http.Request) {
+	servePage(w, r, s.maxPageSize, authorFields, s.store.ListAuthors, nil)
+}
 
-		result, err := db.Exec("INSERT INTO books (title, published_year, isbn) VALUES (?, ?,?)", book.Title, book.PublishedYear, book.ISBN)
-		if err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
-			return
-		}
+func (s *server) createAuthor(w http.ResponseWriter, r *http.Request) {
+	var author Author
+	if !s.decodeBody(w, r, &author) {
+		return
+	}
+	if errs := author.validate(); len(errs) > 0 {
+		invalidFields(w, r, errs...)
+		return
+	}
 
-		ID, _ := result.LastInsertId()
-		book.ID = int(ID)
+	err := s.store.CreateAuthor(r.Context(), &author)
+	if err != nil {
+		internalError(w, r, err)
+		return
+	}
+	s.indexAuthor(author)
 
-		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(book)
-	})(w, r)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(author)
 }
 
-func getBook(w http.ResponseWriter, r *http.Request) {
-	// Token validation middleware
-	validateToken(func(w http.ResponseWriter, r *http.Request) {
-		params := mux.Vars(r)
-		id := params["id"]
+func (s *server) getAuthor(w http.ResponseWriter, r *http.Request) {
+	id, ok := pathID(w, r)
+	if !ok {
+		return
+	}
 
-		var book Book
-		err := db.QueryRow("SELECT id, title, published_year, isbn FROM books WHERE id = ?", id).Scan(&book.ID, &book.Title, &book.PublishedYear, &book.ISBN)
-		if err != nil {
-			w.WriteHeader(http.StatusNotFound)
-			return
-		}
+	author, err := s.store.GetAuthor(r.Context(), id)
+	if errors.Is(err, ErrNotFound) {
+		writeProblem(w, r, http.StatusNotFound, problemNotFound, "Author not found")
+		return
+	}
+	if err != nil {
+		internalError(w, r, err)
+		return
+	}
 
-		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(book)
-	})(w, r)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(author)
 }
 
-func updateBook(w http.ResponseWriter, r *http.Request) {
-	// Token validation middleware
-	validateToken(func(w http.ResponseWriter, r *http.Request) {
-		params := mux.Vars(r)
-		id := params["id"]
+func (s *server) updateAuthor(w http.ResponseWriter, r *http.Request) {
+	id, ok := pathID(w, r)
+	if !ok {
+		return
+	}
 
-		var book Book
-		err := json.NewDecoder(r.Body).Decode(&book)
-		if err != nil {
-			w.WriteHeader(http.StatusBadRequest)
-			return
-		}
+	var author Author
+	if !s.decodeBody(w, r, &author) {
+		return
+	}
+	if errs := author.validate(); len(errs) > 0 {
+		invalidFields(w, r, errs...)
+		return
+	}
 
-		_, err = db.Exec("UPDATE books SET title = ?, published_year = ? , isbn = ?WHERE id = ?", book.Title, book.PublishedYear, book.ISBN, id)
-		if err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
-			return
-		}
+	author.ID = id
 
-		book.ID, _ = strconv.Atoi(id)
+	err := s.store.UpdateAuthor(r.Context(), &author)
+	if errors.Is(err, ErrNotFound) {
+		writeProblem(w, r, http.StatusNotFound, problemNotFound, "Author not found")
+		return
+	}
+	if err != nil {
+		internalError(w, r, err)
+		return
+	}
+	s.indexAuthor(author)
 
-		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(book)
-	})(w, r)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(author)
 }
 
-func deleteBook(w http.ResponseWriter, r *http.Request) {
-	// Token validation middleware
-	validateToken(func(w http.ResponseWriter, r *http.Request) {
-		params := mux.Vars(r)
-		id := params["id"]
+func (s *server) deleteAuthor(w http.ResponseWriter, r *http.Request) {
+	id, ok := pathID(w, r)
+	if !ok {
+		return
+	}
 
-		_, err := db.Exec("DELETE FROM books WHERE id = ?", id)
-		if err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
-			return
-		}
+	err := s.store.DeleteAuthor(r.Context(), id)
+	if errors.Is(err, ErrNotFound) {
+		writeProblem(w, r, http.StatusNotFound, problemNotFound, "Author not found")
+		return
+	}
+	if err != nil {
+		internalError(w, r, err)
+		return
+	}
+	s.unindex(searchAuthor, id)
 
-		w.WriteHeader(http.StatusNoContent)
-	})(w, r)
+	w.WriteHeader(http.StatusNoContent)
 }
 
-func getAllAuthors(w http.ResponseWriter, r *http.Request) {
-	// Token validation middleware
-	validateToken(func(w http.ResponseWriter, r *http.Request) {
-		rows, err := db.Query("SELECT id, name, counttry FROM authors")
-		if err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
-			return
-		}
-		defer rows.Close()
-
-		authors := []Author{}
-		for rows.Next() {
-			var author Author
-			err := rows.Scan(&author.ID, &author.Name, &author.Country)
-			if err != nil {
-				w.WriteHeader(http.StatusInternalServerError)
-				return
-			}
-			authors = append(authors, author)
-		}
+// checkAuthorBook verifies that the author and book referenced by authorBook
+// exist, writing the error response and returning false when they do not
+func (s *server) checkAuthorBook(w http.ResponseWriter, r *http.Request, authorBook AuthorBook) bool {
+	authorExists, err := s.store.AuthorExists(r.Context(), authorBook.AuthorID)
+	if err != nil {
+		internalError(w, r, err)
+		return false
+	}
+	if !authorExists {
+		invalidFields(w, r, FieldError{"author_id", "does not exist"})
+		return false
+	}
+
+	bookExists, err := s.store.BookExists(r.Context(), authorBook.BookID)
+	if err != nil {
+		internalError(w, r, err)
+		return false
+	}
+	if !bookExists {
+		invalidFields(w, r, FieldError{"book_id", "does not exist"})
+		return false
+	}
 
-		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(authors)
-	})(w, r)
+	return true
 }
 
-func createAuthor(w http.ResponseWriter, r *http.Request) {
-	// Token validation middleware
-	validateToken(func(w http.ResponseWriter, r *http.Request) {
-		var author Author
-		err := json.NewDecoder(r.Body).Decode(&author)
-		if err != nil {
-			w.WriteHeader(http.StatusBadRequest)
-			return
-		}
+// CreateAuthorBook creates a new author book relationship
+func (s *server) CreateAuthorBook(w http.ResponseWriter, r *http.Request) {
+	var authorBook AuthorBook
+	if !s.decodeBody(w, r, &authorBook) {
+		return
+	}
+	if errs := authorBook.validate(); len(errs) > 0 {
+		invalidFields(w, r, errs...)
+		return
+	}
 
-		result, err := db.Exec("INSERT INTO authors (name, country) VALUES (?, ?)", author.Name, author.Country)
-		if err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
-			return
-		}
+	// Check if the author and book exist
+	if !s.checkAuthorBook(w, r, authorBook) {
+		return
+	}
 
-		ID, _ := result.LastInsertId()
-		author.ID = int(ID)
+	err := s.store.CreateAuthorBook(r.Context(), &authorBook)
+	if errors.Is(err, ErrConflict) {
+		writeProblem(w, r, http.StatusConflict, problemConflict, "The author is already linked to the book")
+		return
+	}
+	if err != nil {
+		internalError(w, r, err)
+		return
+	}
 
-		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(author)
-	})(w, r)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(authorBook)
 }
 
-func getAuthor(w http.ResponseWriter, r *http.Request) {
-	// Token validation middleware
-	validateToken(func(w http.ResponseWriter, r *http.Request) {
-		params := mux.Vars(r)
-		id := params["id"]
+// GetAuthorBook retrieves a specific author book relationship
+func (s *server) GetAuthorBook(w http.ResponseWriter, r *http.Request) {
+	id, ok := pathID(w, r)
+	if !ok {
+		return
+	}
 
-		var author Author
-		err := db.QueryRow("SELECT id, name, country FROM books WHERE id = ?", id).Scan(&author.ID, &author.Name, &author.Country)
-		if err != nil {
-			w.WriteHeader(http.StatusNotFound)
-			return
-		}
+	authorBook, err := s.store.GetAuthorBook(r.Context(), id)
+	if errors.Is(err, ErrNotFound) {
+		writeProblem(w, r, http.StatusNotFound, problemNotFound, "Author book not found")
+		return
+	}
+	if err != nil {
+		internalError(w, r, err)
+		return
+	}
 
-		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(author)
-	})(w, r)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(authorBook)
 }
 
-func updateAuthor(w http.ResponseWriter, r *http.Request) {
-	// Token validation middleware
-	validateToken(func(w http.ResponseWriter, r *http.Request) {
-		params := mux.Vars(r)
-		id := params["id"]
+// UpdateAuthorBook updates an author book relationship
+func (s *server) UpdateAuthorBook(w http.ResponseWriter, r *http.Request) {
+	id, ok := pathID(w, r)
+	if !ok {
+		return
+	}
 
-		var author Author
-		err := json.NewDecoder(r.Body).Decode(&author)
-		if err != nil {
-			w.WriteHeader(http.StatusBadRequest)
-			return
-		}
+	var authorBook AuthorBook
+	if !s.decodeBody(w, r, &authorBook) {
+		return
+	}
+	if errs := authorBook.validate(); len(errs) > 0 {
+		invalidFields(w, r, errs...)
+		return
+	}
 
-		_, err = db.Exec("UPDATE authors SET name = ?, country = ?WHERE id = ?", author.Name, author.Country, id)
-		if err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
-			return
-		}
+	// Check if the author and book exist
+	if !s.checkAuthorBook(w, r, authorBook) {
+		return
+	}
 
-		author.ID, _ = strconv.Atoi(id)
+	authorBook.AuthorBookID = id
 
-		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(author)
-	})(w, r)
+	err := s.store.UpdateAuthorBook(r.Context(), &authorBook)
+	if errors.Is(err, ErrNotFound) {
+		writeProblem(w, r, http.StatusNotFound, problemNotFound, "Author book not found")
+		return
+	}
+	if errors.Is(err, ErrConflict) {
+		writeProblem(w, r, http.StatusConflict, problemConflict, "The author is already linked to the book")
+		return
+	}
+	if err != nil {
+		internalError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(authorBook)
 }
 
-func deleteAuthor(w http.ResponseWriter, r *http.Request) {
-	// Token validation middleware
-	validateToken(func(w http.ResponseWriter, r *http.Request) {
-		params := mux.Vars(r)
-		id := params["id"]
+// DeleteAuthorBook deletes an author book relationship
+func (s *server) DeleteAuthorBook(w http.ResponseWriter, r *http.Request) {
+	id, ok := pathID(w, r)
+	if !ok {
+		return
+	}
 
-		_, err := db.Exec("DELETE FROM authors WHERE id = ?", id)
-		if err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
-			return
-		}
+	err := s.store.DeleteAuthorBook(r.Context(), id)
+	if errors.Is(err, ErrNotFound) {
+		writeProblem(w, r, http.StatusNotFound, problemNotFound, "Author book not found")
+		return
+	}
+	if err != nil {
+		internalError(w, r, err)
+		return
+	}
 
-		w.WriteHeader(http.StatusNoContent)
-	})(w, r)
+	w.WriteHeader(http.StatusNoContent)
 }
 
-// CreateAuthorBook creates a new author book relationship
-func CreateAuthorBook(w http.ResponseWriter, r *http.Request) {
-	// Token validation middleware
-	validateToken(func(w http.ResponseWriter, r *http.Request) {
-		var authorBook AuthorBook
-		err := json.NewDecoder(r.Body).Decode(&authorBook)
-		if err != nil {
-			w.WriteHeader(http.StatusBadRequest)
-			return
-		}
-
-		// Check if the author and book exist
-		var authorExists bool
-		err = db.QueryRow("SELECT EXISTS(SELECT 1 FROM authors WHERE id = ?)", authorBook.AuthorID).Scan(&authorExists)
-		if err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
-			return
-		}
-		if !authorExists {
-			w.WriteHeader(http.StatusBadRequest)
-			json.NewEncoder(w).Encode(map[string]string{"error": "Author does not exist"})
-			return
-		}
-
-		var bookExists bool
-		err = db.QueryRow("SELECT EXISTS(SELECT 1 FROM books WHERE id = ?)", authorBook.BookID).Scan(&bookExists)
-		if err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
-			return
-		}
-		if !bookExists {
-			w.WriteHeader(http.StatusBadRequest)
-			json.NewEncoder(w).Encode(map[string]string{"error": "Book does not exist"})
-			return
-		}
+// Lists of the books of an author and the authors of a book
 
-		result, err := db.Exec("INSERT INTO author_books (author_id, book_id) VALUES (?, ?)", authorBook.AuthorID, authorBook.BookID)
-		if err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
-			return
-		}
+// getAuthorBooks lists the books linked to an author through author_books
+func (s *server) getAuthorBooks(w http.ResponseWriter, r *http.Request) {
+	id, ok := pathID(w, r)
+	if !ok {
+		return
+	}
 
-		ID, _ := result.LastInsertId()
-		authorBook.AuthorBookID = int(ID)
+	exists, err := s.store.AuthorExists(r.Context(), id)
+	if err != nil {
+		internalError(w, r, err)
+		return
+	}
+	if !exists {
+		writeProblem(w, r, http.StatusNotFound, problemNotFound, "Author not found")
+		return
+	}
 
-		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(authorBook)
-	})(w, r)
+	servePage(w, r, s.maxPageSize, bookFields, func(ctx context.Context, opts ListOptions) ([]Book, int, error) {
+		return s.store.ListBooksByAuthor(ctx, id, opts)
+	}, nil)
 }
 
-// GetAuthorBook retrieves a specific author book relationship
-func GetAuthorBook(w http.ResponseWriter, r *http.Request) {
-	// Token validation middleware
-	validateToken(func(w http.ResponseWriter, r *http.Request) {
-		params := mux.Vars(r)
-		id := params["id"]
-
-		var authorBook AuthorBook
-		err := db.QueryRow("SELECT author_book_id, author_id, book_id FROM author_books WHERE author_book_id = ?", id).Scan(&authorBook.AuthorBookID, &authorBook.AuthorID, &authorBook.BookID)
-		if err != nil {
-			w.WriteHeader(http.StatusNotFound)
-			return
-		}
+// getBookAuthors lists the authors linked to a book through author_books
+func (s *server) getBookAuthors(w http.ResponseWriter, r *http.Request) {
+	id, ok := pathID(w, r)
+	if !ok {
+		return
+	}
 
-		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(authorBook)
-	})(w, r)
+	exists, err := s.store.BookExists(r.Context(), id)
+	if err != nil {
+		internalError(w, r, err)
+		return
+	}
+	if !exists {
+		writeProblem(w, r, http.StatusNotFound, problemNotFound, "Book not found")
+		return
+	}
+
+	servePage(w, r, s.maxPageSize, authorFields, func(ctx context.Context, opts ListOptions) ([]Author, int, error) {
+		return s.store.ListAuthorsOfBook(ctx, id, opts)
+	}, nil)
 }
 
-// UpdateAuthorBook updates an author book relationship
-func UpdateAuthorBook(w http.ResponseWriter, r *http.Request) {
-	// Token validation middleware
-	validateToken(func(w http.ResponseWriter, r *http.Request) {
-		params := mux.Vars(r)
-		id := params["id"]
-
-		var authorBook AuthorBook
-		err := json.NewDecoder(r.Body).Decode(&authorBook)
-		if err != nil {
-			w.WriteHeader(http.StatusBadRequest)
-			return
-		}
+// setBookAuthors links a book to exactly the authors in the body and
+// answers with them, ordered by ID
+func (s *server) setBookAuthors(w http.ResponseWriter, r *http.Request) {
+	id, ok := pathID(w, r)
+	if !ok {
+		return
+	}
 
-		// Check if the author and book exist
-		var authorExists bool
-		err = db.QueryRow("SELECT EXISTS(SELECT 1 FROM authors WHERE id = ?)", authorBook.AuthorID).Scan(&authorExists)
-		if err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
-			return
-		}
-		if !authorExists {
-			w.WriteHeader(http.StatusBadRequest)
-			json.NewEncoder(w).Encode(map[string]string{"error": "Author does not exist"})
-			return
-		}
+	var body BookAuthors
+	if !s.decodeBody(w, r, &body) {
+		return
+	}
+	if errs := body.validate(); len(errs) > 0 {
+		invalidFields(w, r, errs...)
+		return
+	}
 
-		var bookExists bool
-		err = db.QueryRow("SELECT EXISTS(SELECT 1 FROM books WHERE id = ?)", authorBook.BookID).Scan(&bookExists)
+	// Check that every author exists
+	var errs []FieldError
+	for i, authorID := range body.AuthorIDs {
+		exists, err := s.store.AuthorExists(r.Context(), authorID)
 		if err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
-			return
-		}
-		if !bookExists {
-			w.WriteHeader(http.StatusBadRequest)
-			json.NewEncoder(w).Encode(map[string]string{"error": "Book does not exist"})
+			internalError(w, r, err)
 			return
 		}
-
-		_, err = db.Exec("UPDATE author_books SET author_id = ?, book_id = ? WHERE author_book_id = ?", authorBook.AuthorID, authorBook.BookID, id)
-		if err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
-			return
+		if !exists {
+			errs = append(errs, FieldError{fmt.Sprintf("author_ids[%d]", i), "does not exist"})
 		}
+	}
+	if len(errs) > 0 {
+		invalidFields(w, r, errs...)
+		return
+	}
 
-		authorBook.AuthorBookID, _ = strconv.Atoi(id)
-
-		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(authorBook)
-	})(w, r)
-}
-
-// DeleteAuthorBook deletes an author book relationship
-func DeleteAuthorBook(w http.ResponseWriter, r *http.Request) {
-	// Token validation middleware
-	validateToken(func(w http.ResponseWriter, r *http.Request) {
-		params := mux.Vars(r)
-		id := params["id"]
+	authorIDs := slices.Compact(slices.Sorted(slices.Values(body.AuthorIDs)))
+	err := s.store.SetBookAuthors(r.Context(), id, authorIDs)
+	if errors.Is(err, ErrNotFound) {
+		writeProblem(w, r, http.StatusNotFound, problemNotFound, "Book not found")
+		return
+	}
+	if errors.Is(err, ErrConflict) {
+		writeProblem(w, r, http.StatusConflict, problemConflict, "The authors of the book were changed at the same time")
+		return
+	}
+	if err != nil {
+		internalError(w, r, err)
+		return
+	}
 
-		_, err := db.Exec("DELETE FROM author_books WHERE author_book_id = ?", id)
-		if err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
-			return
-		}
+	authors, _, err := s.store.ListAuthorsOfBook(r.Context(), id, ListOptions{Limit: len(authorIDs)})
+	if err != nil {
+		internalError(w, r, err)
+		return
+	}
 
-		w.WriteHeader(http.StatusNoContent)
-	})(w, r)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(authors)
 }
@@ -2,15 +2,94 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"net/http"
 	"net/http/httptest"
+	"reflect"
 	"strconv"
+	"strings"
 	"testing"
+	"time"
 
-	"github.com/gorilla/mux"
+	"github.com/golang-jwt/jwt"
+	"golang.org/x/crypto/bcrypt"
 )
 
+// testConfig is the configuration used by the handler tests
+var testConfig = Config{
+	Addr:      ":8000",
+	Store:     "memory",
+	JWTSecret: "test-secret-key-0123456789",
+
+	AccessTokenTTL:  15 * time.Minute,
+	RefreshTokenTTL: time.Hour,
+	Roles:           defaultRoles(),
+	Lockout:         defaultConfig().Lockout,
+	MaxPageSize:     defaultConfig().MaxPageSize,
+}
+
+// newTestServer returns a server backed by a test store seeded with two
+// books, one author, a link between them and the admin account
+func newTestServer(t *testing.T) *server {
+	return newTestServerWith(t, testConfig)
+}
+
+// newTestServerWith is newTestServer with a custom configuration
+func newTestServerWith(t *testing.T, cfg Config) *server {
+	store := newTestStore(t, "")
+	ctx := context.Background()
+
+	// The lowest bcrypt cost keeps the tests fast
+	hash, err := bcrypt.GenerateFromPassword([]byte("password"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	seed := []error{
+		store.CreateUser(ctx, &User{Username: "admin", PasswordHash: string(hash), Role: roleAdmin}),
+		store.CreateBook(ctx, &Book{Title: "First Book", PublishedYear: "2001", ISBN: "9781111111113"}),
+		store.CreateBook(ctx, &Book{Title: "Second Book", PublishedYear: "2002", ISBN: "9782222222224"}),
+		store.CreateAuthor(ctx, &Author{Name: "Jane Doe", Country: "ID"}),
+		store.CreateAuthorBook(ctx, &AuthorBook{AuthorID: 1, BookID: 2}),
+	}
+	for _, err := range seed {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	s, err := newServer(cfg, store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+// authorize adds a valid admin token to the request
+func authorize(t *testing.T, req *http.Request) {
+	authorizeAs(t, req, "admin", roleAdmin)
+}
+
+// authorizeAs adds a valid token for username with role to the request
+func authorizeAs(t *testing.T, req *http.Request, username, role string) {
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, &Claims{
+		Username: username,
+		Role:     role,
+		StandardClaims: jwt.StandardClaims{
+			Id:        "test-token",
+			ExpiresAt: time.Now().Add(time.Hour).Unix(),
+		},
+	})
+	token.Header["kid"] = hmacKeyID
+	tokenString, err := token.SignedString([]byte(testConfig.JWTSecret))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Authorization", "Bearer "+tokenString)
+}
+
 func TestLogin(t *testing.T) {
 	// Create a request body with valid credentials
 	creds := struct {
@@ -30,9 +109,8 @@ func TestLogin(t *testing.T) {
 	// Create a response recorder to capture the response
 	rr := httptest.NewRecorder()
 
-	// Create a new router and server
-	router := mux.NewRouter()
-	router.HandleFunc("/login", login).Methods("POST")
+	// Create a new server
+	router := newTestServer(t)
 
 	// Serve the request
 	router.ServeHTTP(rr, req)
@@ -60,13 +138,13 @@ func TestGetAllBooks(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
+	authorize(t, req)
 
 	// Create a response recorder to capture the response
 	rr := httptest.NewRecorder()
 
-	// Create a new router and server
-	router := mux.NewRouter()
-	router.HandleFunc("/books", getAllBooks).Methods("GET")
+	// Create a new server
+	router := newTestServer(t)
 
 	// Serve the request
 	router.ServeHTTP(rr, req)
@@ -93,7 +171,7 @@ func TestCreateBook(t *testing.T) {
 	book := Book{
 		Title:         "Test Book",
 		PublishedYear: "2023",
-		ISBN:          1234567890,
+		ISBN:          "9780306406157",
 	}
 	body, _ := json.Marshal(book)
 
@@ -101,13 +179,13 @@ func TestCreateBook(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
+	authorize(t, req)
 
 	// Create a response recorder to capture the response
 	rr := httptest.NewRecorder()
 
-	// Create a new router and server
-	router := mux.NewRouter()
-	router.HandleFunc("/books", createBook).Methods("POST")
+	// Create a new server
+	router := newTestServer(t)
 
 	// Serve the request
 	router.ServeHTTP(rr, req)
@@ -138,13 +216,13 @@ func TestGetBook(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
+	authorize(t, req)
 
 	// Create a response recorder to capture the response
 	rr := httptest.NewRecorder()
 
-	// Create a new router and server
-	router := mux.NewRouter()
-	router.HandleFunc("/books/{id}", getBook).Methods("GET")
+	// Create a new server
+	router := newTestServer(t)
 
 	// Serve the request
 	router.ServeHTTP(rr, req)
@@ -174,7 +252,7 @@ func TestUpdateBook(t *testing.T) {
 	book := Book{
 		Title:         "Updated Book",
 		PublishedYear: "2022",
-		ISBN:          9876543210,
+		ISBN:          "9789876543217",
 	}
 	body, _ := json.Marshal(book)
 
@@ -182,13 +260,13 @@ func TestUpdateBook(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
+	authorize(t, req)
 
 	// Create a response recorder to capture the response
 	rr := httptest.NewRecorder()
 
-	// Create a new router and server
-	router := mux.NewRouter()
-	router.HandleFunc("/books/{id}", updateBook).Methods("PUT")
+	// Create a new server
+	router := newTestServer(t)
 
 	// Serve the request
 	router.ServeHTTP(rr, req)
@@ -219,13 +297,13 @@ func TestDeleteBook(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
+	authorize(t, req)
 
 	// Create a response recorder to capture the response
 	rr := httptest.NewRecorder()
 
-	// Create a new router and server
-	router := mux.NewRouter()
-	router.HandleFunc("/books/{id}", deleteBook).Methods("DELETE")
+	// Create a new server
+	router := newTestServer(t)
 
 	// Serve the request
 	router.ServeHTTP(rr, req)
@@ -241,13 +319,13 @@ func TestGetAllAuthors(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
+	authorize(t, req)
 
 	// Create a response recorder to capture the response
 	rr := httptest.NewRecorder()
 
-	// Create a new router and server
-	router := mux.NewRouter()
-	router.HandleFunc("/authors", getAllAuthors).Methods("GET")
+	// Create a new server
+	router := newTestServer(t)
 
 	// Serve the request
 	router.ServeHTTP(rr, req)
@@ -273,7 +351,7 @@ func TestGetAllAuthors(t *testing.T) {
 func TestCreateAuthor(t *testing.T) {
 	author := Author{
 		Name:    "John Doe",
-		Country: "United States",
+		Country: "US",
 	}
 	body, _ := json.Marshal(author)
 
@@ -281,13 +359,13 @@ func TestCreateAuthor(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
+	authorize(t, req)
 
 	// Create a response recorder to capture the response
 	rr := httptest.NewRecorder()
 
-	// Create a new router and server
-	router := mux.NewRouter()
-	router.HandleFunc("/authors", createAuthor).Methods("POST")
+	// Create a new server
+	router := newTestServer(t)
 
 	// Serve the request
 	router.ServeHTTP(rr, req)
@@ -318,13 +396,13 @@ func TestGetAuthor(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
+	authorize(t, req)
 
 	// Create a response recorder to capture the response
 	rr := httptest.NewRecorder()
 
-	// Create a new router and server
-	router := mux.NewRouter()
-	router.HandleFunc("/authors/{id}", getAuthor).Methods("GET")
+	// Create a new server
+	router := newTestServer(t)
 
 	// Serve the request
 	router.ServeHTTP(rr, req)
@@ -353,7 +431,7 @@ func TestUpdateAuthor(t *testing.T) {
 
 	author := Author{
 		Name:    "Updated Author",
-		Country: "United Kingdom",
+		Country: "GB",
 	}
 	body, _ := json.Marshal(author)
 
@@ -361,13 +439,13 @@ func TestUpdateAuthor(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
+	authorize(t, req)
 
 	// Create a response recorder to capture the response
 	rr := httptest.NewRecorder()
 
-	// Create a new router and server
-	router := mux.NewRouter()
-	router.HandleFunc("/authors/{id}", updateAuthor).Methods("PUT")
+	// Create a new server
+	router := newTestServer(t)
 
 	// Serve the request
 	router.ServeHTTP(rr, req)
@@ -398,13 +476,13 @@ func TestDeleteAuthor(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
+	authorize(t, req)
 
 	// Create a response recorder to capture the response
 	rr := httptest.NewRecorder()
 
-	// Create a new router and server
-	router := mux.NewRouter()
-	router.HandleFunc("/authors/{id}", deleteAuthor).Methods("DELETE")
+	// Create a new server
+	router := newTestServer(t)
 
 	// Serve the request
 	router.ServeHTTP(rr, req)
@@ -432,13 +510,13 @@ func TestCreateAuthorBook(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
+	authorize(t, req)
 
 	// Create a new response recorder
 	rr := httptest.NewRecorder()
 
-	// Set up a mock router
-	router := mux.NewRouter()
-	router.HandleFunc("/authorbooks", CreateAuthorBook).Methods("POST")
+	// Create a new server
+	router := newTestServer(t)
 
 	// Serve the request
 	router.ServeHTTP(rr, req)
@@ -467,13 +545,13 @@ func TestGetAuthorBook(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
+	authorize(t, req)
 
 	// Create a new response recorder
 	rr := httptest.NewRecorder()
 
-	// Set up a mock router
-	router := mux.NewRouter()
-	router.HandleFunc("/authorbooks/{id}", GetAuthorBook).Methods("GET")
+	// Create a new server
+	router := newTestServer(t)
 
 	// Serve the request
 	router.ServeHTTP(rr, req)
@@ -505,13 +583,13 @@ func TestUpdateAuthorBook(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
+	authorize(t, req)
 
 	// Create a new response recorder
 	rr := httptest.NewRecorder()
 
-	// Set up a mock router
-	router := mux.NewRouter()
-	router.HandleFunc("/authorbooks/{id}", UpdateAuthorBook).Methods("PUT")
+	// Create a new server
+	router := newTestServer(t)
 
 	// Serve the request
 	router.ServeHTTP(rr, req)
@@ -532,19 +610,144 @@ func TestDeleteAuthorBook(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
+	authorize(t, req)
 
 	// Create a new response recorder
 	rr := httptest.NewRecorder()
 
-	// Set up a mock router
-	router := mux.NewRouter()
-	router.HandleFunc("/authorbooks/{id}", DeleteAuthorBook).Methods("DELETE")
+	// Create a new server
+	router := newTestServer(t)
 
 	// Serve the request
 	router.ServeHTTP(rr, req)
 
 	// Check the response status code
-	if rr.Code != http.StatusOK {
-		t.Errorf("Expected status code %v, but got %v", http.StatusOK, rr.Code)
+	if rr.Code != http.StatusNoContent {
+		t.Errorf("Expected status code %v, but got %v", http.StatusNoContent, rr.Code)
+	}
+}
+
+func TestMissingAndInvalidIDs(t *testing.T) {
+	s := newTestServer(t)
+
+	tests := []struct {
+		method string
+		url    string
+		body   interface{}
+		status int
+	}{
+		{"GET", "/books/99", nil, http.StatusNotFound},
+		{"PUT", "/books/99", Book{Title: "Missing"}, http.StatusNotFound},
+		{"DELETE", "/books/99", nil, http.StatusNotFound},
+		{"GET", "/authors/99", nil, http.StatusNotFound},
+		{"PUT", "/authors/99", Author{Name: "Missing"}, http.StatusNotFound},
+		{"DELETE", "/authors/99", nil, http.StatusNotFound},
+		{"GET", "/authorbooks/99", nil, http.StatusNotFound},
+		{"PUT", "/authorbooks/99", AuthorBook{AuthorID: 1, BookID: 1}, http.StatusNotFound},
+		{"DELETE", "/authorbooks/99", nil, http.StatusNotFound},
+		{"GET", "/authors/99/books", nil, http.StatusNotFound},
+		{"GET", "/books/99/authors", nil, http.StatusNotFound},
+		{"PUT", "/books/99/authors", BookAuthors{AuthorIDs: []int{1}}, http.StatusNotFound},
+		{"GET", "/books/abc/authors", nil, http.StatusBadRequest},
+		{"GET", "/books/abc", nil, http.StatusBadRequest},
+		{"PUT", "/authors/abc", Author{Name: "Name"}, http.StatusBadRequest},
+		{"DELETE", "/authorbooks/1x", nil, http.StatusBadRequest},
+		{"POST", "/users/abc/disable", nil, http.StatusBadRequest},
+		{"DELETE", "/apikeys/abc", nil, http.StatusBadRequest},
+		{"POST", "/authorbooks", AuthorBook{AuthorID: 1, BookID: 2}, http.StatusConflict},
+	}
+	for _, test := range tests {
+		rr := serveJSON(t, s, test.method, test.url, test.body)
+		if rr.Code != test.status {
+			t.Errorf("%s %s: got %d, expected %d", test.method, test.url, rr.Code, test.status)
+		}
+	}
+}
+
+func TestBookAuthorRoutes(t *testing.T) {
+	s := newTestServer(t)
+	if rr := serveJSON(t, s, "POST", "/authors", Author{Name: "John Roe", Country: "GB"}); rr.Code != http.StatusOK {
+		t.Fatalf("POST /authors: got %d, expected %d", rr.Code, http.StatusOK)
+	}
+
+	rr := serveJSON(t, s, "PUT", "/books/1/authors", BookAuthors{AuthorIDs: []int{2, 1, 2}})
+	var authors []Author
+	if err := json.NewDecoder(rr.Body).Decode(&authors); err != nil {
+		t.Fatal(err)
+	}
+	if rr.Code != http.StatusOK || len(authors) != 2 || authors[0].Name != "Jane Doe" || authors[1].Name != "John Roe" {
+		t.Errorf("PUT /books/1/authors: got %d %+v, expected both authors", rr.Code, authors)
+	}
+
+	tests := []struct {
+		url string
+		ids []int
+	}{
+		{"/authors/1/books", []int{1, 2}},
+		{"/authors/1/books?published_year=2002", []int{2}},
+		{"/authors/2/books", []int{1}},
+		{"/books/1/authors?sort=-name", []int{2, 1}},
+		{"/books/1/authors?country=GB", []int{2}},
+		{"/books/2/authors", []int{1}},
+	}
+	for _, test := range tests {
+		ids, total, _ := listIDs(t, s, test.url)
+		if !reflect.DeepEqual(ids, test.ids) || total != strconv.Itoa(len(test.ids)) {
+			t.Errorf("GET %s: got %v of %s, expected %v", test.url, ids, total, test.ids)
+		}
+	}
+
+	// Pages link to each other like the top level lists
+	if _, _, links := listIDs(t, s, "/authors/1/books?limit=1"); !strings.HasPrefix(links["next"], "/authors/1/books?cursor=") {
+		t.Errorf("got links %v, expected a next page", links)
+	}
+
+	// An empty list removes every author
+	serveJSON(t, s, "PUT", "/books/1/authors", BookAuthors{AuthorIDs: []int{}})
+	if ids, _, _ := listIDs(t, s, "/books/1/authors"); len(ids) != 0 {
+		t.Errorf("got authors %v after removing them all", ids)
+	}
+
+	for _, body := range []any{BookAuthors{}, BookAuthors{AuthorIDs: []int{0}}, BookAuthors{AuthorIDs: []int{1, 99}}} {
+		problem := decodeProblem(t, serveJSON(t, s, "PUT", "/books/1/authors", body), http.StatusBadRequest, problemValidation)
+		if len(problem.Errors) != 1 {
+			t.Errorf("PUT %+v: got errors %+v, expected one", body, problem.Errors)
+		}
+	}
+
+	// Librarians can't delete links, which replacing the authors does
+	req := httptest.NewRequest("PUT", "/books/1/authors", strings.NewReader(`{"author_ids": [1]}`))
+	authorizeAs(t, req, "librarian", roleLibrarian)
+	rr = httptest.NewRecorder()
+	s.ServeHTTP(rr, req)
+	if rr.Code != http.StatusForbidden {
+		t.Errorf("PUT as librarian: got %d, expected %d", rr.Code, http.StatusForbidden)
+	}
+}
+
+// failingStore is a store whose database is unreachable
+type failingStore struct {
+	Store
+}
+
+var errStoreDown = errors.New("database is down")
+
+func (failingStore) GetBook(ctx context.Context, id int) (Book, error) {
+	return Book{}, errStoreDown
+}
+
+func (failingStore) DeleteAuthor(ctx context.Context, id int) error {
+	return errStoreDown
+}
+
+func TestStoreFailureIsNotNotFound(t *testing.T) {
+	s := newTestServer(t)
+	s.store = failingStore{s.store}
+
+	if rr := serveJSON(t, s, "GET", "/books/1", nil); rr.Code != http.StatusInternalServerError {
+		t.Errorf("GET /books/1: got %d, expected %d", rr.Code, http.StatusInternalServerError)
+	}
+	if rr := serveJSON(t, s, "DELETE", "/authors/1", nil); rr.Code != http.StatusInternalServerError {
+		t.Errorf("DELETE /authors/1: got %d, expected %d", rr.Code, http.StatusInternalServerError)
 	}
 }
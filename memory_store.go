@@ -0,0 +1,787 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"maps"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// memoryStore is a Store that keeps everything in process memory. It is
+// meant for tests and local development; nothing survives a restart.
+type memoryStore struct {
+	mu sync.RWMutex
+
+	books       map[int]Book
+	authors     map[int]Author
+	authorBooks map[int]AuthorBook
+	users       map[int]User
+	identities  map[int]Identity
+
+	refreshTokens map[int]RefreshToken
+	revokedTokens map[string]int64
+	apiKeys       map[int]APIKey
+	loginFailures map[string]LoginFailures
+
+	nextBookID         int
+	nextAuthorID       int
+	nextAuthorBookID   int
+	nextUserID         int
+	nextRefreshTokenID int
+	nextAPIKeyID       int
+}
+
+// newMemoryStore returns an empty in-memory store.
+func newMemoryStore() *memoryStore {
+	return &memoryStore{
+		books:       make(map[int]Book),
+		authors:     make(map[int]Author),
+		authorBooks: make(map[int]AuthorBook),
+		users:       make(map[int]User),
+		identities:  make(map[int]Identity),
+
+		refreshTokens: make(map[int]RefreshToken),
+		revokedTokens: make(map[string]int64),
+		apiKeys:       make(map[int]APIKey),
+		loginFailures: make(map[string]LoginFailures),
+
+		nextBookID:         1,
+		nextAuthorID:       1,
+		nextAuthorBookID:   1,
+		nextUserID:         1,
+		nextRefreshTokenID: 1,
+		nextAPIKeyID:       1,
+	}
+}
+
+func (s *memoryStore) Close() error {
+	return nil
+}
+
+// listPage returns the page opts of items and the number of items that
+// pass its filters, the same as a sqlStore would
+func listPage[T any](items []T, opts ListOptions, fields listFields[T]) ([]T, int, error) {
+	if err := fields.check(opts); err != nil {
+		return nil, 0, err
+	}
+
+	items = filterItems(items, opts.Filters, fields)
+	compare := func(item T, pos Position) int {
+		return comparePositions(opts.Sort, fields.position(item, opts.Sort), pos)
+	}
+	slices.SortFunc(items, func(a, b T) int {
+		return compare(a, fields.position(b, opts.Sort))
+	})
+	total := len(items)
+
+	switch {
+	case opts.After != nil:
+		i, found := slices.BinarySearchFunc(items, *opts.After, compare)
+		if found {
+			i++
+		}
+		items = items[i:]
+	case opts.Before != nil:
+		i, _ := slices.BinarySearchFunc(items, *opts.Before, compare)
+		return items[max(i-opts.Limit, 0):i], total, nil
+	}
+
+	items = items[min(opts.Offset, len(items)):]
+	return items[:min(opts.Limit, len(items))], total, nil
+}
+
+// filterItems keeps the items that pass every filter
+func filterItems[T any](items []T, filters []Filter, fields listFields[T]) []T {
+	return slices.DeleteFunc(items, func(item T) bool {
+		for _, filter := range filters {
+			if !filter.matches(fields[filter.Field].value(item)) {
+				return true
+			}
+		}
+		return false
+	})
+}
+
+// matches tells whether a field value passes the filter. A field with
+// several values passes when one of them does.
+func (f Filter) matches(value any) bool {
+	if values, ok := value.([]any); ok {
+		return slices.ContainsFunc(values, f.matches)
+	}
+
+	switch f.Op {
+	case opEq, opIn:
+		return slices.ContainsFunc(f.Values, func(v any) bool { return compareValues(value, v) == 0 })
+	case opPrefix:
+		return strings.HasPrefix(strings.ToLower(value.(string)), strings.ToLower(f.Values[0].(string)))
+	}
+
+	if value == "" {
+		return false
+	}
+	c := compareValues(value, f.Values[0])
+	switch f.Op {
+	case opGt:
+		return c > 0
+	case opGte:
+		return c >= 0
+	case opLt:
+		return c < 0
+	case opLte:
+		return c <= 0
+	}
+	return false
+}
+
+// compareValues orders two field values, which are both ints or both
+// strings
+func compareValues(a, b any) int {
+	if a, ok := a.(int); ok {
+		return cmp.Compare(a, b.(int))
+	}
+	return strings.Compare(a.(string), b.(string))
+}
+
+// comparePositions orders two positions in a list sorted by keys
+func comparePositions(keys []SortKey, a, b Position) int {
+	for i, key := range keys {
+		c := compareValues(a.Values[i], b.Values[i])
+		if key.Desc {
+			c = -c
+		}
+		if c != 0 {
+			return c
+		}
+	}
+	return cmp.Compare(a.ID, b.ID)
+}
+
+func (s *memoryStore) AllBooks(ctx context.Context) ([]Book, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	books := make([]Book, 0, len(s.books))
+	for _, book := range s.books {
+		books = append(books, book)
+	}
+	sort.Slice(books, func(i, j int) bool { return books[i].ID < books[j].ID })
+	return books, nil
+}
+
+func (s *memoryStore) ListBooks(ctx context.Context, opts ListOptions) ([]Book, int, error) {
+	books, _ := s.AllBooks(ctx)
+	return listPage(books, opts, s.bookFields())
+}
+
+// authorCountries returns the countries of the authors of every book
+func (s *memoryStore) authorCountries() map[int][]string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	countries := make(map[int][]string)
+	for _, authorBook := range s.authorBooks {
+		author, ok := s.authors[authorBook.AuthorID]
+		if ok && !slices.Contains(countries[authorBook.BookID], author.Country) {
+			countries[authorBook.BookID] = append(countries[authorBook.BookID], author.Country)
+		}
+	}
+	return countries
+}
+
+// bookFields returns bookFields with the author_country of every book
+func (s *memoryStore) bookFields() listFields[Book] {
+	countries := s.authorCountries()
+	fields := maps.Clone(bookFields)
+	field := fields["author_country"]
+	field.value = func(b Book) any {
+		values := []any{}
+		for _, country := range countries[b.ID] {
+			values = append(values, country)
+		}
+		return values
+	}
+	fields["author_country"] = field
+	return fields
+}
+
+func (s *memoryStore) BookFacets(ctx context.Context, names []string, filters []Filter) (Facets, error) {
+	fields := s.bookFields()
+	if err := fields.check(ListOptions{Filters: filters}); err != nil {
+		return nil, err
+	}
+	books, _ := s.AllBooks(ctx)
+	books = filterItems(books, filters, fields)
+	countries := s.authorCountries()
+
+	facets := make(Facets)
+	for _, name := range names {
+		counts := make(map[string]int)
+		for _, book := range books {
+			var values []string
+			switch name {
+			case facetYear:
+				values = []string{book.PublishedYear}
+			case facetDecade:
+				values = []string{decade(book.PublishedYear)}
+			case facetLanguage:
+				values = []string{book.Language}
+			case facetGenre:
+				values = []string{book.Genre}
+			case facetAuthorCountry:
+				values = countries[book.ID]
+			default:
+				return nil, fmt.Errorf("can't count books by %q", name)
+			}
+			for _, value := range values {
+				if value != "" {
+					counts[value]++
+				}
+			}
+		}
+		facets[name] = facetCounts(name, counts)
+	}
+	return facets, nil
+}
+
+func (s *memoryStore) GetBook(ctx context.Context, id int) (Book, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	book, ok := s.books[id]
+	if !ok {
+		return Book{}, ErrNotFound
+	}
+	return book, nil
+}
+
+func (s *memoryStore) GetBookByISBN(ctx context.Context, isbn ISBN) (Book, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for _, book := range s.books {
+		if book.ISBN != "" && book.ISBN == isbn {
+			return book, nil
+		}
+	}
+	return Book{}, ErrNotFound
+}
+
+// isbnTaken reports whether another book than book has its ISBN
+func (s *memoryStore) isbnTaken(book *Book) bool {
+	for _, other := range s.books {
+		if book.ISBN != "" && other.ISBN == book.ISBN && other.ID != book.ID {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *memoryStore) CreateBook(ctx context.Context, book *Book) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	book.ID = s.nextBookID
+	if s.isbnTaken(book) {
+		return ErrConflict
+	}
+	s.nextBookID++
+	s.books[book.ID] = *book
+	return nil
+}
+
+func (s *memoryStore) UpdateBook(ctx context.Context, book *Book) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.books[book.ID]; !ok {
+		return ErrNotFound
+	}
+	if s.isbnTaken(book) {
+		return ErrConflict
+	}
+	s.books[book.ID] = *book
+	return nil
+}
+
+func (s *memoryStore) DeleteBook(ctx context.Context, id int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.books[id]; !ok {
+		return ErrNotFound
+	}
+	delete(s.books, id)
+	s.unlink(func(authorBook AuthorBook) bool { return authorBook.BookID == id })
+	return nil
+}
+
+// unlink deletes the author books that match, as ON DELETE CASCADE does in
+// the SQL stores
+func (s *memoryStore) unlink(match func(AuthorBook) bool) {
+	maps.DeleteFunc(s.authorBooks, func(_ int, authorBook AuthorBook) bool { return match(authorBook) })
+}
+
+func (s *memoryStore) BookExists(ctx context.Context, id int) (bool, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	_, ok := s.books[id]
+	return ok, nil
+}
+
+func (s *memoryStore) AllAuthors(ctx context.Context) ([]Author, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	authors := make([]Author, 0, len(s.authors))
+	for _, author := range s.authors {
+		authors = append(authors, author)
+	}
+	sort.Slice(authors, func(i, j int) bool { return authors[i].ID < authors[j].ID })
+	return authors, nil
+}
+
+func (s *memoryStore) ListAuthors(ctx context.Context, opts ListOptions) ([]Author, int, error) {
+	authors, _ := s.AllAuthors(ctx)
+	return listPage(authors, opts, authorFields)
+}
+
+func (s *memoryStore) GetAuthor(ctx context.Context, id int) (Author, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	author, ok := s.authors[id]
+	if !ok {
+		return Author{}, ErrNotFound
+	}
+	return author, nil
+}
+
+func (s *memoryStore) CreateAuthor(ctx context.Context, author *Author) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	author.ID = s.nextAuthorID
+	s.nextAuthorID++
+	s.authors[author.ID] = *author
+	return nil
+}
+
+func (s *memoryStore) UpdateAuthor(ctx context.Context, author *Author) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.authors[author.ID]; !ok {
+		return ErrNotFound
+	}
+	s.authors[author.ID] = *author
+	return nil
+}
+
+func (s *memoryStore) DeleteAuthor(ctx context.Context, id int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.authors[id]; !ok {
+		return ErrNotFound
+	}
+	delete(s.authors, id)
+	s.unlink(func(authorBook AuthorBook) bool { return authorBook.AuthorID == id })
+	return nil
+}
+
+func (s *memoryStore) AuthorExists(ctx context.Context, id int) (bool, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	_, ok := s.authors[id]
+	return ok, nil
+}
+
+func (s *memoryStore) GetAuthorBook(ctx context.Context, id int) (AuthorBook, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	authorBook, ok := s.authorBooks[id]
+	if !ok {
+		return AuthorBook{}, ErrNotFound
+	}
+	return authorBook, nil
+}
+
+// linked reports whether another link than authorBook joins its author and
+// book
+func (s *memoryStore) linked(authorBook *AuthorBook) bool {
+	for _, other := range s.authorBooks {
+		if other.AuthorID == authorBook.AuthorID && other.BookID == authorBook.BookID && other.AuthorBookID != authorBook.AuthorBookID {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *memoryStore) CreateAuthorBook(ctx context.Context, authorBook *AuthorBook) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	authorBook.AuthorBookID = s.nextAuthorBookID
+	if s.linked(authorBook) {
+		return ErrConflict
+	}
+	s.nextAuthorBookID++
+	s.authorBooks[authorBook.AuthorBookID] = *authorBook
+	return nil
+}
+
+// linkedIDs returns the IDs of the books of an author, or of the authors of
+// a book when byBook is set
+func (s *memoryStore) linkedIDs(id int, byBook bool) map[int]bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	ids := make(map[int]bool)
+	for _, authorBook := range s.authorBooks {
+		switch {
+		case byBook && authorBook.BookID == id:
+			ids[authorBook.AuthorID] = true
+		case !byBook && authorBook.AuthorID == id:
+			ids[authorBook.BookID] = true
+		}
+	}
+	return ids
+}
+
+func (s *memoryStore) ListBooksByAuthor(ctx context.Context, authorID int, opts ListOptions) ([]Book, int, error) {
+	linked := s.linkedIDs(authorID, false)
+	books, _ := s.AllBooks(ctx)
+	books = slices.DeleteFunc(books, func(b Book) bool { return !linked[b.ID] })
+	return listPage(books, opts, s.bookFields())
+}
+
+func (s *memoryStore) ListAuthorsOfBook(ctx context.Context, bookID int, opts ListOptions) ([]Author, int, error) {
+	linked := s.linkedIDs(bookID, true)
+	authors, _ := s.AllAuthors(ctx)
+	authors = slices.DeleteFunc(authors, func(a Author) bool { return !linked[a.ID] })
+	return listPage(authors, opts, authorFields)
+}
+
+func (s *memoryStore) SetBookAuthors(ctx context.Context, bookID int, authorIDs []int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.books[bookID]; !ok {
+		return ErrNotFound
+	}
+	for id, authorBook := range s.authorBooks {
+		if authorBook.BookID == bookID && !slices.Contains(authorIDs, authorBook.AuthorID) {
+			delete(s.authorBooks, id)
+		}
+	}
+	for _, authorID := range authorIDs {
+		authorBook := AuthorBook{AuthorBookID: s.nextAuthorBookID, AuthorID: authorID, BookID: bookID}
+		if !s.linked(&authorBook) {
+			s.nextAuthorBookID++
+			s.authorBooks[authorBook.AuthorBookID] = authorBook
+		}
+	}
+	return nil
+}
+
+func (s *memoryStore) UpdateAuthorBook(ctx context.Context, authorBook *AuthorBook) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.authorBooks[authorBook.AuthorBookID]; !ok {
+		return ErrNotFound
+	}
+	if s.linked(authorBook) {
+		return ErrConflict
+	}
+	s.authorBooks[authorBook.AuthorBookID] = *authorBook
+	return nil
+}
+
+func (s *memoryStore) DeleteAuthorBook(ctx context.Context, id int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.authorBooks[id]; !ok {
+		return ErrNotFound
+	}
+	delete(s.authorBooks, id)
+	return nil
+}
+
+func (s *memoryStore) AllUsers(ctx context.Context) ([]User, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	users := make([]User, 0, len(s.users))
+	for _, user := range s.users {
+		users = append(users, user)
+	}
+	sort.Slice(users, func(i, j int) bool { return users[i].ID < users[j].ID })
+	return users, nil
+}
+
+func (s *memoryStore) GetUser(ctx context.Context, id int) (User, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	user, ok := s.users[id]
+	if !ok {
+		return User{}, ErrNotFound
+	}
+	return user, nil
+}
+
+func (s *memoryStore) GetUserByUsername(ctx context.Context, username string) (User, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for _, user := range s.users {
+		if user.Username == username {
+			return user, nil
+		}
+	}
+	return User{}, ErrNotFound
+}
+
+// usernameTaken tells whether a user other than user has its username
+func (s *memoryStore) usernameTaken(user *User) bool {
+	for _, other := range s.users {
+		if other.Username == user.Username && other.ID != user.ID {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *memoryStore) CreateUser(ctx context.Context, user *User) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	user.ID = s.nextUserID
+	if s.usernameTaken(user) {
+		return ErrConflict
+	}
+	s.nextUserID++
+	s.users[user.ID] = *user
+	return nil
+}
+
+func (s *memoryStore) UpdateUser(ctx context.Context, user *User) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.users[user.ID]; !ok {
+		return ErrNotFound
+	}
+	if s.usernameTaken(user) {
+		return ErrConflict
+	}
+	s.users[user.ID] = *user
+	return nil
+}
+
+func (s *memoryStore) GetUserByIdentity(ctx context.Context, issuer, subject string) (User, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for _, identity := range s.identities {
+		if identity.Issuer == issuer && identity.Subject == subject {
+			return s.users[identity.UserID], nil
+		}
+	}
+	return User{}, ErrNotFound
+}
+
+func (s *memoryStore) LinkIdentity(ctx context.Context, identity Identity) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.identities[identity.UserID]; ok {
+		return ErrConflict
+	}
+	for _, other := range s.identities {
+		if other.Issuer == identity.Issuer && other.Subject == identity.Subject {
+			return ErrConflict
+		}
+	}
+	s.identities[identity.UserID] = identity
+	return nil
+}
+
+func (s *memoryStore) CreateRefreshToken(ctx context.Context, token *RefreshToken) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	token.ID = s.nextRefreshTokenID
+	s.nextRefreshTokenID++
+	s.refreshTokens[token.ID] = *token
+	return nil
+}
+
+func (s *memoryStore) GetRefreshToken(ctx context.Context, tokenHash string) (RefreshToken, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for _, token := range s.refreshTokens {
+		if token.TokenHash == tokenHash {
+			return token, nil
+		}
+	}
+	return RefreshToken{}, ErrNotFound
+}
+
+func (s *memoryStore) RevokeRefreshToken(ctx context.Context, id int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	token, ok := s.refreshTokens[id]
+	if !ok || token.Revoked {
+		return ErrNotFound
+	}
+	token.Revoked = true
+	s.refreshTokens[id] = token
+	return nil
+}
+
+func (s *memoryStore) RevokeUserRefreshTokens(ctx context.Context, userID int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for id, token := range s.refreshTokens {
+		if token.UserID == userID {
+			token.Revoked = true
+			s.refreshTokens[id] = token
+		}
+	}
+	return nil
+}
+
+func (s *memoryStore) RevokeToken(ctx context.Context, jti string, expiresAt int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// Entries for tokens that have expired anyway are no longer needed
+	now := time.Now().Unix()
+	for id, exp := range s.revokedTokens {
+		if exp < now {
+			delete(s.revokedTokens, id)
+		}
+	}
+
+	s.revokedTokens[jti] = expiresAt
+	return nil
+}
+
+func (s *memoryStore) IsTokenRevoked(ctx context.Context, jti string) (bool, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	_, ok := s.revokedTokens[jti]
+	return ok, nil
+}
+
+func (s *memoryStore) AllAPIKeys(ctx context.Context) ([]APIKey, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	keys := make([]APIKey, 0, len(s.apiKeys))
+	for _, key := range s.apiKeys {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i].ID < keys[j].ID })
+	return keys, nil
+}
+
+func (s *memoryStore) GetAPIKeyByHash(ctx context.Context, keyHash string) (APIKey, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for _, key := range s.apiKeys {
+		if key.KeyHash == keyHash {
+			return key, nil
+		}
+	}
+	return APIKey{}, ErrNotFound
+}
+
+func (s *memoryStore) CreateAPIKey(ctx context.Context, key *APIKey) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key.ID = s.nextAPIKeyID
+	s.nextAPIKeyID++
+	s.apiKeys[key.ID] = *key
+	return nil
+}
+
+func (s *memoryStore) RevokeAPIKey(ctx context.Context, id int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key, ok := s.apiKeys[id]
+	if !ok || key.Revoked {
+		return ErrNotFound
+	}
+	key.Revoked = true
+	s.apiKeys[id] = key
+	return nil
+}
+
+func (s *memoryStore) TouchAPIKey(ctx context.Context, id int, usedAt time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if key, ok := s.apiKeys[id]; ok {
+		key.LastUsedAt = &usedAt
+		s.apiKeys[id] = key
+	}
+	return nil
+}
+
+func (s *memoryStore) GetLoginFailures(ctx context.Context, key string) (LoginFailures, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.loginFailures[key], nil
+}
+
+func (s *memoryStore) AddLoginFailure(ctx context.Context, key string, at time.Time, resetAfter time.Duration) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	failures := s.loginFailures[key]
+	if at.Sub(failures.LastFailure) > resetAfter {
+		failures.Failures = 0
+	}
+	failures.Failures++
+	failures.LastFailure = at
+	s.loginFailures[key] = failures
+	return failures.Failures, nil
+}
+
+func (s *memoryStore) LockLogin(ctx context.Context, key string, until time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	failures := s.loginFailures[key]
+	failures.LockedUntil = until
+	s.loginFailures[key] = failures
+	return nil
+}
+
+func (s *memoryStore) ClearLoginFailures(ctx context.Context, key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.loginFailures, key)
+	return nil
+}
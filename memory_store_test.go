@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"testing"
+)
+
+func TestMemoryStoreConcurrentCreate(t *testing.T) {
+	store := newMemoryStore()
+	ctx := context.Background()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := store.CreateBook(ctx, &Book{Title: "Concurrent"}); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	books, err := store.AllBooks(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(books) != 50 {
+		t.Fatalf("expected 50 books, got %d", len(books))
+	}
+
+	// IDs are assigned sequentially without gaps or duplicates
+	for i, book := range books {
+		if book.ID != i+1 {
+			t.Errorf("expected book ID %d, got %d", i+1, book.ID)
+		}
+	}
+}
+
+func TestMemoryStoreExists(t *testing.T) {
+	store := newMemoryStore()
+	ctx := context.Background()
+
+	author := Author{Name: "Jane Doe", Country: "Indonesia"}
+	if err := store.CreateAuthor(ctx, &author); err != nil {
+		t.Fatal(err)
+	}
+
+	exists, err := store.AuthorExists(ctx, author.ID)
+	if err != nil || !exists {
+		t.Errorf("expected author %d to exist", author.ID)
+	}
+
+	if err := store.DeleteAuthor(ctx, author.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	exists, err = store.AuthorExists(ctx, author.ID)
+	if err != nil || exists {
+		t.Errorf("expected author %d to be deleted", author.ID)
+	}
+
+	if _, err := store.GetAuthor(ctx, author.ID); err != ErrNotFound {
+		t.Errorf("expected ErrNotFound, got %v", err)
+	}
+}
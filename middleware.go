@@ -0,0 +1,164 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strings"
+
+	"github.com/golang-jwt/jwt"
+)
+
+// authRealm is the realm announced in WWW-Authenticate challenges
+const authRealm = "BookAPI"
+
+// Principal is the authenticated caller of a request
+type Principal struct {
+	Username string
+	Role     string
+	// TokenID and ExpiresAt identify the access token used, so that it can
+	// be revoked
+	TokenID   string
+	ExpiresAt int64
+	// APIKeyID is set when the caller authenticated with an API key, which
+	// grants Scopes instead of the permissions of a role
+	APIKeyID int
+	Scopes   []string
+	// DailyQuota limits the requests per day of an API key; zero means
+	// unlimited
+	DailyQuota int
+}
+
+type principalKey struct{}
+
+// principalFromContext returns the caller stored by the authenticate
+// middleware
+func principalFromContext(ctx context.Context) (*Principal, bool) {
+	principal, ok := ctx.Value(principalKey{}).(*Principal)
+	return principal, ok
+}
+
+// bearerToken extracts the token from an RFC 6750 "Bearer" Authorization
+// header. ok is false when the header is missing or uses another scheme.
+func bearerToken(header string) (token string, ok bool) {
+	scheme, token, found := strings.Cut(header, " ")
+	if !found || !strings.EqualFold(scheme, "Bearer") {
+		return "", false
+	}
+
+	token = strings.TrimLeft(token, " ")
+	if token == "" || strings.ContainsAny(token, " \t") {
+		return "", false
+	}
+	return token, true
+}
+
+// challenge answers with status, a Bearer WWW-Authenticate header and a
+// problem body. An empty errorCode produces the bare challenge RFC 6750
+// prescribes for requests that carried no credentials.
+func challenge(w http.ResponseWriter, r *http.Request, status int, errorCode, description, scope string) {
+	value := `Bearer realm="` + authRealm + `"`
+	if errorCode != "" {
+		value += `, error="` + errorCode + `"`
+	}
+	if description != "" {
+		value += `, error_description="` + description + `"`
+	}
+	if scope != "" {
+		value += `, scope="` + scope + `"`
+	}
+
+	w.Header().Set("WWW-Authenticate", value)
+
+	typ, detail := problemUnauthorized, description
+	switch status {
+	case http.StatusBadRequest:
+		typ = problemBadRequest
+	case http.StatusForbidden:
+		typ, detail = problemForbidden, "Requires the "+scope+" permission"
+	}
+	if detail == "" {
+		detail = "A Bearer token is required"
+	}
+	writeProblem(w, r, status, typ, detail)
+}
+
+// authenticate is the middleware of the protected routes. It validates the
+// Bearer token, either a JWT or an API key, and stores the caller in the
+// request context.
+func (s *server) authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		header := r.Header.Get("Authorization")
+		if header == "" {
+			challenge(w, r, http.StatusUnauthorized, "", "", "")
+			return
+		}
+
+		tokenString, ok := bearerToken(header)
+		if !ok {
+			challenge(w, r, http.StatusBadRequest, "invalid_request", "Authorization header must use the Bearer scheme", "")
+			return
+		}
+
+		if strings.HasPrefix(tokenString, apiKeyPrefix) {
+			principal, ok := s.authenticateAPIKey(w, r, tokenString)
+			if !ok {
+				return
+			}
+			ctx := context.WithValue(r.Context(), principalKey{}, principal)
+			next.ServeHTTP(w, r.WithContext(ctx))
+			return
+		}
+
+		claims := &Claims{}
+		token, err := jwt.ParseWithClaims(tokenString, claims, s.keys.keyFunc)
+
+		// Tokens without an expiry or ID predate expiring tokens and are no
+		// longer accepted
+		if err != nil || !token.Valid || claims.ExpiresAt == 0 || claims.Id == "" {
+			challenge(w, r, http.StatusUnauthorized, "invalid_token", "The access token is invalid or expired", "")
+			return
+		}
+
+		revoked, err := s.store.IsTokenRevoked(r.Context(), claims.Id)
+		if err != nil {
+			internalError(w, r, err)
+			return
+		}
+		if revoked {
+			challenge(w, r, http.StatusUnauthorized, "invalid_token", "The access token has been revoked", "")
+			return
+		}
+
+		principal := &Principal{
+			Username:  claims.Username,
+			Role:      claims.Role,
+			TokenID:   claims.Id,
+			ExpiresAt: claims.ExpiresAt,
+		}
+		ctx := context.WithValue(r.Context(), principalKey{}, principal)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// allowed reports whether the caller may do what permission grants, by the
+// scopes of its API key or else by its role
+func (s *server) allowed(principal *Principal, permission string) bool {
+	if principal.APIKeyID != 0 {
+		return grants(principal.Scopes, permission)
+	}
+	return s.roles.allows(principal.Role, permission)
+}
+
+// require wraps a protected handler so that it only runs when the caller is
+// allowed permission, answering 403 otherwise
+func (s *server) require(permission string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		principal, ok := principalFromContext(r.Context())
+		if !ok || !s.allowed(principal, permission) {
+			challenge(w, r, http.StatusForbidden, "insufficient_scope", "", permission)
+			return
+		}
+
+		next(w, r)
+	}
+}
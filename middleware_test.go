@@ -0,0 +1,126 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestBearerToken(t *testing.T) {
+	tests := []struct {
+		header string
+		token  string
+		ok     bool
+	}{
+		{"Bearer abc.def.ghi", "abc.def.ghi", true},
+		{"bearer abc.def.ghi", "abc.def.ghi", true},
+		{"BEARER  abc.def.ghi", "abc.def.ghi", true},
+		{"abc.def.ghi", "", false},
+		{"Basic dXNlcjpwYXNz", "", false},
+		{"Bearer", "", false},
+		{"Bearer ", "", false},
+		{"Bearer abc def", "", false},
+	}
+
+	for _, test := range tests {
+		token, ok := bearerToken(test.header)
+		if token != test.token || ok != test.ok {
+			t.Errorf("bearerToken(%q) = %q, %v; expected %q, %v", test.header, token, ok, test.token, test.ok)
+		}
+	}
+}
+
+func TestAuthenticateChallenges(t *testing.T) {
+	router := newTestServer(t)
+
+	tests := []struct {
+		name         string
+		header       string
+		status       int
+		authenticate string
+	}{
+		{"missing", "", http.StatusUnauthorized, `Bearer realm="BookAPI"`},
+		{"wrong scheme", "Basic dXNlcjpwYXNz", http.StatusBadRequest, `Bearer realm="BookAPI", error="invalid_request", error_description="Authorization header must use the Bearer scheme"`},
+		{"invalid token", "Bearer not-a-jwt", http.StatusUnauthorized, `Bearer realm="BookAPI", error="invalid_token", error_description="The access token is invalid or expired"`},
+	}
+
+	for _, test := range tests {
+		req, err := http.NewRequest("GET", "/books", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if test.header != "" {
+			req.Header.Set("Authorization", test.header)
+		}
+
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+
+		if rr.Code != test.status {
+			t.Errorf("%s: got status %d, expected %d", test.name, rr.Code, test.status)
+		}
+		if got := rr.Header().Get("WWW-Authenticate"); got != test.authenticate {
+			t.Errorf("%s: got WWW-Authenticate %q, expected %q", test.name, got, test.authenticate)
+		}
+	}
+}
+
+func TestRequireChallenge(t *testing.T) {
+	router := newTestServer(t)
+
+	req, err := http.NewRequest("DELETE", "/books/1", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	authorizeAs(t, req, "reader", roleReader)
+
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusForbidden {
+		t.Errorf("got status %d, expected %d", rr.Code, http.StatusForbidden)
+	}
+	expected := `Bearer realm="BookAPI", error="insufficient_scope", scope="delete:books"`
+	if got := rr.Header().Get("WWW-Authenticate"); got != expected {
+		t.Errorf("got WWW-Authenticate %q, expected %q", got, expected)
+	}
+}
+
+func TestPublicRoutesSkipAuthentication(t *testing.T) {
+	router := newTestServer(t)
+
+	// Unknown paths are not found rather than unauthorized
+	req, err := http.NewRequest("GET", "/nowhere", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	if rr.Code != http.StatusNotFound {
+		t.Errorf("unknown path returned %d, expected %d", rr.Code, http.StatusNotFound)
+	}
+
+	if code := loginStatus(t, router, "admin", "password"); code != http.StatusOK {
+		t.Errorf("login returned %d, expected %d", code, http.StatusOK)
+	}
+}
+
+func TestAuthenticateStoresPrincipal(t *testing.T) {
+	s := newTestServer(t)
+
+	var got *Principal
+	handler := s.authenticate(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got, _ = principalFromContext(r.Context())
+	}))
+
+	req, err := http.NewRequest("GET", "/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	authorizeAs(t, req, "librarian", roleLibrarian)
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	if got == nil || got.Username != "librarian" || got.Role != roleLibrarian || got.TokenID == "" {
+		t.Errorf("expected the librarian principal in the context, got %+v", got)
+	}
+}
@@ -0,0 +1,302 @@
+package main
+
+import (
+	"context"
+	"embed"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// migrationFiles holds the versioned schema for each SQL dialect. Files are
+// named <version>_<name>.up.sql and <version>_<name>.down.sql.
+//
+//go:embed migrations
+var migrationFiles embed.FS
+
+// migration is one versioned schema change.
+type migration struct {
+	version int
+	name    string
+	up      string
+	down    string
+}
+
+// migrationStatus reports whether a migration has been applied.
+type migrationStatus struct {
+	migration
+	applied   bool
+	appliedAt string
+}
+
+func (d dialect) String() string {
+	switch d {
+	case dialectMySQL:
+		return "mysql"
+	case dialectSQLite:
+		return "sqlite"
+	case dialectPostgres:
+		return "postgres"
+	default:
+		return "dialect(" + strconv.Itoa(int(d)) + ")"
+	}
+}
+
+// loadMigrations reads the embedded migrations for d, ordered by version.
+func loadMigrations(d dialect) ([]migration, error) {
+	dir := path.Join("migrations", d.String())
+	entries, err := migrationFiles.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	byVersion := make(map[int]*migration)
+	for _, entry := range entries {
+		file := entry.Name()
+		base := strings.TrimSuffix(file, ".sql")
+		direction := path.Ext(base)
+		base = strings.TrimSuffix(base, direction)
+
+		prefix, name, ok := strings.Cut(base, "_")
+		version, err := strconv.Atoi(prefix)
+		if !ok || err != nil || (direction != ".up" && direction != ".down") {
+			return nil, fmt.Errorf("malformed migration file name %q", file)
+		}
+
+		contents, err := migrationFiles.ReadFile(path.Join(dir, file))
+		if err != nil {
+			return nil, err
+		}
+
+		m, ok := byVersion[version]
+		if !ok {
+			m = &migration{version: version, name: name}
+			byVersion[version] = m
+		}
+		if direction == ".up" {
+			m.up = string(contents)
+		} else {
+			m.down = string(contents)
+		}
+	}
+
+	migrations := make([]migration, 0, len(byVersion))
+	for _, m := range byVersion {
+		if m.up == "" || m.down == "" {
+			return nil, fmt.Errorf("migration %d is missing its up or down file", m.version)
+		}
+		migrations = append(migrations, *m)
+	}
+	sort.Slice(migrations, func(i, j int) bool { return migrations[i].version < migrations[j].version })
+	return migrations, nil
+}
+
+// splitStatements splits a migration file into statements so that drivers
+// which only accept one statement per Exec can run it. Chunks holding only
+// -- comments are dropped, since MySQL refuses them as empty queries.
+func splitStatements(script string) []string {
+	var statements []string
+	for _, statement := range strings.Split(script, ";") {
+		if statement = strings.TrimSpace(statement); !onlyComments(statement) {
+			statements = append(statements, statement)
+		}
+	}
+	return statements
+}
+
+// onlyComments tells whether a chunk of a script is empty or holds nothing
+// but -- comments
+func onlyComments(chunk string) bool {
+	for _, line := range strings.Split(chunk, "\n") {
+		if line = strings.TrimSpace(line); line != "" && !strings.HasPrefix(line, "--") {
+			return false
+		}
+	}
+	return true
+}
+
+func (s *sqlStore) ensureMigrationTable(ctx context.Context) error {
+	_, err := s.exec(ctx, `CREATE TABLE IF NOT EXISTS schema_migrations (
+	version BIGINT PRIMARY KEY,
+	applied_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+)`)
+	return err
+}
+
+// appliedMigrations returns the applied versions and when they were applied.
+func (s *sqlStore) appliedMigrations(ctx context.Context) (map[int]string, error) {
+	if err := s.ensureMigrationTable(ctx); err != nil {
+		return nil, err
+	}
+
+	rows, err := s.query(ctx, "SELECT version, applied_at FROM schema_migrations")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	applied := make(map[int]string)
+	for rows.Next() {
+		var (
+			version   int
+			appliedAt string
+		)
+		if err := rows.Scan(&version, &appliedAt); err != nil {
+			return nil, err
+		}
+		applied[version] = appliedAt
+	}
+	return applied, rows.Err()
+}
+
+// runMigration executes script and records or removes version in a single
+// transaction. MySQL commits DDL implicitly, so a failed MySQL migration may
+// leave part of its changes behind.
+func (s *sqlStore) runMigration(ctx context.Context, script string, version int, up bool) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, statement := range splitStatements(script) {
+		if _, err := tx.ExecContext(ctx, statement); err != nil {
+			return err
+		}
+	}
+
+	record := "INSERT INTO schema_migrations (version) VALUES (?)"
+	if !up {
+		record = "DELETE FROM schema_migrations WHERE version = ?"
+	}
+	if _, err := tx.ExecContext(ctx, s.rebind(record), version); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// migrateUp applies every pending migration in order and returns them.
+func (s *sqlStore) migrateUp(ctx context.Context) ([]migration, error) {
+	migrations, err := loadMigrations(s.dialect)
+	if err != nil {
+		return nil, err
+	}
+	applied, err := s.appliedMigrations(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var done []migration
+	for _, m := range migrations {
+		if _, ok := applied[m.version]; ok {
+			continue
+		}
+		if err := s.runMigration(ctx, m.up, m.version, true); err != nil {
+			return done, fmt.Errorf("migration %d_%s: %w", m.version, m.name, err)
+		}
+		done = append(done, m)
+	}
+	return done, nil
+}
+
+// migrateDown rolls back the most recent steps applied migrations and
+// returns them.
+func (s *sqlStore) migrateDown(ctx context.Context, steps int) ([]migration, error) {
+	migrations, err := loadMigrations(s.dialect)
+	if err != nil {
+		return nil, err
+	}
+	applied, err := s.appliedMigrations(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var done []migration
+	for i := len(migrations) - 1; i >= 0 && len(done) < steps; i-- {
+		m := migrations[i]
+		if _, ok := applied[m.version]; !ok {
+			continue
+		}
+		if err := s.runMigration(ctx, m.down, m.version, false); err != nil {
+			return done, fmt.Errorf("migration %d_%s: %w", m.version, m.name, err)
+		}
+		done = append(done, m)
+	}
+	return done, nil
+}
+
+// migrationStatuses lists every known migration and whether it is applied.
+func (s *sqlStore) migrationStatuses(ctx context.Context) ([]migrationStatus, error) {
+	migrations, err := loadMigrations(s.dialect)
+	if err != nil {
+		return nil, err
+	}
+	applied, err := s.appliedMigrations(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	statuses := make([]migrationStatus, len(migrations))
+	for i, m := range migrations {
+		appliedAt, ok := applied[m.version]
+		statuses[i] = migrationStatus{migration: m, applied: ok, appliedAt: appliedAt}
+	}
+	return statuses, nil
+}
+
+// runMigrate implements the "migrate up", "migrate down [steps]" and
+// "migrate status" subcommands.
+func runMigrate(ctx context.Context, store Store, args []string, out io.Writer) error {
+	s, ok := store.(*sqlStore)
+	if !ok {
+		return errors.New("migrate requires a SQL store")
+	}
+	if len(args) == 0 {
+		return errors.New("usage: migrate up | down [steps] | status")
+	}
+
+	switch args[0] {
+	case "up":
+		done, err := s.migrateUp(ctx)
+		for _, m := range done {
+			fmt.Fprintf(out, "applied %04d_%s\n", m.version, m.name)
+		}
+		if err == nil && len(done) == 0 {
+			fmt.Fprintln(out, "schema is up to date")
+		}
+		return err
+	case "down":
+		steps := 1
+		if len(args) > 1 {
+			var err error
+			if steps, err = strconv.Atoi(args[1]); err != nil || steps < 1 {
+				return fmt.Errorf("invalid number of steps %q", args[1])
+			}
+		}
+		done, err := s.migrateDown(ctx, steps)
+		for _, m := range done {
+			fmt.Fprintf(out, "rolled back %04d_%s\n", m.version, m.name)
+		}
+		return err
+	case "status":
+		statuses, err := s.migrationStatuses(ctx)
+		if err != nil {
+			return err
+		}
+		for _, status := range statuses {
+			state := "pending"
+			if status.applied {
+				state = "applied " + status.appliedAt
+			}
+			fmt.Fprintf(out, "%04d_%s\t%s\n", status.version, status.name, state)
+		}
+		return nil
+	default:
+		return fmt.Errorf("unknown migrate command %q", args[0])
+	}
+}
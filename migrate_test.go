@@ -0,0 +1,202 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestLoadMigrations(t *testing.T) {
+	for _, d := range []dialect{dialectMySQL, dialectSQLite, dialectPostgres} {
+		migrations, err := loadMigrations(d)
+		if err != nil {
+			t.Fatalf("%s: %v", d, err)
+		}
+		if len(migrations) == 0 {
+			t.Fatalf("%s: no migrations found", d)
+		}
+		for i, m := range migrations {
+			if m.version != i+1 {
+				t.Errorf("%s: expected migration version %d, got %d", d, i+1, m.version)
+			}
+		}
+	}
+}
+
+func TestSplitStatements(t *testing.T) {
+	script := `-- Adds a column
+ALTER TABLE books ADD COLUMN notes TEXT;
+CREATE INDEX books_notes ON books (notes);
+
+-- Nothing follows this comment
+`
+	expected := []string{"-- Adds a column\nALTER TABLE books ADD COLUMN notes TEXT", "CREATE INDEX books_notes ON books (notes)"}
+	if statements := splitStatements(script); !slices.Equal(statements, expected) {
+		t.Errorf("got statements %q, expected %q", statements, expected)
+	}
+}
+
+func TestMigrateCommand(t *testing.T) {
+	store, err := newSQLiteStore(filepath.Join(t.TempDir(), "library.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	ctx := context.Background()
+	run := func(args ...string) string {
+		var out bytes.Buffer
+		if err := runMigrate(ctx, store, args, &out); err != nil {
+			t.Fatalf("migrate %s: %v", strings.Join(args, " "), err)
+		}
+		return out.String()
+	}
+
+	if out := run("status"); !strings.Contains(out, "0001_create_tables\tpending") {
+		t.Errorf("expected pending migration in status, got %q", out)
+	}
+
+	if out := run("up"); !strings.Contains(out, "applied 0001_create_tables") {
+		t.Errorf("expected migration to be applied, got %q", out)
+	}
+	if out := run("up"); out != "schema is up to date\n" {
+		t.Errorf("expected second up to do nothing, got %q", out)
+	}
+	if out := run("status"); !strings.Contains(out, "0001_create_tables\tapplied") {
+		t.Errorf("expected applied migration in status, got %q", out)
+	}
+
+	// The tables exist once migrated
+	if err := store.CreateBook(ctx, &Book{Title: "Test Book", PublishedYear: "2023"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if out := run("down"); strings.Count(out, "rolled back") != 1 {
+		t.Errorf("expected a single migration to be rolled back, got %q", out)
+	}
+	if out := run("down", "99"); !strings.Contains(out, "rolled back 0001_create_tables") {
+		t.Errorf("expected migration to be rolled back, got %q", out)
+	}
+	if _, err := store.AllBooks(ctx); err == nil {
+		t.Error("expected books table to be dropped")
+	}
+
+	if err := runMigrate(ctx, newMemoryStore(), []string{"up"}, &bytes.Buffer{}); err == nil {
+		t.Error("expected migrate to fail for the memory store")
+	}
+}
+
+func TestMigrateAdoptsExistingTables(t *testing.T) {
+	store, err := newSQLiteStore(filepath.Join(t.TempDir(), "library.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	// Tables created by hand, as the README asked before migrations
+	ctx := context.Background()
+	for _, statement := range []string{
+		"CREATE TABLE books (id INTEGER PRIMARY KEY AUTOINCREMENT, title TEXT NOT NULL, published_year TEXT NOT NULL, isbn INTEGER NOT NULL)",
+		"CREATE TABLE authors (id INTEGER PRIMARY KEY AUTOINCREMENT, name TEXT NOT NULL, country TEXT NOT NULL)",
+		"CREATE TABLE author_books (author_book_id INTEGER PRIMARY KEY AUTOINCREMENT, author_id INTEGER NOT NULL, book_id INTEGER NOT NULL)",
+		"INSERT INTO books (title, published_year, isbn) VALUES ('Kept', '2001', 306406152)",
+	} {
+		if _, err := store.exec(ctx, statement); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := store.migrateUp(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	book, err := store.GetBook(ctx, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if book.Title != "Kept" || book.ISBN != "9780306406157" {
+		t.Errorf("got %+v, expected the existing book with its ISBN-13", book)
+	}
+}
+
+// migrateBefore rolls a fully migrated store back to the schema before
+// migration version
+func migrateBefore(t *testing.T, store *sqlStore, version int) {
+	t.Helper()
+
+	migrations, err := loadMigrations(store.dialect)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.migrateDown(context.Background(), len(migrations)-version+1); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMigrateExistingUsersToReaders(t *testing.T) {
+	store, err := newSQLiteStore(filepath.Join(t.TempDir(), "library.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	ctx := context.Background()
+	if _, err := store.migrateUp(ctx); err != nil {
+		t.Fatal(err)
+	}
+	// Roll back to before 0004_add_user_role
+	migrateBefore(t, store, 4)
+	if _, err := store.exec(ctx, "INSERT INTO users (username, password_hash) VALUES ('old', 'hash')"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.migrateUp(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	user, err := store.GetUserByUsername(ctx, "old")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user.Role != roleReader {
+		t.Errorf("existing user got role %q, expected %q", user.Role, roleReader)
+	}
+}
+
+func TestMigrateISBNToText(t *testing.T) {
+	store, err := newSQLiteStore(filepath.Join(t.TempDir(), "library.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	ctx := context.Background()
+	if _, err := store.migrateUp(ctx); err != nil {
+		t.Fatal(err)
+	}
+	// Roll back to before 0008_store_isbn13
+	migrateBefore(t, store, 8)
+
+	// ISBNs were numbers, so ISBN-10s lost their leading zeros. Numbers
+	// with a wrong check digit aren't ISBNs at all.
+	for _, isbn := range []int64{306406152, 9780306406157, 0, 9789876543217, 1234567890, 9780306406158, 42} {
+		if _, err := store.exec(ctx, "INSERT INTO books (title, published_year, isbn) VALUES ('Old', '2001', ?)", isbn); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := store.migrateUp(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	books, err := store.AllBooks(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []ISBN{"9780306406157", "", "", "9789876543217", "", "", ""}
+	for i, book := range books {
+		if book.ISBN != expected[i] {
+			t.Errorf("book %d: got ISBN %q, expected %q", book.ID, book.ISBN, expected[i])
+		}
+	}
+}
@@ -0,0 +1,23 @@
+-- Tables created by hand before migrations existed are adopted as they
+-- are, so that existing databases can be migrated
+CREATE TABLE IF NOT EXISTS books (
+	id INT AUTO_INCREMENT PRIMARY KEY,
+	title VARCHAR(255) NOT NULL,
+	published_year VARCHAR(4) NOT NULL,
+	isbn BIGINT NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS authors (
+	id INT AUTO_INCREMENT PRIMARY KEY,
+	name VARCHAR(255) NOT NULL,
+	country VARCHAR(255) NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS author_books (
+	author_book_id INT AUTO_INCREMENT PRIMARY KEY,
+	author_id INT NOT NULL,
+	book_id INT NOT NULL,
+	CONSTRAINT author_books_author_fk FOREIGN KEY (author_id) REFERENCES authors (id) ON DELETE CASCADE,
+	CONSTRAINT author_books_book_fk FOREIGN KEY (book_id) REFERENCES books (id) ON DELETE CASCADE,
+	CONSTRAINT author_books_unique UNIQUE (author_id, book_id)
+);
@@ -0,0 +1,7 @@
+CREATE TABLE IF NOT EXISTS users (
+	id INT AUTO_INCREMENT PRIMARY KEY,
+	username VARCHAR(255) NOT NULL,
+	password_hash VARCHAR(255) NOT NULL,
+	disabled BOOLEAN NOT NULL DEFAULT FALSE,
+	CONSTRAINT users_username_unique UNIQUE (username)
+);
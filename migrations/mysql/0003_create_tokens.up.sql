@@ -0,0 +1,14 @@
+CREATE TABLE refresh_tokens (
+	id INT AUTO_INCREMENT PRIMARY KEY,
+	user_id INT NOT NULL,
+	token_hash VARCHAR(64) NOT NULL,
+	expires_at BIGINT NOT NULL,
+	revoked BOOLEAN NOT NULL DEFAULT FALSE,
+	CONSTRAINT refresh_tokens_user_fk FOREIGN KEY (user_id) REFERENCES users (id) ON DELETE CASCADE,
+	CONSTRAINT refresh_tokens_hash_unique UNIQUE (token_hash)
+);
+
+CREATE TABLE revoked_tokens (
+	jti VARCHAR(64) PRIMARY KEY,
+	expires_at BIGINT NOT NULL
+);
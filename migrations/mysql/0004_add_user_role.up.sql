@@ -0,0 +1,3 @@
+-- Existing accounts get the least privileged role. Operators promote their
+-- admins with the set-role subcommand after upgrading.
+ALTER TABLE users ADD COLUMN role VARCHAR(32) NOT NULL DEFAULT 'reader';
@@ -0,0 +1 @@
+ALTER TABLE api_keys ADD COLUMN daily_quota INT NOT NULL DEFAULT 0;
@@ -0,0 +1,7 @@
+ALTER TABLE books DROP INDEX books_isbn_unique;
+
+ALTER TABLE books MODIFY isbn BIGINT NULL;
+
+UPDATE books SET isbn = 0 WHERE isbn IS NULL;
+
+ALTER TABLE books MODIFY isbn BIGINT NOT NULL;
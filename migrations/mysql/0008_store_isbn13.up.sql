@@ -0,0 +1,18 @@
+-- Numbers with a wrong check digit aren't ISBNs, so they become NULL
+-- rather than being turned into made-up ISBN-13s
+ALTER TABLE books ADD COLUMN isbn13 VARCHAR(13) NULL;
+
+UPDATE books SET isbn13 = CASE
+		WHEN isbn BETWEEN 9780000000000 AND 9799999999999 AND ((isbn DIV 1000000000000 MOD 10) + 3 * (isbn DIV 100000000000 MOD 10) + (isbn DIV 10000000000 MOD 10) + 3 * (isbn DIV 1000000000 MOD 10) + (isbn DIV 100000000 MOD 10) + 3 * (isbn DIV 10000000 MOD 10) + (isbn DIV 1000000 MOD 10) + 3 * (isbn DIV 100000 MOD 10) + (isbn DIV 10000 MOD 10) + 3 * (isbn DIV 1000 MOD 10) + (isbn DIV 100 MOD 10) + 3 * (isbn DIV 10 MOD 10) + (isbn MOD 10)) MOD 10 = 0 THEN CAST(isbn AS CHAR)
+		WHEN isbn BETWEEN 1 AND 9999999999 AND (10 * (isbn DIV 1000000000 MOD 10) + 9 * (isbn DIV 100000000 MOD 10) + 8 * (isbn DIV 10000000 MOD 10) + 7 * (isbn DIV 1000000 MOD 10) + 6 * (isbn DIV 100000 MOD 10) + 5 * (isbn DIV 10000 MOD 10) + 4 * (isbn DIV 1000 MOD 10) + 3 * (isbn DIV 100 MOD 10) + 2 * (isbn DIV 10 MOD 10) + (isbn MOD 10)) MOD 11 = 0 THEN CONCAT('978', LPAD(isbn DIV 10, 9, '0'), (10 - (38 + 3 * (isbn DIV 1000000000 MOD 10) + (isbn DIV 100000000 MOD 10) + 3 * (isbn DIV 10000000 MOD 10) + (isbn DIV 1000000 MOD 10) + 3 * (isbn DIV 100000 MOD 10) + (isbn DIV 10000 MOD 10) + 3 * (isbn DIV 1000 MOD 10) + (isbn DIV 100 MOD 10) + 3 * (isbn DIV 10 MOD 10)) MOD 10) MOD 10)
+	END;
+
+ALTER TABLE books DROP COLUMN isbn;
+
+ALTER TABLE books CHANGE isbn13 isbn VARCHAR(13) NULL;
+
+UPDATE books JOIN (SELECT isbn, MIN(id) AS first_id FROM books WHERE isbn IS NOT NULL GROUP BY isbn) AS firsts
+	ON books.isbn = firsts.isbn AND books.id <> firsts.first_id
+SET books.isbn = NULL;
+
+ALTER TABLE books ADD CONSTRAINT books_isbn_unique UNIQUE (isbn);
@@ -0,0 +1,9 @@
+DROP INDEX books_published_year ON books;
+
+DROP INDEX books_genre ON books;
+
+DROP INDEX books_language ON books;
+
+ALTER TABLE books DROP COLUMN genre;
+
+ALTER TABLE books DROP COLUMN language;
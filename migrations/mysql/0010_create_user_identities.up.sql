@@ -0,0 +1,11 @@
+-- Links accounts to the provider accounts that log in to them. Provider
+-- accounts are identified by issuer and subject, which unlike usernames
+-- are unique and never reassigned.
+CREATE TABLE user_identities (
+	user_id INT NOT NULL,
+	issuer VARCHAR(255) NOT NULL,
+	subject VARCHAR(255) NOT NULL,
+	CONSTRAINT user_identities_user_fk FOREIGN KEY (user_id) REFERENCES users (id) ON DELETE CASCADE,
+	CONSTRAINT user_identities_user_unique UNIQUE (user_id),
+	CONSTRAINT user_identities_subject_unique UNIQUE (issuer, subject)
+);
@@ -0,0 +1,3 @@
+DROP TABLE author_books;
+DROP TABLE authors;
+DROP TABLE books;
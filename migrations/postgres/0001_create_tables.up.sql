@@ -0,0 +1,21 @@
+-- Tables created by hand before migrations existed are adopted as they
+-- are, so that existing databases can be migrated
+CREATE TABLE IF NOT EXISTS books (
+	id SERIAL PRIMARY KEY,
+	title VARCHAR(255) NOT NULL,
+	published_year VARCHAR(4) NOT NULL,
+	isbn BIGINT NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS authors (
+	id SERIAL PRIMARY KEY,
+	name VARCHAR(255) NOT NULL,
+	country VARCHAR(255) NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS author_books (
+	author_book_id SERIAL PRIMARY KEY,
+	author_id INTEGER NOT NULL REFERENCES authors (id) ON DELETE CASCADE,
+	book_id INTEGER NOT NULL REFERENCES books (id) ON DELETE CASCADE,
+	CONSTRAINT author_books_unique UNIQUE (author_id, book_id)
+);
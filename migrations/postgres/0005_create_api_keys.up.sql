@@ -0,0 +1,12 @@
+CREATE TABLE api_keys (
+	id SERIAL PRIMARY KEY,
+	name VARCHAR(255) NOT NULL,
+	key_prefix VARCHAR(16) NOT NULL,
+	key_hash VARCHAR(64) NOT NULL,
+	scopes TEXT NOT NULL,
+	created_by VARCHAR(255) NOT NULL,
+	created_at BIGINT NOT NULL,
+	last_used_at BIGINT NULL,
+	revoked BOOLEAN NOT NULL DEFAULT FALSE,
+	CONSTRAINT api_keys_hash_unique UNIQUE (key_hash)
+);
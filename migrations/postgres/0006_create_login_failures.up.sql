@@ -0,0 +1,6 @@
+CREATE TABLE login_failures (
+	attempt_key VARCHAR(255) PRIMARY KEY,
+	failures INT NOT NULL,
+	last_failure BIGINT NOT NULL,
+	locked_until BIGINT NOT NULL
+);
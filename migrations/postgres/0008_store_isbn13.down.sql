@@ -0,0 +1,5 @@
+ALTER TABLE books DROP CONSTRAINT books_isbn_unique;
+
+ALTER TABLE books ALTER COLUMN isbn TYPE BIGINT USING COALESCE(CAST(isbn AS BIGINT), 0);
+
+ALTER TABLE books ALTER COLUMN isbn SET NOT NULL;
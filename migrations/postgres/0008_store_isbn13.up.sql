@@ -0,0 +1,13 @@
+-- Numbers with a wrong check digit aren't ISBNs, so they become NULL
+-- rather than being turned into made-up ISBN-13s
+ALTER TABLE books ALTER COLUMN isbn DROP NOT NULL;
+
+ALTER TABLE books ALTER COLUMN isbn TYPE VARCHAR(13) USING CASE
+		WHEN isbn BETWEEN 9780000000000 AND 9799999999999 AND ((isbn / 1000000000000 % 10) + 3 * (isbn / 100000000000 % 10) + (isbn / 10000000000 % 10) + 3 * (isbn / 1000000000 % 10) + (isbn / 100000000 % 10) + 3 * (isbn / 10000000 % 10) + (isbn / 1000000 % 10) + 3 * (isbn / 100000 % 10) + (isbn / 10000 % 10) + 3 * (isbn / 1000 % 10) + (isbn / 100 % 10) + 3 * (isbn / 10 % 10) + (isbn % 10)) % 10 = 0 THEN CAST(isbn AS VARCHAR)
+		WHEN isbn BETWEEN 1 AND 9999999999 AND (10 * (isbn / 1000000000 % 10) + 9 * (isbn / 100000000 % 10) + 8 * (isbn / 10000000 % 10) + 7 * (isbn / 1000000 % 10) + 6 * (isbn / 100000 % 10) + 5 * (isbn / 10000 % 10) + 4 * (isbn / 1000 % 10) + 3 * (isbn / 100 % 10) + 2 * (isbn / 10 % 10) + (isbn % 10)) % 11 = 0 THEN '978' || lpad(CAST(isbn / 10 AS VARCHAR), 9, '0') || CAST((10 - (38 + 3 * (isbn / 1000000000 % 10) + (isbn / 100000000 % 10) + 3 * (isbn / 10000000 % 10) + (isbn / 1000000 % 10) + 3 * (isbn / 100000 % 10) + (isbn / 10000 % 10) + 3 * (isbn / 1000 % 10) + (isbn / 100 % 10) + 3 * (isbn / 10 % 10)) % 10) % 10 AS VARCHAR)
+	END;
+
+UPDATE books SET isbn = NULL
+WHERE id NOT IN (SELECT MIN(id) FROM books WHERE isbn IS NOT NULL GROUP BY isbn);
+
+ALTER TABLE books ADD CONSTRAINT books_isbn_unique UNIQUE (isbn);
@@ -0,0 +1,10 @@
+ALTER TABLE books ADD COLUMN language VARCHAR(2) NOT NULL DEFAULT '';
+
+ALTER TABLE books ADD COLUMN genre VARCHAR(64) NOT NULL DEFAULT '';
+
+-- Facet counts group books by these columns and filters select by them
+CREATE INDEX books_language ON books (language);
+
+CREATE INDEX books_genre ON books (genre);
+
+CREATE INDEX books_published_year ON books (published_year);
@@ -0,0 +1,21 @@
+-- Tables created by hand before migrations existed are adopted as they
+-- are, so that existing databases can be migrated
+CREATE TABLE IF NOT EXISTS books (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	title TEXT NOT NULL,
+	published_year TEXT NOT NULL,
+	isbn INTEGER NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS authors (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	name TEXT NOT NULL,
+	country TEXT NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS author_books (
+	author_book_id INTEGER PRIMARY KEY AUTOINCREMENT,
+	author_id INTEGER NOT NULL REFERENCES authors (id) ON DELETE CASCADE,
+	book_id INTEGER NOT NULL REFERENCES books (id) ON DELETE CASCADE,
+	CONSTRAINT author_books_unique UNIQUE (author_id, book_id)
+);
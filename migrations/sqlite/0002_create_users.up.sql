@@ -0,0 +1,7 @@
+CREATE TABLE IF NOT EXISTS users (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	username TEXT NOT NULL,
+	password_hash TEXT NOT NULL,
+	disabled BOOLEAN NOT NULL DEFAULT 0,
+	CONSTRAINT users_username_unique UNIQUE (username)
+);
@@ -0,0 +1,14 @@
+CREATE TABLE refresh_tokens (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	user_id INTEGER NOT NULL,
+	token_hash TEXT NOT NULL,
+	expires_at BIGINT NOT NULL,
+	revoked BOOLEAN NOT NULL DEFAULT 0,
+	CONSTRAINT refresh_tokens_user_fk FOREIGN KEY (user_id) REFERENCES users (id) ON DELETE CASCADE,
+	CONSTRAINT refresh_tokens_hash_unique UNIQUE (token_hash)
+);
+
+CREATE TABLE revoked_tokens (
+	jti TEXT PRIMARY KEY,
+	expires_at BIGINT NOT NULL
+);
@@ -0,0 +1,12 @@
+CREATE TABLE api_keys (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	name TEXT NOT NULL,
+	key_prefix TEXT NOT NULL,
+	key_hash TEXT NOT NULL,
+	scopes TEXT NOT NULL,
+	created_by TEXT NOT NULL,
+	created_at BIGINT NOT NULL,
+	last_used_at BIGINT NULL,
+	revoked BOOLEAN NOT NULL DEFAULT 0,
+	CONSTRAINT api_keys_hash_unique UNIQUE (key_hash)
+);
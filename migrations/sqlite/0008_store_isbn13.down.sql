@@ -0,0 +1,9 @@
+DROP INDEX books_isbn_unique;
+
+ALTER TABLE books ADD COLUMN isbn_number INTEGER NOT NULL DEFAULT 0;
+
+UPDATE books SET isbn_number = COALESCE(CAST(isbn AS INTEGER), 0);
+
+ALTER TABLE books DROP COLUMN isbn;
+
+ALTER TABLE books RENAME COLUMN isbn_number TO isbn;
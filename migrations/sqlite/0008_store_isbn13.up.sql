@@ -0,0 +1,17 @@
+-- Numbers with a wrong check digit aren't ISBNs, so they become NULL
+-- rather than being turned into made-up ISBN-13s
+ALTER TABLE books ADD COLUMN isbn13 TEXT NULL;
+
+UPDATE books SET isbn13 = CASE
+		WHEN isbn BETWEEN 9780000000000 AND 9799999999999 AND ((isbn / 1000000000000 % 10) + 3 * (isbn / 100000000000 % 10) + (isbn / 10000000000 % 10) + 3 * (isbn / 1000000000 % 10) + (isbn / 100000000 % 10) + 3 * (isbn / 10000000 % 10) + (isbn / 1000000 % 10) + 3 * (isbn / 100000 % 10) + (isbn / 10000 % 10) + 3 * (isbn / 1000 % 10) + (isbn / 100 % 10) + 3 * (isbn / 10 % 10) + (isbn % 10)) % 10 = 0 THEN CAST(isbn AS TEXT)
+		WHEN isbn BETWEEN 1 AND 9999999999 AND (10 * (isbn / 1000000000 % 10) + 9 * (isbn / 100000000 % 10) + 8 * (isbn / 10000000 % 10) + 7 * (isbn / 1000000 % 10) + 6 * (isbn / 100000 % 10) + 5 * (isbn / 10000 % 10) + 4 * (isbn / 1000 % 10) + 3 * (isbn / 100 % 10) + 2 * (isbn / 10 % 10) + (isbn % 10)) % 11 = 0 THEN '978' || printf('%09d', isbn / 10) || ((10 - (38 + 3 * (isbn / 1000000000 % 10) + (isbn / 100000000 % 10) + 3 * (isbn / 10000000 % 10) + (isbn / 1000000 % 10) + 3 * (isbn / 100000 % 10) + (isbn / 10000 % 10) + 3 * (isbn / 1000 % 10) + (isbn / 100 % 10) + 3 * (isbn / 10 % 10)) % 10) % 10)
+	END;
+
+ALTER TABLE books DROP COLUMN isbn;
+
+ALTER TABLE books RENAME COLUMN isbn13 TO isbn;
+
+UPDATE books SET isbn = NULL
+WHERE id NOT IN (SELECT MIN(id) FROM books WHERE isbn IS NOT NULL GROUP BY isbn);
+
+CREATE UNIQUE INDEX books_isbn_unique ON books (isbn);
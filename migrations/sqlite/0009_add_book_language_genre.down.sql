@@ -0,0 +1,9 @@
+DROP INDEX books_published_year;
+
+DROP INDEX books_genre;
+
+DROP INDEX books_language;
+
+ALTER TABLE books DROP COLUMN genre;
+
+ALTER TABLE books DROP COLUMN language;
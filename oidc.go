@@ -0,0 +1,496 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt"
+)
+
+// OIDCConfig configures login through an external OpenID Connect provider.
+// It is enabled by setting Issuer.
+type OIDCConfig struct {
+	// Issuer is the provider's issuer URL. Its endpoints are discovered from
+	// Issuer + "/.well-known/openid-configuration".
+	Issuer       string `yaml:"issuer"`
+	ClientID     string `yaml:"client_id"`
+	ClientSecret string `yaml:"client_secret"`
+	// RedirectURL is where the provider sends the user back to, the public
+	// URL of /login/oidc/callback.
+	RedirectURL string   `yaml:"redirect_url"`
+	Scopes      []string `yaml:"scopes"`
+	// UsernameClaim and GroupsClaim name the ID token claims holding the
+	// username and the user's groups.
+	UsernameClaim string `yaml:"username_claim"`
+	GroupsClaim   string `yaml:"groups_claim"`
+	// RoleMappings give the role of users in a group; the first mapping
+	// matching one of the user's groups wins. Users matching none get
+	// DefaultRole, or are refused if it is empty.
+	RoleMappings []OIDCRoleMapping `yaml:"role_mappings"`
+	DefaultRole  string            `yaml:"default_role"`
+}
+
+// OIDCRoleMapping gives members of Group the role Role.
+type OIDCRoleMapping struct {
+	Group string `yaml:"group"`
+	Role  string `yaml:"role"`
+}
+
+// Identity links a user to an account at an identity provider, which the
+// provider identifies by its subject. Unlike usernames, subjects are unique
+// at the provider and never reassigned.
+type Identity struct {
+	UserID  int
+	Issuer  string
+	Subject string
+}
+
+// validate checks the OIDC settings against the configured roles.
+func (c OIDCConfig) validate(roles Roles) []string {
+	if c.Issuer == "" {
+		return nil
+	}
+
+	var problems []string
+	if u, err := url.Parse(c.Issuer); err != nil || u.Scheme == "" || u.Host == "" {
+		problems = append(problems, "oidc.issuer must be an absolute URL")
+	}
+	if c.ClientID == "" {
+		problems = append(problems, "oidc.client_id must not be empty")
+	}
+	if c.RedirectURL == "" {
+		problems = append(problems, "oidc.redirect_url must not be empty")
+	}
+	if c.UsernameClaim == "" {
+		problems = append(problems, "oidc.username_claim must not be empty")
+	}
+	for _, mapping := range c.RoleMappings {
+		if _, ok := roles[mapping.Role]; !ok {
+			problems = append(problems, fmt.Sprintf("oidc.role_mappings: unknown role %q", mapping.Role))
+		}
+	}
+	if _, ok := roles[c.DefaultRole]; c.DefaultRole != "" && !ok {
+		problems = append(problems, fmt.Sprintf("oidc.default_role: unknown role %q", c.DefaultRole))
+	}
+	return problems
+}
+
+// oidcCookieName is the cookie holding the state, nonce and PKCE verifier
+// of a login in progress
+const oidcCookieName = "bookapi_oidc"
+
+// oidcLoginTimeout is how long a user has to finish logging in at the
+// provider
+const oidcLoginTimeout = 10 * time.Minute
+
+// oidcKeyRefreshInterval limits how often the provider's keys are fetched
+// again when a token names an unknown key
+const oidcKeyRefreshInterval = time.Minute
+
+// errOIDCRejected is returned when the provider refuses an authorization
+// code, as opposed to being unreachable
+var errOIDCRejected = errors.New("oidc: authorization code rejected")
+
+// oidcDiscovery is the part of the provider metadata BookAPI uses
+type oidcDiscovery struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+// oidcProvider talks to the identity provider. The metadata and keys are
+// fetched on first use and cached, so the server starts even while the
+// provider is down.
+type oidcProvider struct {
+	cfg    OIDCConfig
+	client *http.Client
+
+	mu          sync.Mutex
+	discovery   *oidcDiscovery
+	keys        map[string]interface{}
+	keysFetched time.Time
+}
+
+func newOIDCProvider(cfg OIDCConfig) *oidcProvider {
+	return &oidcProvider{
+		cfg:    cfg,
+		client: &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+// getJSON fetches url and decodes the JSON response into v
+func (p *oidcProvider) getJSON(ctx context.Context, url string, v interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("oidc: GET %s: %s", url, resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// discover returns the provider metadata
+func (p *oidcProvider) discover(ctx context.Context) (*oidcDiscovery, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.discovery != nil {
+		return p.discovery, nil
+	}
+
+	var doc oidcDiscovery
+	err := p.getJSON(ctx, strings.TrimSuffix(p.cfg.Issuer, "/")+"/.well-known/openid-configuration", &doc)
+	if err != nil {
+		return nil, err
+	}
+	if doc.Issuer != p.cfg.Issuer {
+		return nil, fmt.Errorf("oidc: provider reports issuer %q, expected %q", doc.Issuer, p.cfg.Issuer)
+	}
+	if doc.AuthorizationEndpoint == "" || doc.TokenEndpoint == "" || doc.JWKSURI == "" {
+		return nil, errors.New("oidc: provider metadata is missing endpoints")
+	}
+
+	p.discovery = &doc
+	return p.discovery, nil
+}
+
+// key returns the provider's signing key kid, fetching the key set again
+// when kid is unknown, for example after the provider rotated its keys
+func (p *oidcProvider) key(ctx context.Context, kid string) (interface{}, error) {
+	doc, err := p.discover(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if key, ok := p.keys[kid]; ok {
+		return key, nil
+	}
+	if time.Since(p.keysFetched) < oidcKeyRefreshInterval {
+		return nil, fmt.Errorf("oidc: unknown key id %q", kid)
+	}
+
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := p.getJSON(ctx, doc.JWKSURI, &set); err != nil {
+		return nil, err
+	}
+
+	keys := make(map[string]interface{})
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		// Keys of types BookAPI can't verify with are skipped
+		if key, err := k.publicKey(); err == nil {
+			keys[k.Kid] = key
+		}
+	}
+	p.keys, p.keysFetched = keys, time.Now()
+
+	key, ok := p.keys[kid]
+	if !ok {
+		return nil, fmt.Errorf("oidc: unknown key id %q", kid)
+	}
+	return key, nil
+}
+
+// authCodeURL returns the provider URL the user is sent to for logging in
+func (p *oidcProvider) authCodeURL(ctx context.Context, state, nonce, verifier string) (string, error) {
+	doc, err := p.discover(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	challenge := sha256.Sum256([]byte(verifier))
+	query := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {p.cfg.ClientID},
+		"redirect_uri":          {p.cfg.RedirectURL},
+		"scope":                 {strings.Join(p.cfg.Scopes, " ")},
+		"state":                 {state},
+		"nonce":                 {nonce},
+		"code_challenge":        {base64.RawURLEncoding.EncodeToString(challenge[:])},
+		"code_challenge_method": {"S256"},
+	}
+
+	separator := "?"
+	if strings.Contains(doc.AuthorizationEndpoint, "?") {
+		separator = "&"
+	}
+	return doc.AuthorizationEndpoint + separator + query.Encode(), nil
+}
+
+// exchange redeems an authorization code and returns the raw ID token
+func (p *oidcProvider) exchange(ctx context.Context, code, verifier string) (string, error) {
+	doc, err := p.discover(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {p.cfg.RedirectURL},
+		"code_verifier": {verifier},
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", doc.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth(url.QueryEscape(p.cfg.ClientID), url.QueryEscape(p.cfg.ClientSecret))
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 400 && resp.StatusCode < 500 {
+		io.Copy(io.Discard, resp.Body)
+		return "", errOIDCRejected
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("oidc: token endpoint: %s", resp.Status)
+	}
+
+	var body struct {
+		IDToken string `json:"id_token"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return "", err
+	}
+	if body.IDToken == "" {
+		return "", errors.New("oidc: token response has no id_token")
+	}
+	return body.IDToken, nil
+}
+
+// verify checks the signature, issuer, audience, expiry and nonce of an ID
+// token and returns its claims
+func (p *oidcProvider) verify(ctx context.Context, rawIDToken, nonce string) (jwt.MapClaims, error) {
+	claims := jwt.MapClaims{}
+	_, err := jwt.ParseWithClaims(rawIDToken, claims, func(token *jwt.Token) (interface{}, error) {
+		kid, _ := token.Header["kid"].(string)
+		key, err := p.key(ctx, kid)
+		if err != nil {
+			return nil, err
+		}
+
+		// Only accept the algorithm family matching the key, never HMAC
+		// or none
+		switch key.(type) {
+		case *rsa.PublicKey:
+			if _, ok := token.Method.(*jwt.SigningMethodRSA); !ok {
+				return nil, fmt.Errorf("oidc: unexpected signing algorithm %v", token.Header["alg"])
+			}
+		case *ecdsa.PublicKey:
+			if _, ok := token.Method.(*jwt.SigningMethodECDSA); !ok {
+				return nil, fmt.Errorf("oidc: unexpected signing algorithm %v", token.Header["alg"])
+			}
+		}
+		return key, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if !claims.VerifyIssuer(p.cfg.Issuer, true) {
+		return nil, errors.New("oidc: wrong issuer")
+	}
+	if !claims.VerifyAudience(p.cfg.ClientID, true) {
+		return nil, errors.New("oidc: wrong audience")
+	}
+	if !claims.VerifyExpiresAt(jwt.TimeFunc().Unix(), true) {
+		return nil, errors.New("oidc: token has no expiry")
+	}
+	if got, _ := claims["nonce"].(string); subtle.ConstantTimeCompare([]byte(got), []byte(nonce)) != 1 {
+		return nil, errors.New("oidc: wrong nonce")
+	}
+	return claims, nil
+}
+
+// role returns the BookAPI role for the groups in claims, or "" if the user
+// may not log in
+func (p *oidcProvider) role(claims jwt.MapClaims) string {
+	var groups []string
+	switch v := claims[p.cfg.GroupsClaim].(type) {
+	case string:
+		groups = []string{v}
+	case []interface{}:
+		for _, group := range v {
+			if group, ok := group.(string); ok {
+				groups = append(groups, group)
+			}
+		}
+	}
+
+	for _, mapping := range p.cfg.RoleMappings {
+		if contains(groups, mapping.Group) {
+			return mapping.Role
+		}
+	}
+	return p.cfg.DefaultRole
+}
+
+// oidcLogin sends the user to the provider to log in
+func (s *server) oidcLogin(w http.ResponseWriter, r *http.Request) {
+	var values [3]string
+	for i := range values {
+		value, err := randomToken(32)
+		if err != nil {
+			internalError(w, r, err)
+			return
+		}
+		values[i] = value
+	}
+	state, nonce, verifier := values[0], values[1], values[2]
+
+	target, err := s.oidc.authCodeURL(r.Context(), state, nonce, verifier)
+	if err != nil {
+		upstreamError(w, r, err)
+		return
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     oidcCookieName,
+		Value:    state + "." + nonce + "." + verifier,
+		Path:     "/login/oidc",
+		MaxAge:   int(oidcLoginTimeout / time.Second),
+		HttpOnly: true,
+		Secure:   strings.HasPrefix(s.oidc.cfg.RedirectURL, "https://"),
+		SameSite: http.SameSiteLaxMode,
+	})
+	http.Redirect(w, r, target, http.StatusFound)
+}
+
+// oidcCallback finishes a login at the provider. The user's account is
+// created on first login and found by the provider's subject afterwards,
+// and its role follows the provider's groups.
+func (s *server) oidcCallback(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	if query.Get("error") != "" {
+		writeProblem(w, r, http.StatusUnauthorized, problemUnauthorized, "The identity provider returned "+query.Get("error"))
+		return
+	}
+
+	// The state ties the callback to the browser that started the login
+	cookie, err := r.Cookie(oidcCookieName)
+	if err != nil {
+		writeProblem(w, r, http.StatusBadRequest, problemBadRequest, "The login was not started from this browser")
+		return
+	}
+	http.SetCookie(w, &http.Cookie{Name: oidcCookieName, Path: "/login/oidc", MaxAge: -1})
+
+	parts := strings.Split(cookie.Value, ".")
+	if len(parts) != 3 || query.Get("code") == "" ||
+		subtle.ConstantTimeCompare([]byte(parts[0]), []byte(query.Get("state"))) != 1 {
+		writeProblem(w, r, http.StatusBadRequest, problemBadRequest, "The callback state does not match the login")
+		return
+	}
+	nonce, verifier := parts[1], parts[2]
+
+	ctx := r.Context()
+	rawIDToken, err := s.oidc.exchange(ctx, query.Get("code"), verifier)
+	if errors.Is(err, errOIDCRejected) {
+		writeProblem(w, r, http.StatusUnauthorized, problemUnauthorized, "The identity provider rejected the authorization code")
+		return
+	}
+	if err != nil {
+		upstreamError(w, r, err)
+		return
+	}
+
+	claims, err := s.oidc.verify(ctx, rawIDToken, nonce)
+	if err != nil {
+		writeProblem(w, r, http.StatusUnauthorized, problemUnauthorized, "The ID token is invalid")
+		return
+	}
+
+	subject, _ := claims["sub"].(string)
+	if subject == "" {
+		writeProblem(w, r, http.StatusUnauthorized, problemUnauthorized, "The ID token has no sub claim")
+		return
+	}
+	username, _ := claims[s.oidc.cfg.UsernameClaim].(string)
+	if username == "" {
+		writeProblem(w, r, http.StatusUnauthorized, problemUnauthorized, "The ID token has no "+s.oidc.cfg.UsernameClaim+" claim")
+		return
+	}
+	role := s.oidc.role(claims)
+	if role == "" {
+		writeProblem(w, r, http.StatusForbidden, problemForbidden, "No role is mapped to this account's groups")
+		return
+	}
+
+	identity := Identity{Issuer: s.oidc.cfg.Issuer, Subject: subject}
+	user, err := s.store.GetUserByIdentity(ctx, identity.Issuer, identity.Subject)
+	if errors.Is(err, ErrNotFound) {
+		user, err = s.linkOIDCUser(ctx, identity, username, role)
+	}
+	switch {
+	case errors.Is(err, ErrConflict):
+		writeProblem(w, r, http.StatusConflict, problemConflict, "The account "+username+" already exists and can't log in through the identity provider")
+		return
+	case err == nil && user.Disabled:
+		writeProblem(w, r, http.StatusUnauthorized, problemUnauthorized, "The account is disabled")
+		return
+	case err == nil && user.Role != role:
+		user.Role = role
+		err = s.store.UpdateUser(ctx, &user)
+	}
+	if err != nil {
+		internalError(w, r, err)
+		return
+	}
+
+	s.issueTokens(w, r, user)
+}
+
+// linkOIDCUser links identity to the account named username, which is
+// created if it doesn't exist. Accounts with a password or linked to
+// another provider account are never taken over; linking to them returns
+// ErrConflict.
+func (s *server) linkOIDCUser(ctx context.Context, identity Identity, username, role string) (User, error) {
+	user, err := s.store.GetUserByUsername(ctx, username)
+	switch {
+	case errors.Is(err, ErrNotFound):
+		// Accounts from the provider have no password, so they can't use
+		// the local login
+		user = User{Username: username, Role: role}
+		err = s.store.CreateUser(ctx, &user)
+	case err == nil && user.PasswordHash != "":
+		err = ErrConflict
+	}
+	if err != nil {
+		return user, err
+	}
+
+	identity.UserID = user.ID
+	return user, s.store.LinkIdentity(ctx, identity)
+}
@@ -0,0 +1,293 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt"
+)
+
+// mockOIDCProvider is a minimal OpenID Connect provider. Every code it
+// hands out is answered with an ID token carrying claims and the nonce of
+// the authorization request.
+type mockOIDCProvider struct {
+	*httptest.Server
+	key    *rsa.PrivateKey
+	claims jwt.MapClaims
+
+	nonce     string
+	challenge string
+}
+
+func newMockOIDCProvider(t *testing.T) *mockOIDCProvider {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &mockOIDCProvider{key: key}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{
+			"issuer":                 p.URL,
+			"authorization_endpoint": p.URL + "/authorize",
+			"token_endpoint":         p.URL + "/token",
+			"jwks_uri":               p.URL + "/keys",
+		})
+	})
+	mux.HandleFunc("/keys", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string][]jwk{"keys": {{
+			Kty: "RSA",
+			Kid: "mock",
+			Use: "sig",
+			Alg: "RS256",
+			N:   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+			E:   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		}}})
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		clientID, secret, _ := r.BasicAuth()
+		verifier := sha256.Sum256([]byte(r.PostFormValue("code_verifier")))
+		if clientID != "bookapi" || secret != "client-secret" || r.PostFormValue("code") != "good-code" ||
+			base64.RawURLEncoding.EncodeToString(verifier[:]) != p.challenge {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": "invalid_grant"})
+			return
+		}
+
+		claims := jwt.MapClaims{
+			"iss":   p.URL,
+			"aud":   "bookapi",
+			"exp":   time.Now().Add(time.Minute).Unix(),
+			"nonce": p.nonce,
+		}
+		for name, value := range p.claims {
+			claims[name] = value
+		}
+		token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+		token.Header["kid"] = "mock"
+		idToken, err := token.SignedString(key)
+		if err != nil {
+			t.Error(err)
+		}
+		json.NewEncoder(w).Encode(map[string]string{"access_token": "opaque", "id_token": idToken})
+	})
+	p.Server = httptest.NewServer(mux)
+	t.Cleanup(p.Close)
+	return p
+}
+
+// newOIDCTestServer returns a test server logging in through provider
+func newOIDCTestServer(t *testing.T, provider *mockOIDCProvider) *server {
+	cfg := testConfig
+	cfg.OIDC = OIDCConfig{
+		Issuer:        provider.URL,
+		ClientID:      "bookapi",
+		ClientSecret:  "client-secret",
+		RedirectURL:   "http://bookapi.test/login/oidc/callback",
+		Scopes:        []string{"openid", "groups"},
+		UsernameClaim: "preferred_username",
+		GroupsClaim:   "groups",
+		RoleMappings: []OIDCRoleMapping{
+			{Group: "library-admins", Role: roleAdmin},
+			{Group: "library-staff", Role: roleLibrarian},
+		},
+	}
+	return newTestServerWith(t, cfg)
+}
+
+// startOIDCLogin starts a login and returns the state cookie and the state
+// the provider would send back
+func startOIDCLogin(t *testing.T, router http.Handler, provider *mockOIDCProvider) (*http.Cookie, string) {
+	req, err := http.NewRequest("GET", "/login/oidc", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	if rr.Code != http.StatusFound {
+		t.Fatalf("GET /login/oidc returned %d, expected %d", rr.Code, http.StatusFound)
+	}
+
+	location, err := url.Parse(rr.Header().Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	query := location.Query()
+	if location.Path != "/authorize" || query.Get("client_id") != "bookapi" || query.Get("code_challenge_method") != "S256" || query.Get("scope") != "openid groups" {
+		t.Errorf("unexpected authorization URL %s", location)
+	}
+	provider.nonce = query.Get("nonce")
+	provider.challenge = query.Get("code_challenge")
+
+	cookies := rr.Result().Cookies()
+	if len(cookies) != 1 || !cookies[0].HttpOnly {
+		t.Fatalf("expected one HttpOnly state cookie, got %v", cookies)
+	}
+	return cookies[0], query.Get("state")
+}
+
+// finishOIDCLogin calls the callback as the provider's redirect would
+func finishOIDCLogin(t *testing.T, router http.Handler, cookie *http.Cookie, state, code string) *httptest.ResponseRecorder {
+	req, err := http.NewRequest("GET", "/login/oidc/callback?"+url.Values{"state": {state}, "code": {code}}.Encode(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.AddCookie(cookie)
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	return rr
+}
+
+func TestOIDCLogin(t *testing.T) {
+	provider := newMockOIDCProvider(t)
+	router := newOIDCTestServer(t, provider)
+	provider.claims = jwt.MapClaims{"sub": "1001", "preferred_username": "sso.user", "groups": []string{"everyone", "library-staff"}}
+
+	cookie, state := startOIDCLogin(t, router, provider)
+	rr := finishOIDCLogin(t, router, cookie, state, "good-code")
+	if rr.Code != http.StatusOK {
+		t.Fatalf("callback returned %d, expected %d", rr.Code, http.StatusOK)
+	}
+
+	var tokens map[string]string
+	if err := json.Unmarshal(rr.Body.Bytes(), &tokens); err != nil {
+		t.Fatal(err)
+	}
+	claims := &Claims{}
+	if _, err := jwt.ParseWithClaims(tokens["token"], claims, router.keys.keyFunc); err != nil {
+		t.Fatal(err)
+	}
+	if claims.Username != "sso.user" || claims.Role != roleLibrarian {
+		t.Errorf("expected a librarian token for sso.user, got %s/%s", claims.Username, claims.Role)
+	}
+
+	// The account is provisioned without a local password
+	if code := loginStatus(t, router, "sso.user", ""); code != http.StatusUnauthorized {
+		t.Errorf("local login of the SSO account returned %d, expected %d", code, http.StatusUnauthorized)
+	}
+
+	// Group changes at the provider apply at the next login
+	provider.claims["groups"] = "library-admins"
+	cookie, state = startOIDCLogin(t, router, provider)
+	rr = finishOIDCLogin(t, router, cookie, state, "good-code")
+	user, err := router.store.GetUserByUsername(t.Context(), "sso.user")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rr.Code != http.StatusOK || user.Role != roleAdmin {
+		t.Errorf("expected the second login to make sso.user an admin, got %d and role %q", rr.Code, user.Role)
+	}
+
+	// The account is found by subject, so renames at the provider keep it
+	provider.claims["preferred_username"] = "renamed.user"
+	cookie, state = startOIDCLogin(t, router, provider)
+	if rr = finishOIDCLogin(t, router, cookie, state, "good-code"); rr.Code != http.StatusOK {
+		t.Errorf("login after a rename returned %d, expected %d", rr.Code, http.StatusOK)
+	}
+	if _, err := router.store.GetUserByUsername(t.Context(), "renamed.user"); err != ErrNotFound {
+		t.Errorf("expected no account for the new name, got %v", err)
+	}
+
+	// Local accounts keep working next to SSO
+	if code := loginStatus(t, router, "admin", "password"); code != http.StatusOK {
+		t.Errorf("local login returned %d, expected %d", code, http.StatusOK)
+	}
+}
+
+func TestOIDCLoginCannotTakeOverAccounts(t *testing.T) {
+	provider := newMockOIDCProvider(t)
+	router := newOIDCTestServer(t, provider)
+
+	// A provider user named like the local admin doesn't get its account
+	provider.claims = jwt.MapClaims{"sub": "1001", "preferred_username": "admin", "groups": []string{"library-staff"}}
+	cookie, state := startOIDCLogin(t, router, provider)
+	rr := finishOIDCLogin(t, router, cookie, state, "good-code")
+	decodeProblem(t, rr, http.StatusConflict, problemConflict)
+
+	admin, err := router.store.GetUserByUsername(t.Context(), "admin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if admin.Role != roleAdmin {
+		t.Errorf("expected the local admin to stay an admin, got role %q", admin.Role)
+	}
+	if code := loginStatus(t, router, "admin", "password"); code != http.StatusOK {
+		t.Errorf("local login returned %d, expected %d", code, http.StatusOK)
+	}
+
+	// Nor does a second provider user with the name of a provisioned one
+	provider.claims = jwt.MapClaims{"sub": "1002", "preferred_username": "sso.user", "groups": []string{"library-staff"}}
+	cookie, state = startOIDCLogin(t, router, provider)
+	if rr := finishOIDCLogin(t, router, cookie, state, "good-code"); rr.Code != http.StatusOK {
+		t.Fatalf("first login returned %d, expected %d", rr.Code, http.StatusOK)
+	}
+	provider.claims = jwt.MapClaims{"sub": "1003", "preferred_username": "sso.user", "groups": []string{"library-admins"}}
+	cookie, state = startOIDCLogin(t, router, provider)
+	decodeProblem(t, finishOIDCLogin(t, router, cookie, state, "good-code"), http.StatusConflict, problemConflict)
+
+	user, err := router.store.GetUserByUsername(t.Context(), "sso.user")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user.Role != roleLibrarian {
+		t.Errorf("expected sso.user to stay a librarian, got role %q", user.Role)
+	}
+}
+
+func TestOIDCLoginFailures(t *testing.T) {
+	provider := newMockOIDCProvider(t)
+	router := newOIDCTestServer(t, provider)
+	provider.claims = jwt.MapClaims{"sub": "1001", "preferred_username": "sso.user", "groups": []string{"library-staff"}}
+
+	cookie, state := startOIDCLogin(t, router, provider)
+	if rr := finishOIDCLogin(t, router, cookie, "forged-state", "good-code"); rr.Code != http.StatusBadRequest {
+		t.Errorf("wrong state: got %d, expected %d", rr.Code, http.StatusBadRequest)
+	}
+	if rr := finishOIDCLogin(t, router, cookie, state, "bad-code"); rr.Code != http.StatusUnauthorized {
+		t.Errorf("rejected code: got %d, expected %d", rr.Code, http.StatusUnauthorized)
+	}
+
+	// An ID token issued for another login attempt is refused
+	cookie, state = startOIDCLogin(t, router, provider)
+	provider.nonce = "replayed"
+	if rr := finishOIDCLogin(t, router, cookie, state, "good-code"); rr.Code != http.StatusUnauthorized {
+		t.Errorf("wrong nonce: got %d, expected %d", rr.Code, http.StatusUnauthorized)
+	}
+
+	delete(provider.claims, "sub")
+	cookie, state = startOIDCLogin(t, router, provider)
+	if rr := finishOIDCLogin(t, router, cookie, state, "good-code"); rr.Code != http.StatusUnauthorized {
+		t.Errorf("no subject: got %d, expected %d", rr.Code, http.StatusUnauthorized)
+	}
+
+	provider.claims["sub"] = "1001"
+	provider.claims["groups"] = []string{"visitors"}
+	cookie, state = startOIDCLogin(t, router, provider)
+	if rr := finishOIDCLogin(t, router, cookie, state, "good-code"); rr.Code != http.StatusForbidden {
+		t.Errorf("unmapped group: got %d, expected %d", rr.Code, http.StatusForbidden)
+	}
+}
+
+func TestOIDCRoutesDisabled(t *testing.T) {
+	router := newTestServer(t)
+
+	req, err := http.NewRequest("GET", "/login/oidc", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	if rr.Code == http.StatusFound {
+		t.Error("expected no OIDC login without an issuer")
+	}
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// defaultPageSize is the number of items a page has when the request
+// doesn't set a limit, unless the maximum page size is smaller
+const defaultPageSize = 50
+
+// ListOptions selects a page of a list. The items that pass all Filters
+// are ordered by the Sort keys and then by ID. A page starts after the item
+// at position After, ends before the item at position Before or else skips
+// Offset items.
+type ListOptions struct {
+	Limit   int
+	Offset  int
+	Filters []Filter
+	Sort    []SortKey
+	After   *Position
+	Before  *Position
+}
+
+// cursor marks a position in a list. It is passed to clients as an opaque
+// string so that its contents can change. A cursor holds the item's values
+// of the sort keys, so it is only valid with the sort it was made for.
+type cursor struct {
+	ID     int      `json:"id"`
+	Sort   string   `json:"sort,omitempty"`
+	Values []string `json:"values,omitempty"`
+	Before bool     `json:"before,omitempty"`
+}
+
+// newCursor returns a cursor at pos in a list sorted by sort
+func newCursor(pos Position, sort string, before bool) cursor {
+	c := cursor{ID: pos.ID, Sort: sort, Before: before}
+	for _, value := range pos.Values {
+		c.Values = append(c.Values, fmt.Sprint(value))
+	}
+	return c
+}
+
+func (c cursor) encode() string {
+	data, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func decodeCursor(s string) (cursor, error) {
+	var c cursor
+	data, err := base64.RawURLEncoding.DecodeString(s)
+	if err == nil {
+		err = json.Unmarshal(data, &c)
+	}
+	if err != nil || c.ID <= 0 {
+		return c, fmt.Errorf("cursor %q is invalid", s)
+	}
+	return c, nil
+}
+
+// parseListOptions reads the limit, offset, cursor and sort query
+// parameters and the filters. Limits above maxPageSize are lowered to it.
+func parseListOptions[T any](query url.Values, maxPageSize int, fields listFields[T]) (ListOptions, []FieldError) {
+	opts, errs := parsePageRange(query, maxPageSize)
+	filters, filterErrs := parseFilters(query, fields)
+	opts.Filters = filters
+	errs = append(errs, filterErrs...)
+	sort, sortErrs := parseSort(query.Get("sort"), fields)
+	opts.Sort = sort
+	errs = append(errs, sortErrs...)
+
+	if value := query.Get("cursor"); value != "" {
+		c, err := decodeCursor(value)
+		var pos Position
+		if err == nil {
+			pos, err = cursorPosition(c, query.Get("sort"), sort, fields)
+		}
+		switch {
+		case err != nil:
+			errs = append(errs, FieldError{"cursor", err.Error()})
+		case query.Has("offset"):
+			errs = append(errs, FieldError{"cursor", "can't be combined with offset"})
+		case c.Before:
+			opts.Before = &pos
+		default:
+			opts.After = &pos
+		}
+	}
+	return opts, errs
+}
+
+// parsePageRange reads the limit and offset query parameters
+func parsePageRange(query url.Values, maxPageSize int) (ListOptions, []FieldError) {
+	opts := ListOptions{Limit: min(defaultPageSize, maxPageSize)}
+	var errs []FieldError
+
+	if value := query.Get("limit"); value != "" {
+		limit, err := strconv.Atoi(value)
+		if err != nil || limit < 1 {
+			errs = append(errs, FieldError{"limit", "must be a positive number"})
+		}
+		opts.Limit = min(limit, maxPageSize)
+	}
+	if value := query.Get("offset"); value != "" {
+		offset, err := strconv.Atoi(value)
+		if err != nil || offset < 0 {
+			errs = append(errs, FieldError{"offset", "must be a number that isn't negative"})
+		}
+		opts.Offset = offset
+	}
+	return opts, errs
+}
+
+// cursorPosition returns where c points in a list sorted by keys, which
+// were parsed from sort
+func cursorPosition[T any](c cursor, sort string, keys []SortKey, fields listFields[T]) (Position, error) {
+	if c.Sort != sort || len(c.Values) != len(keys) {
+		return Position{}, errors.New("was made for another sort")
+	}
+	pos := Position{ID: c.ID}
+	for i, key := range keys {
+		value, err := fields[key.Field].cursorValue(c.Values[i])
+		if err != nil {
+			return Position{}, fmt.Errorf("has an invalid %s", key.Field)
+		}
+		pos.Values = append(pos.Values, value)
+	}
+	return pos, nil
+}
+
+// servePage answers with the page of a list selected, filtered and sorted
+// by the query parameters. The number of items that pass the filters is
+// sent in X-Total-Count and the neighbouring pages in a Link header. Pages
+// are linked by cursor, unless the client asked for an offset. Lists with
+// a count function can send the facet counts of the filtered items along
+// with the page.
+func servePage[T any](w http.ResponseWriter, r *http.Request, maxPageSize int, fields listFields[T], list func(context.Context, ListOptions) ([]T, int, error), count facetCounter) {
+	query := r.URL.Query()
+	opts, errs := parseListOptions(query, maxPageSize, fields)
+	var facetNames []string
+	if query.Has("facets") {
+		if count == nil {
+			errs = append(errs, FieldError{"facets", "can't be counted for this list"})
+		} else {
+			var facetErrs []FieldError
+			facetNames, facetErrs = parseFacets(query.Get("facets"))
+			errs = append(errs, facetErrs...)
+		}
+	}
+	if len(errs) > 0 {
+		invalidParameters(w, r, errs...)
+		return
+	}
+
+	// One more item than the page holds tells whether there is another page
+	limit := opts.Limit
+	opts.Limit++
+	items, total, err := list(r.Context(), opts)
+	if err != nil {
+		internalError(w, r, err)
+		return
+	}
+	var facets Facets
+	if facetNames != nil {
+		if facets, err = count(r.Context(), facetNames, opts.Filters); err != nil {
+			internalError(w, r, err)
+			return
+		}
+	}
+	more := len(items) > limit
+	if more && opts.Before != nil {
+		items = items[1:]
+	} else if more {
+		items = items[:limit]
+	}
+
+	var links []string
+	link := func(rel string, set map[string]string) {
+		q := url.Values{}
+		for key, values := range query {
+			q[key] = values
+		}
+		q.Del("cursor")
+		q.Del("offset")
+		q.Set("limit", strconv.Itoa(limit))
+		for key, value := range set {
+			q.Set(key, value)
+		}
+		links = append(links, fmt.Sprintf(`<%s?%s>; rel="%s"`, r.URL.Path, q.Encode(), rel))
+	}
+
+	switch {
+	case query.Has("offset"):
+		if opts.Offset+limit < total {
+			link("next", map[string]string{"offset": strconv.Itoa(opts.Offset + limit)})
+		}
+		if opts.Offset > 0 {
+			link("prev", map[string]string{"offset": strconv.Itoa(max(opts.Offset-limit, 0))})
+		}
+	case len(items) > 0:
+		sort := query.Get("sort")
+		first := fields.position(items[0], opts.Sort)
+		last := fields.position(items[len(items)-1], opts.Sort)
+		// A page before a cursor always has that cursor's item after it
+		if more || opts.Before != nil {
+			link("next", map[string]string{"cursor": newCursor(last, sort, false).encode()})
+		}
+		if opts.After != nil || (more && opts.Before != nil) {
+			link("prev", map[string]string{"cursor": newCursor(first, sort, true).encode()})
+		}
+	}
+
+	w.Header().Set("X-Total-Count", strconv.Itoa(total))
+	if len(links) > 0 {
+		w.Header().Set("Link", strings.Join(links, ", "))
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if facets != nil {
+		json.NewEncoder(w).Encode(facetedPage[T]{items, facets})
+		return
+	}
+	json.NewEncoder(w).Encode(items)
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"regexp"
+	"strconv"
+	"testing"
+)
+
+// newPaginationTestServer returns a test server with 25 books in total
+func newPaginationTestServer(t *testing.T) *server {
+	s := newTestServer(t)
+	for i := 3; i <= 25; i++ {
+		if err := s.store.CreateBook(context.Background(), &Book{Title: "Book " + strconv.Itoa(i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return s
+}
+
+var linkPattern = regexp.MustCompile(`<([^>]*)>; rel="(\w+)"`)
+
+// getPage requests url and returns the IDs of the books on the page and
+// its links by relation
+func getPage(t *testing.T, s *server, url string) ([]int, map[string]string) {
+	t.Helper()
+
+	rr := serveJSON(t, s, "GET", url, nil)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("GET %s: got %d, expected %d", url, rr.Code, http.StatusOK)
+	}
+	if total := rr.Header().Get("X-Total-Count"); total != "25" {
+		t.Errorf("GET %s: got X-Total-Count %q, expected 25", url, total)
+	}
+
+	var books []Book
+	if err := json.NewDecoder(rr.Body).Decode(&books); err != nil {
+		t.Fatal(err)
+	}
+	ids := make([]int, len(books))
+	for i, book := range books {
+		ids[i] = book.ID
+	}
+
+	return ids, parseLinks(rr.Header().Get("Link"))
+}
+
+// parseLinks returns the links of a Link header by relation
+func parseLinks(header string) map[string]string {
+	links := make(map[string]string)
+	for _, match := range linkPattern.FindAllStringSubmatch(header, -1) {
+		links[match[2]] = match[1]
+	}
+	return links
+}
+
+func TestCursorPagination(t *testing.T) {
+	s := newPaginationTestServer(t)
+
+	// Walk forward to the end, then back to the start
+	var pages [][]int
+	url := "/books?limit=10"
+	for url != "" {
+		ids, links := getPage(t, s, url)
+		pages = append(pages, ids)
+		url = links["next"]
+		if len(pages) > 5 {
+			t.Fatal("pagination doesn't end")
+		}
+	}
+	if len(pages) != 3 || len(pages[2]) != 5 || pages[0][0] != 1 || pages[2][4] != 25 {
+		t.Fatalf("got pages %v, expected 10, 10 and 5 books", pages)
+	}
+
+	_, links := getPage(t, s, "/books?limit=10")
+	_, links = getPage(t, s, links["next"])
+	_, links = getPage(t, s, links["next"])
+	ids, links := getPage(t, s, links["prev"])
+	if ids[0] != 11 || ids[9] != 20 {
+		t.Errorf("got previous page %v, expected books 11 to 20", ids)
+	}
+	ids, links = getPage(t, s, links["prev"])
+	if ids[0] != 1 || len(ids) != 10 {
+		t.Errorf("got first page %v, expected books 1 to 10", ids)
+	}
+	if _, ok := links["prev"]; ok {
+		t.Errorf("the first page links to a previous page %q", links["prev"])
+	}
+}
+
+func TestOffsetPagination(t *testing.T) {
+	s := newPaginationTestServer(t)
+
+	ids, links := getPage(t, s, "/books?limit=10&offset=20")
+	if len(ids) != 5 || ids[0] != 21 {
+		t.Errorf("got %v, expected books 21 to 25", ids)
+	}
+	if _, ok := links["next"]; ok {
+		t.Errorf("the last page links to a next page %q", links["next"])
+	}
+	if links["prev"] != "/books?limit=10&offset=10" {
+		t.Errorf("got prev link %q, expected /books?limit=10&offset=10", links["prev"])
+	}
+}
+
+func TestPageSizeLimits(t *testing.T) {
+	cfg := testConfig
+	cfg.MaxPageSize = 5
+	s := newTestServerWith(t, cfg)
+	for range 10 {
+		if err := s.store.CreateBook(context.Background(), &Book{Title: "Book"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, url := range []string{"/books", "/books?limit=1000"} {
+		rr := serveJSON(t, s, "GET", url, nil)
+		var books []Book
+		if err := json.NewDecoder(rr.Body).Decode(&books); err != nil {
+			t.Fatal(err)
+		}
+		if len(books) != 5 {
+			t.Errorf("GET %s: got %d books, expected the maximum of 5", url, len(books))
+		}
+	}
+
+	for _, url := range []string{"/books?limit=0", "/books?limit=ten", "/books?offset=-1", "/books?cursor=bogus", "/books?cursor=eyJpZCI6MX0&offset=1"} {
+		decodeProblem(t, serveJSON(t, s, "GET", url, nil), http.StatusBadRequest, problemValidation)
+	}
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"regexp"
+)
+
+// Problem is an RFC 7807 problem details object, the body of every error
+// response.
+type Problem struct {
+	Type     string `json:"type"`
+	Title    string `json:"title"`
+	Status   int    `json:"status"`
+	Detail   string `json:"detail,omitempty"`
+	Instance string `json:"instance,omitempty"`
+	// RequestID matches the X-Request-ID response header and the server log
+	RequestID string `json:"request_id,omitempty"`
+	// Errors lists the invalid fields of a validation problem
+	Errors []FieldError `json:"errors,omitempty"`
+}
+
+// FieldError describes one invalid field of a request body.
+type FieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// problemType is a kind of problem, identified by a URI relative to the API
+type problemType struct {
+	uri   string
+	title string
+}
+
+var (
+	problemMalformedBody    = problemType{"/problems/malformed-body", "Malformed request body"}
+	problemValidation       = problemType{"/problems/validation-error", "Invalid request"}
+	problemBadRequest       = problemType{"/problems/bad-request", "Bad request"}
+	problemUnauthorized     = problemType{"/problems/unauthorized", "Authentication required"}
+	problemForbidden        = problemType{"/problems/forbidden", "Permission denied"}
+	problemNotFound         = problemType{"/problems/not-found", "Resource not found"}
+	problemMethodNotAllowed = problemType{"/problems/method-not-allowed", "Method not allowed"}
+	problemConflict         = problemType{"/problems/conflict", "Conflict"}
+	problemLocked           = problemType{"/problems/locked", "Account locked"}
+	problemRateLimited      = problemType{"/problems/rate-limited", "Too many requests"}
+	problemInternal         = problemType{"/problems/internal-error", "Internal server error"}
+	problemUpstream         = problemType{"/problems/upstream-error", "Identity provider unavailable"}
+)
+
+// writeProblem answers the request with a problem of the given type
+func writeProblem(w http.ResponseWriter, r *http.Request, status int, typ problemType, detail string) {
+	writeProblemBody(w, r, Problem{Type: typ.uri, Title: typ.title, Status: status, Detail: detail})
+}
+
+func writeProblemBody(w http.ResponseWriter, r *http.Request, problem Problem) {
+	problem.Instance = r.URL.Path
+	problem.RequestID = requestIDFromContext(r.Context())
+
+	w.Header().Set("Content-Type", "application/problem+json")
+	w.WriteHeader(problem.Status)
+	json.NewEncoder(w).Encode(problem)
+}
+
+// malformedBody answers a request whose body couldn't be decoded
+func malformedBody(w http.ResponseWriter, r *http.Request, err error) {
+	writeProblem(w, r, http.StatusBadRequest, problemMalformedBody, err.Error())
+}
+
+// invalidFields answers a request whose body has invalid fields
+func invalidFields(w http.ResponseWriter, r *http.Request, errs ...FieldError) {
+	writeProblemBody(w, r, Problem{
+		Type:   problemValidation.uri,
+		Title:  problemValidation.title,
+		Status: http.StatusBadRequest,
+		Detail: "The request body has invalid fields",
+		Errors: errs,
+	})
+}
+
+// invalidParameters answers a request whose query has invalid parameters
+func invalidParameters(w http.ResponseWriter, r *http.Request, errs ...FieldError) {
+	writeProblemBody(w, r, Problem{
+		Type:   problemValidation.uri,
+		Title:  problemValidation.title,
+		Status: http.StatusBadRequest,
+		Detail: "The query has invalid parameters",
+		Errors: errs,
+	})
+}
+
+// internalError logs err and answers with a 500 that doesn't reveal it
+func internalError(w http.ResponseWriter, r *http.Request, err error) {
+	log.Printf("request %s: %s %s: %v", requestIDFromContext(r.Context()), r.Method, r.URL.Path, err)
+	writeProblem(w, r, http.StatusInternalServerError, problemInternal, "The request could not be completed")
+}
+
+// upstreamError logs err and answers with a 502 for a failed call to the
+// identity provider
+func upstreamError(w http.ResponseWriter, r *http.Request, err error) {
+	log.Printf("request %s: %s %s: %v", requestIDFromContext(r.Context()), r.Method, r.URL.Path, err)
+	writeProblem(w, r, http.StatusBadGateway, problemUpstream, "The identity provider could not be reached")
+}
+
+// notFound answers requests for routes that don't exist
+func notFound(w http.ResponseWriter, r *http.Request) {
+	writeProblem(w, r, http.StatusNotFound, problemNotFound, "No such route")
+}
+
+// methodNotAllowed answers requests with a method the route doesn't support
+func methodNotAllowed(w http.ResponseWriter, r *http.Request) {
+	writeProblem(w, r, http.StatusMethodNotAllowed, problemMethodNotAllowed, r.Method+" is not supported here")
+}
+
+type requestIDKey struct{}
+
+// validRequestID accepts client supplied request IDs that are safe to log
+var validRequestID = regexp.MustCompile(`^[A-Za-z0-9._-]{1,128}$`)
+
+// withRequestID stores the request ID in the context and echoes it in the
+// X-Request-ID header. A valid ID sent by the client is kept so requests can
+// be followed across services.
+func withRequestID(w http.ResponseWriter, r *http.Request) *http.Request {
+	id := r.Header.Get("X-Request-ID")
+	if !validRequestID.MatchString(id) {
+		var err error
+		if id, err = randomToken(8); err != nil {
+			id = "unknown"
+		}
+	}
+
+	w.Header().Set("X-Request-ID", id)
+	return r.WithContext(context.WithValue(r.Context(), requestIDKey{}, id))
+}
+
+// requestIDFromContext returns the ID of the request being served
+func requestIDFromContext(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// decodeProblem checks that rr holds a problem with the given status and
+// type and returns it
+func decodeProblem(t *testing.T, rr *httptest.ResponseRecorder, status int, typ problemType) Problem {
+	t.Helper()
+
+	if rr.Code != status {
+		t.Errorf("handler returned wrong status code: got %d, expected %d", rr.Code, status)
+	}
+	if ct := rr.Header().Get("Content-Type"); ct != "application/problem+json" {
+		t.Errorf("handler returned wrong content type: got %q, expected application/problem+json", ct)
+	}
+
+	var problem Problem
+	if err := json.NewDecoder(rr.Body).Decode(&problem); err != nil {
+		t.Fatal(err)
+	}
+	if problem.Type != typ.uri || problem.Status != status {
+		t.Errorf("handler returned wrong problem: got %s %d, expected %s %d", problem.Type, problem.Status, typ.uri, status)
+	}
+	if problem.RequestID == "" || problem.RequestID != rr.Header().Get("X-Request-ID") {
+		t.Errorf("problem request_id %q does not match X-Request-ID %q", problem.RequestID, rr.Header().Get("X-Request-ID"))
+	}
+	return problem
+}
+
+func TestMalformedBodyProblem(t *testing.T) {
+	s := newTestServer(t)
+
+	req, err := http.NewRequest("POST", "/books", strings.NewReader(`{"title": `))
+	if err != nil {
+		t.Fatal(err)
+	}
+	authorize(t, req)
+	rr := httptest.NewRecorder()
+	s.ServeHTTP(rr, req)
+
+	problem := decodeProblem(t, rr, http.StatusBadRequest, problemMalformedBody)
+	if problem.Instance != "/books" {
+		t.Errorf("problem instance: got %q, expected /books", problem.Instance)
+	}
+}
+
+func TestValidationProblem(t *testing.T) {
+	s := newTestServer(t)
+
+	rr := serveJSON(t, s, "POST", "/users", map[string]string{"username": "", "password": "password1"})
+	problem := decodeProblem(t, rr, http.StatusBadRequest, problemValidation)
+	if len(problem.Errors) != 1 || problem.Errors[0].Field != "username" {
+		t.Errorf("problem errors: got %+v, expected one for username", problem.Errors)
+	}
+}
+
+func TestNotFoundProblems(t *testing.T) {
+	s := newTestServer(t)
+
+	decodeProblem(t, serveJSON(t, s, "GET", "/books/999", nil), http.StatusNotFound, problemNotFound)
+	decodeProblem(t, serveJSON(t, s, "GET", "/no/such/route", nil), http.StatusNotFound, problemNotFound)
+	decodeProblem(t, serveJSON(t, s, "PATCH", "/books", nil), http.StatusMethodNotAllowed, problemMethodNotAllowed)
+}
+
+func TestUnauthorizedProblem(t *testing.T) {
+	s := newTestServer(t)
+
+	req, err := http.NewRequest("GET", "/books", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr := httptest.NewRecorder()
+	s.ServeHTTP(rr, req)
+
+	decodeProblem(t, rr, http.StatusUnauthorized, problemUnauthorized)
+	if rr.Header().Get("WWW-Authenticate") == "" {
+		t.Error("expected a WWW-Authenticate header")
+	}
+}
+
+// failingBooks is a store whose book listing fails
+type failingBooks struct {
+	Store
+}
+
+func (failingBooks) ListBooks(ctx context.Context, opts ListOptions) ([]Book, int, error) {
+	return nil, 0, errors.New("connection refused by db.internal:5432")
+}
+
+func TestInternalErrorProblemHidesCause(t *testing.T) {
+	s := newTestServer(t)
+	s.store = failingBooks{s.store}
+
+	rr := serveJSON(t, s, "GET", "/books", nil)
+	body := rr.Body.String()
+	decodeProblem(t, rr, http.StatusInternalServerError, problemInternal)
+	if strings.Contains(body, "db.internal") {
+		t.Errorf("problem leaks the error: %s", body)
+	}
+}
+
+func TestRequestID(t *testing.T) {
+	s := newTestServer(t)
+
+	tests := []struct {
+		header string
+		echoed bool
+	}{
+		{"trace-42.abc_DEF", true},
+		{"", false},
+		{"has spaces", false},
+		{strings.Repeat("a", 129), false},
+	}
+	for _, test := range tests {
+		req, err := http.NewRequest("GET", "/books", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		authorize(t, req)
+		if test.header != "" {
+			req.Header.Set("X-Request-ID", test.header)
+		}
+		rr := httptest.NewRecorder()
+		s.ServeHTTP(rr, req)
+
+		id := rr.Header().Get("X-Request-ID")
+		if test.echoed && id != test.header {
+			t.Errorf("X-Request-ID %q: got %q, expected it echoed", test.header, id)
+		}
+		if !test.echoed && (id == "" || id == test.header) {
+			t.Errorf("X-Request-ID %q: got %q, expected a generated ID", test.header, id)
+		}
+	}
+}
@@ -0,0 +1,279 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Route groups that are rate limited separately
+const (
+	// rateGroupAuth holds the public routes: login, refresh and the JWKS
+	rateGroupAuth = "auth"
+	// rateGroupRead holds the protected GET routes
+	rateGroupRead = "read"
+	// rateGroupWrite holds the protected routes that change data
+	rateGroupWrite = "write"
+)
+
+var rateGroups = []string{rateGroupAuth, rateGroupRead, rateGroupWrite}
+
+// RateLimit is a token bucket refilled with Requests tokens every Per, up to
+// Burst tokens. Burst defaults to Requests.
+type RateLimit struct {
+	Requests int           `yaml:"requests"`
+	Per      time.Duration `yaml:"per"`
+	Burst    int           `yaml:"burst"`
+}
+
+// rate returns the tokens added per second
+func (l RateLimit) rate() float64 {
+	return float64(l.Requests) / l.Per.Seconds()
+}
+
+// capacity returns the size of the bucket
+func (l RateLimit) capacity() int {
+	if l.Burst > 0 {
+		return l.Burst
+	}
+	return l.Requests
+}
+
+// validateRateLimits checks the configured limits of every route group.
+func validateRateLimits(limits map[string]RateLimit) []string {
+	names := make([]string, 0, len(limits))
+	for name := range limits {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var problems []string
+	for _, name := range names {
+		limit := limits[name]
+		if !contains(rateGroups, name) {
+			problems = append(problems, fmt.Sprintf("rate_limits: unknown route group %q", name))
+		}
+		if limit.Requests <= 0 || limit.Per <= 0 || limit.Burst < 0 {
+			problems = append(problems, fmt.Sprintf("rate_limits.%s: requests and per must be positive", name))
+		}
+	}
+	return problems
+}
+
+// RateLimitResult is the state of a bucket after taking a token from it.
+type RateLimitResult struct {
+	Allowed   bool
+	Remaining int
+	// Reset is how long until the bucket is full again
+	Reset time.Duration
+	// RetryAfter is how long until the next token when none was left
+	RetryAfter time.Duration
+}
+
+// RateLimitStore keeps token buckets and daily quota counters. The server
+// uses an in-process store; running several instances needs a shared one.
+type RateLimitStore interface {
+	// Take takes a token from the bucket key, refilling it by limit first.
+	Take(ctx context.Context, key string, limit RateLimit, now time.Time) (RateLimitResult, error)
+	// CountQuota counts a request against the quota of key on day and
+	// returns the number of requests counted that day.
+	CountQuota(ctx context.Context, key, day string) (int, error)
+}
+
+type tokenBucket struct {
+	tokens  float64
+	updated time.Time
+	// full is when the bucket will have refilled completely
+	full time.Time
+}
+
+type quotaCounter struct {
+	day   string
+	count int
+}
+
+// memoryRateLimiter is the in-process RateLimitStore.
+type memoryRateLimiter struct {
+	mu      sync.Mutex
+	buckets map[string]*tokenBucket
+	quotas  map[string]quotaCounter
+	takes   int
+}
+
+func newMemoryRateLimiter() *memoryRateLimiter {
+	return &memoryRateLimiter{
+		buckets: make(map[string]*tokenBucket),
+		quotas:  make(map[string]quotaCounter),
+	}
+}
+
+// sweepInterval is how many takes pass between removing idle buckets
+const sweepInterval = 1024
+
+func (m *memoryRateLimiter) Take(ctx context.Context, key string, limit RateLimit, now time.Time) (RateLimitResult, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	rate, capacity := limit.rate(), float64(limit.capacity())
+
+	m.takes++
+	if m.takes%sweepInterval == 0 {
+		m.sweep(now)
+	}
+
+	bucket, ok := m.buckets[key]
+	if !ok {
+		bucket = &tokenBucket{tokens: capacity, updated: now}
+		m.buckets[key] = bucket
+	}
+	if elapsed := now.Sub(bucket.updated).Seconds(); elapsed > 0 {
+		bucket.tokens = math.Min(capacity, bucket.tokens+elapsed*rate)
+		bucket.updated = now
+	}
+
+	var result RateLimitResult
+	if bucket.tokens >= 1 {
+		bucket.tokens--
+		result.Allowed = true
+	} else {
+		result.RetryAfter = seconds((1 - bucket.tokens) / rate)
+	}
+	result.Remaining = int(bucket.tokens)
+	result.Reset = seconds((capacity - bucket.tokens) / rate)
+	bucket.full = now.Add(result.Reset)
+	return result, nil
+}
+
+// sweep removes buckets that have been idle long enough to be full, which
+// is the same as not having a bucket, and the quotas of past days
+func (m *memoryRateLimiter) sweep(now time.Time) {
+	for key, bucket := range m.buckets {
+		if !now.Before(bucket.full) {
+			delete(m.buckets, key)
+		}
+	}
+	for key, quota := range m.quotas {
+		if quota.day != now.UTC().Format(time.DateOnly) {
+			delete(m.quotas, key)
+		}
+	}
+}
+
+func (m *memoryRateLimiter) CountQuota(ctx context.Context, key, day string) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	quota := m.quotas[key]
+	if quota.day != day {
+		quota = quotaCounter{day: day}
+	}
+	quota.count++
+	m.quotas[key] = quota
+	return quota.count, nil
+}
+
+// seconds converts a number of seconds to a Duration
+func seconds(s float64) time.Duration {
+	return time.Duration(s * float64(time.Second))
+}
+
+// headerSeconds formats d as whole seconds, rounded up
+func headerSeconds(d time.Duration) string {
+	return strconv.Itoa(int(math.Ceil(d.Seconds())))
+}
+
+// methodRateGroup puts reads and writes of the protected routes in their
+// own groups
+func methodRateGroup(r *http.Request) string {
+	if r.Method == http.MethodGet || r.Method == http.MethodHead {
+		return rateGroupRead
+	}
+	return rateGroupWrite
+}
+
+// rateLimitKey identifies the client a request is counted against: its API
+// key, its user or else its address
+func rateLimitKey(r *http.Request) string {
+	principal, ok := principalFromContext(r.Context())
+	switch {
+	case ok && principal.APIKeyID != 0:
+		return "key:" + strconv.Itoa(principal.APIKeyID)
+	case ok:
+		return "user:" + principal.Username
+	default:
+		return "ip:" + clientIP(r)
+	}
+}
+
+// rateLimit returns a middleware limiting each client to the rate of the
+// route group picked by group. API keys also count against their daily
+// quota. Requests over either limit are answered with 429.
+func (s *server) rateLimit(group func(*http.Request) string) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			name, key := group(r), rateLimitKey(r)
+
+			if limit, ok := s.rateLimits[name]; ok && !s.takeToken(w, r, name+":"+key, limit) {
+				return
+			}
+			if principal, ok := principalFromContext(r.Context()); ok && principal.DailyQuota > 0 {
+				if !s.countQuota(w, r, key, principal.DailyQuota) {
+					return
+				}
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// takeToken takes a token from the bucket key and sets the RateLimit
+// headers, answering 429 and returning false when the bucket is empty
+func (s *server) takeToken(w http.ResponseWriter, r *http.Request, key string, limit RateLimit) bool {
+	result, err := s.limiter.Take(r.Context(), key, limit, s.now())
+	if err != nil {
+		internalError(w, r, err)
+		return false
+	}
+
+	w.Header().Set("RateLimit-Policy", fmt.Sprintf("%d;w=%s;burst=%d", limit.Requests, headerSeconds(limit.Per), limit.capacity()))
+	w.Header().Set("RateLimit-Limit", strconv.Itoa(limit.capacity()))
+	w.Header().Set("RateLimit-Remaining", strconv.Itoa(result.Remaining))
+	w.Header().Set("RateLimit-Reset", headerSeconds(result.Reset))
+	if !result.Allowed {
+		w.Header().Set("Retry-After", headerSeconds(result.RetryAfter))
+		writeProblem(w, r, http.StatusTooManyRequests, problemRateLimited, "Rate limit exceeded")
+		return false
+	}
+	return true
+}
+
+// countQuota counts the request against a daily quota, which resets at
+// midnight UTC, answering 429 and returning false once it is used up
+func (s *server) countQuota(w http.ResponseWriter, r *http.Request, key string, quota int) bool {
+	now := s.now().UTC()
+	tomorrow := now.Truncate(24 * time.Hour).Add(24 * time.Hour)
+
+	count, err := s.limiter.CountQuota(r.Context(), key, now.Format(time.DateOnly))
+	if err != nil {
+		internalError(w, r, err)
+		return false
+	}
+
+	w.Header().Set("X-Quota-Limit", strconv.Itoa(quota))
+	w.Header().Set("X-Quota-Remaining", strconv.Itoa(max(quota-count, 0)))
+	w.Header().Set("X-Quota-Reset", headerSeconds(tomorrow.Sub(now)))
+	if count > quota {
+		w.Header().Set("Retry-After", headerSeconds(tomorrow.Sub(now)))
+		writeProblem(w, r, http.StatusTooManyRequests, problemRateLimited, "Daily quota exceeded")
+		return false
+	}
+	return true
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// newRateLimitTestServer returns a test server with the given limits and a
+// controllable clock
+func newRateLimitTestServer(t *testing.T, limits map[string]RateLimit) (*server, *time.Time) {
+	cfg := testConfig
+	cfg.RateLimits = limits
+	router := newTestServerWith(t, cfg)
+
+	now := time.Date(2026, 10, 1, 23, 59, 0, 0, time.UTC)
+	router.now = func() time.Time { return now }
+	return router, &now
+}
+
+// getAs requests url with a token for username and returns the response
+func getAs(t *testing.T, router http.Handler, url, username string) *httptest.ResponseRecorder {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	authorizeAs(t, req, username, roleReader)
+
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	return rr
+}
+
+func TestRateLimit(t *testing.T) {
+	router, now := newRateLimitTestServer(t, map[string]RateLimit{
+		rateGroupRead: {Requests: 1, Per: 2 * time.Second, Burst: 2},
+	})
+
+	for i, remaining := range []string{"1", "0"} {
+		rr := getAs(t, router, "/books", "alice")
+		if rr.Code != http.StatusOK || rr.Header().Get("RateLimit-Remaining") != remaining {
+			t.Errorf("request %d: got %d with %q remaining, expected %d with %s", i+1, rr.Code, rr.Header().Get("RateLimit-Remaining"), http.StatusOK, remaining)
+		}
+	}
+
+	rr := getAs(t, router, "/books", "alice")
+	if rr.Code != http.StatusTooManyRequests {
+		t.Fatalf("request over the limit returned %d, expected %d", rr.Code, http.StatusTooManyRequests)
+	}
+	headers := map[string]string{
+		"Retry-After":      "2",
+		"RateLimit-Limit":  "2",
+		"RateLimit-Reset":  "4",
+		"RateLimit-Policy": "1;w=2;burst=2",
+	}
+	for name, want := range headers {
+		if got := rr.Header().Get(name); got != want {
+			t.Errorf("%s: got %q, expected %q", name, got, want)
+		}
+	}
+
+	// Other users have their own bucket and writes aren't limited here
+	if rr := getAs(t, router, "/books", "bob"); rr.Code != http.StatusOK {
+		t.Errorf("another user got %d, expected %d", rr.Code, http.StatusOK)
+	}
+	if rr := serveJSON(t, router, "POST", "/books", map[string]string{"title": "New"}); rr.Code != http.StatusOK {
+		t.Errorf("unlimited write got %d, expected %d", rr.Code, http.StatusOK)
+	}
+
+	*now = now.Add(2 * time.Second)
+	if rr := getAs(t, router, "/books", "alice"); rr.Code != http.StatusOK {
+		t.Errorf("request after refill got %d, expected %d", rr.Code, http.StatusOK)
+	}
+}
+
+func TestRateLimitByIP(t *testing.T) {
+	router, _ := newRateLimitTestServer(t, map[string]RateLimit{
+		rateGroupAuth: {Requests: 1, Per: time.Minute},
+	})
+
+	if rr := loginFrom(t, router, "10.0.0.1", "admin", "password"); rr.Code != http.StatusOK {
+		t.Errorf("first login got %d, expected %d", rr.Code, http.StatusOK)
+	}
+	if rr := loginFrom(t, router, "10.0.0.1", "admin", "password"); rr.Code != http.StatusTooManyRequests {
+		t.Errorf("second login got %d, expected %d", rr.Code, http.StatusTooManyRequests)
+	}
+	if rr := loginFrom(t, router, "10.0.0.2", "admin", "password"); rr.Code != http.StatusOK {
+		t.Errorf("login from another address got %d, expected %d", rr.Code, http.StatusOK)
+	}
+}
+
+func TestAPIKeyDailyQuota(t *testing.T) {
+	router, now := newRateLimitTestServer(t, nil)
+	router.apiKeyDailyQuota = 5
+
+	key := createTestAPIKey(t, router, map[string]interface{}{"name": "sync", "scopes": []string{"read:*"}, "daily_quota": 2})
+	for i := 0; i < 2; i++ {
+		if code := serveWithKey(t, router, "GET", "/books", key); code != http.StatusOK {
+			t.Errorf("request %d within the quota got %d, expected %d", i+1, code, http.StatusOK)
+		}
+	}
+
+	req, _ := http.NewRequest("GET", "/books", nil)
+	req.Header.Set("Authorization", "Bearer "+key)
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	if rr.Code != http.StatusTooManyRequests || rr.Header().Get("Retry-After") != "60" || rr.Header().Get("X-Quota-Remaining") != "0" {
+		t.Errorf("request over the quota got %d with headers %v", rr.Code, rr.Header())
+	}
+
+	// Quotas start over at midnight UTC
+	*now = now.Add(time.Minute)
+	if code := serveWithKey(t, router, "GET", "/books", key); code != http.StatusOK {
+		t.Errorf("request on the next day got %d, expected %d", code, http.StatusOK)
+	}
+
+	// Keys without their own quota get the configured one
+	key = createTestAPIKey(t, router, map[string]interface{}{"name": "other", "scopes": []string{"read:*"}})
+	for i := 0; i < 5; i++ {
+		serveWithKey(t, router, "GET", "/books", key)
+	}
+	if code := serveWithKey(t, router, "GET", "/books", key); code != http.StatusTooManyRequests {
+		t.Errorf("request over the default quota got %d, expected %d", code, http.StatusTooManyRequests)
+	}
+}
+
+func TestMemoryRateLimiterSweep(t *testing.T) {
+	limiter := newMemoryRateLimiter()
+	limit := RateLimit{Requests: 1, Per: time.Second}
+	now := time.Now()
+
+	limiter.Take(context.Background(), "idle", limit, now)
+	for i := 1; i < sweepInterval; i++ {
+		limiter.Take(context.Background(), "busy", limit, now.Add(time.Duration(i)*time.Second))
+	}
+	if _, ok := limiter.buckets["idle"]; ok {
+		t.Error("expected the refilled bucket to be removed")
+	}
+	if _, ok := limiter.buckets["busy"]; !ok {
+		t.Error("expected the bucket in use to be kept")
+	}
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Built-in role names. The set of roles and what they may do is configured
+// through Config.Roles; these are the defaults and the role given to the
+// bootstrap admin.
+const (
+	roleReader    = "reader"
+	roleLibrarian = "librarian"
+	roleAdmin     = "admin"
+)
+
+// Permissions have the form action:resource. A role granted "*" may do
+// anything, and one granted "action:*" may perform action on any resource.
+const (
+	permReadBooks         = "read:books"
+	permWriteBooks        = "write:books"
+	permDeleteBooks       = "delete:books"
+	permReadAuthors       = "read:authors"
+	permWriteAuthors      = "write:authors"
+	permDeleteAuthors     = "delete:authors"
+	permReadAuthorBooks   = "read:authorbooks"
+	permWriteAuthorBooks  = "write:authorbooks"
+	permDeleteAuthorBooks = "delete:authorbooks"
+	permReadUsers         = "read:users"
+	permWriteUsers        = "write:users"
+	permReadAPIKeys       = "read:apikeys"
+	permWriteAPIKeys      = "write:apikeys"
+	permDeleteAPIKeys     = "delete:apikeys"
+)
+
+// knownActions and knownResources are the parts a permission may be built from
+var (
+	knownActions   = []string{"read", "write", "delete"}
+	knownResources = []string{"books", "authors", "authorbooks", "users", "apikeys"}
+)
+
+// Roles maps each role name to the permissions it grants.
+type Roles map[string][]string
+
+// defaultRoles gives readers read-only access, lets librarians also create
+// and update, and reserves deletes and user management for admins.
+func defaultRoles() Roles {
+	return Roles{
+		roleReader: {permReadBooks, permReadAuthors, permReadAuthorBooks},
+		roleLibrarian: {
+			permReadBooks, permReadAuthors, permReadAuthorBooks,
+			permWriteBooks, permWriteAuthors, permWriteAuthorBooks,
+		},
+		roleAdmin: {"*"},
+	}
+}
+
+// allows reports whether role grants permission.
+func (r Roles) allows(role, permission string) bool {
+	return grants(r[role], permission)
+}
+
+// grants reports whether the list of granted permissions includes
+// permission, directly or through a wildcard.
+func grants(list []string, permission string) bool {
+	action, _, _ := strings.Cut(permission, ":")
+	for _, granted := range list {
+		if granted == "*" || granted == permission || granted == action+":*" {
+			return true
+		}
+	}
+	return false
+}
+
+// validate checks that every granted permission is well formed.
+func (r Roles) validate() []string {
+	var problems []string
+
+	names := make([]string, 0, len(r))
+	for name := range r {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		for _, permission := range r[name] {
+			if !validPermission(permission) {
+				problems = append(problems, fmt.Sprintf("role %q has unknown permission %q", name, permission))
+			}
+		}
+	}
+	return problems
+}
+
+func validPermission(permission string) bool {
+	if permission == "*" {
+		return true
+	}
+
+	action, resource, ok := strings.Cut(permission, ":")
+	return ok && contains(knownActions, action) && (resource == "*" || contains(knownResources, resource))
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRolesAllows(t *testing.T) {
+	roles := defaultRoles()
+	roles["auditor"] = []string{"read:*"}
+
+	tests := []struct {
+		role       string
+		permission string
+		expected   bool
+	}{
+		{roleReader, permReadBooks, true},
+		{roleReader, permWriteBooks, false},
+		{roleLibrarian, permWriteAuthors, true},
+		{roleLibrarian, permDeleteBooks, false},
+		{roleAdmin, permDeleteAuthorBooks, true},
+		{roleAdmin, permWriteUsers, true},
+		{"auditor", permReadUsers, true},
+		{"auditor", permWriteBooks, false},
+		{"unknown", permReadBooks, false},
+	}
+
+	for _, test := range tests {
+		if got := roles.allows(test.role, test.permission); got != test.expected {
+			t.Errorf("allows(%q, %q) = %v, expected %v", test.role, test.permission, got, test.expected)
+		}
+	}
+}
+
+func TestRolesValidate(t *testing.T) {
+	roles := Roles{"custom": {"read:books", "fly:books", "read:planes", "write:*"}}
+
+	problems := roles.validate()
+	if len(problems) != 2 {
+		t.Fatalf("expected 2 problems, got %v", problems)
+	}
+	if !strings.Contains(problems[0], `"fly:books"`) || !strings.Contains(problems[1], `"read:planes"`) {
+		t.Errorf("unexpected problems %v", problems)
+	}
+}
+
+func TestRoutePermissions(t *testing.T) {
+	tests := []struct {
+		role     string
+		method   string
+		url      string
+		body     string
+		expected int
+	}{
+		{roleReader, "GET", "/books", "", http.StatusOK},
+		{roleReader, "GET", "/authors/1", "", http.StatusOK},
+		{roleReader, "POST", "/books", `{"title": "New"}`, http.StatusForbidden},
+		{roleReader, "GET", "/users", "", http.StatusForbidden},
+		{roleLibrarian, "POST", "/books", `{"title": "New"}`, http.StatusOK},
+		{roleLibrarian, "PUT", "/authors/1", `{"name": "Renamed"}`, http.StatusOK},
+		{roleLibrarian, "DELETE", "/books/1", "", http.StatusForbidden},
+		{roleLibrarian, "DELETE", "/authorbooks/1", "", http.StatusForbidden},
+		{roleAdmin, "DELETE", "/books/1", "", http.StatusNoContent},
+		{roleAdmin, "GET", "/users", "", http.StatusOK},
+		{"", "GET", "/books", "", http.StatusForbidden},
+	}
+
+	for _, test := range tests {
+		router := newTestServer(t)
+
+		req, err := http.NewRequest(test.method, test.url, bytes.NewBufferString(test.body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		authorizeAs(t, req, "someone", test.role)
+
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+
+		if rr.Code != test.expected {
+			t.Errorf("%s %s as %q returned %d, expected %d", test.method, test.url, test.role, rr.Code, test.expected)
+		}
+	}
+}
+
+func TestChangeOwnPassword(t *testing.T) {
+	router := newTestServer(t)
+
+	// A reader can't change the admin's password...
+	req, err := http.NewRequest("PUT", "/users/1/password", bytes.NewBufferString(`{"password": "new-password"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	authorizeAs(t, req, "reader", roleReader)
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	if rr.Code != http.StatusForbidden {
+		t.Errorf("changing another user's password returned %d, expected %d", rr.Code, http.StatusForbidden)
+	}
+
+	// ...but the admin can change their own regardless of role
+	req, err = http.NewRequest("PUT", "/users/1/password", bytes.NewBufferString(`{"password": "new-password"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	authorizeAs(t, req, "admin", roleReader)
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	if rr.Code != http.StatusNoContent {
+		t.Errorf("changing your own password returned %d, expected %d", rr.Code, http.StatusNoContent)
+	}
+}
@@ -0,0 +1,649 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode"
+)
+
+// Kinds of documents in the search index
+const (
+	searchBook   = "book"
+	searchAuthor = "author"
+)
+
+// searchIndexVersion changes whenever the saved index format or the way
+// text is split into terms does, so that old index files are rebuilt
+const searchIndexVersion = 1
+
+// BM25 parameters: how quickly repeating a term stops raising the score,
+// and how much a long text is penalised
+const (
+	bm25K1 = 1.2
+	bm25B  = 0.75
+)
+
+// searchKey identifies a document in the search index
+type searchKey struct {
+	Kind string
+	ID   int
+}
+
+// searchData is an inverted index of book titles and author names. It is
+// what a searchIndex saves to its file.
+type searchData struct {
+	Version int
+	// Texts holds the text of every document, to return with results
+	Texts map[searchKey]string
+	// Lengths holds the number of terms of every document
+	Lengths     map[searchKey]int
+	TotalLength int
+	// Postings holds the positions of every term in every document
+	Postings map[string]map[searchKey][]int
+
+	// grams holds the terms of Postings by each of their bigrams, to find
+	// the terms a misspelt one may be. It is built from Postings rather
+	// than saved.
+	grams map[string]map[string]bool
+}
+
+func newSearchData() *searchData {
+	return &searchData{
+		Version:  searchIndexVersion,
+		Texts:    make(map[searchKey]string),
+		Lengths:  make(map[searchKey]int),
+		Postings: make(map[string]map[searchKey][]int),
+		grams:    make(map[string]map[string]bool),
+	}
+}
+
+// termGrams returns the pairs of neighbouring letters of a term, counting
+// its start and end as letters so that every letter is in two pairs
+func termGrams(term string) []string {
+	runes := []rune("^" + term + "$")
+	grams := make([]string, 0, len(runes)-1)
+	for i := range len(runes) - 1 {
+		grams = append(grams, string(runes[i:i+2]))
+	}
+	return grams
+}
+
+// indexGrams adds a new term to or, when removed, deletes it from grams
+func (d *searchData) indexGrams(term string, removed bool) {
+	for _, gram := range termGrams(term) {
+		if removed {
+			delete(d.grams[gram], term)
+			if len(d.grams[gram]) == 0 {
+				delete(d.grams, gram)
+			}
+			continue
+		}
+		if d.grams[gram] == nil {
+			d.grams[gram] = make(map[string]bool)
+		}
+		d.grams[gram][term] = true
+	}
+}
+
+// searchTerms splits text into lower case, stemmed words
+func searchTerms(text string) []string {
+	words := strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r) && r != '\'' && r != '’'
+	})
+
+	terms := make([]string, 0, len(words))
+	for _, word := range words {
+		word = strings.ReplaceAll(word, "’", "'")
+		word = strings.TrimSuffix(strings.Trim(word, "'"), "'s")
+		word = strings.ReplaceAll(word, "'", "")
+		if word != "" {
+			terms = append(terms, stem(word))
+		}
+	}
+	return terms
+}
+
+// put adds a document, replacing any with the same key
+func (d *searchData) put(key searchKey, text string) {
+	d.remove(key)
+
+	terms := searchTerms(text)
+	d.Texts[key] = text
+	d.Lengths[key] = len(terms)
+	d.TotalLength += len(terms)
+	for i, term := range terms {
+		if d.Postings[term] == nil {
+			d.Postings[term] = make(map[searchKey][]int)
+			d.indexGrams(term, false)
+		}
+		d.Postings[term][key] = append(d.Postings[term][key], i)
+	}
+}
+
+func (d *searchData) remove(key searchKey) {
+	text, ok := d.Texts[key]
+	if !ok {
+		return
+	}
+
+	for _, term := range searchTerms(text) {
+		delete(d.Postings[term], key)
+		if len(d.Postings[term]) == 0 {
+			delete(d.Postings, term)
+			d.indexGrams(term, true)
+		}
+	}
+	d.TotalLength -= d.Lengths[key]
+	delete(d.Texts, key)
+	delete(d.Lengths, key)
+}
+
+// searchClause is a word or a quoted phrase of a query. Every clause must
+// match a document for it to be found.
+type searchClause struct {
+	terms  []string
+	phrase bool
+}
+
+// parseSearchQuery splits a query into words and "quoted phrases"
+func parseSearchQuery(q string) []searchClause {
+	var clauses []searchClause
+	for i, part := range strings.Split(q, `"`) {
+		// Parts at odd indexes were between quotes
+		if i%2 == 1 {
+			if terms := searchTerms(part); len(terms) > 0 {
+				clauses = append(clauses, searchClause{terms: terms, phrase: len(terms) > 1})
+			}
+			continue
+		}
+		for _, term := range searchTerms(part) {
+			clauses = append(clauses, searchClause{terms: []string{term}})
+		}
+	}
+	return clauses
+}
+
+// maxTypos is the number of typos tolerated in a term: none in short terms,
+// where one typo makes another word, one from four letters on and two from
+// eight
+func maxTypos(term string) int {
+	switch n := len([]rune(term)); {
+	case n < 4:
+		return 0
+	case n < 8:
+		return 1
+	}
+	return 2
+}
+
+// editDistance counts the insertions, deletions, substitutions and swaps of
+// neighbouring letters that turn a into b
+func editDistance(a, b []rune) int {
+	// Three rows of the distance matrix are enough for swaps
+	prev2 := make([]int, len(b)+1)
+	prev := make([]int, len(b)+1)
+	cur := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = min(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+			if i > 1 && j > 1 && a[i-1] == b[j-2] && a[i-2] == b[j-1] {
+				cur[j] = min(cur[j], prev2[j-2]+1)
+			}
+		}
+		prev2, prev, cur = prev, cur, prev2
+	}
+	return prev[len(b)]
+}
+
+// variants returns the indexed terms a query term matches with the weight
+// of each match: 1 for the term itself and less for every typo
+func (d *searchData) variants(term string) map[string]float64 {
+	variants := make(map[string]float64)
+	if _, ok := d.Postings[term]; ok {
+		variants[term] = 1
+	}
+
+	typos := maxTypos(term)
+	if typos == 0 {
+		return variants
+	}
+
+	// A typo changes at most three of the letter pairs of a term, so only
+	// terms that share the others are compared with it
+	grams := termGrams(term)
+	shared := make(map[string]int)
+	for _, gram := range grams {
+		for indexed := range d.grams[gram] {
+			shared[indexed]++
+		}
+	}
+
+	runes := []rune(term)
+	for indexed, n := range shared {
+		other := []rune(indexed)
+		if indexed == term || n < len(grams)-3*typos || len(other) < len(runes)-typos || len(other) > len(runes)+typos {
+			continue
+		}
+		if n := editDistance(runes, other); n <= typos {
+			variants[indexed] = 1 / float64(1+n)
+		}
+	}
+	return variants
+}
+
+// bm25 scores a term found freq times in a document of length terms, when
+// it is in docs of the documents
+func (d *searchData) bm25(freq, length, docs int) float64 {
+	n := float64(len(d.Texts))
+	idf := math.Log(1 + (n-float64(docs)+0.5)/(float64(docs)+0.5))
+	avgLength := float64(d.TotalLength) / n
+	tf := float64(freq)
+	return idf * tf * (bm25K1 + 1) / (tf + bm25K1*(1-bm25B+bm25B*float64(length)/avgLength))
+}
+
+// score returns the score of every document of the given kinds that
+// matches the clause
+func (d *searchData) score(clause searchClause, kinds []string) map[searchKey]float64 {
+	scores := make(map[searchKey]float64)
+	if !clause.phrase {
+		for term, weight := range d.variants(clause.terms[0]) {
+			postings := d.Postings[term]
+			for key, positions := range postings {
+				if !slices.Contains(kinds, key.Kind) {
+					continue
+				}
+				score := weight * d.bm25(len(positions), d.Lengths[key], len(postings))
+				scores[key] = max(scores[key], score)
+			}
+		}
+		return scores
+	}
+
+	// A phrase matches where its terms follow each other, without typos
+	first := d.Postings[clause.terms[0]]
+	for key, positions := range first {
+		if !slices.Contains(kinds, key.Kind) {
+			continue
+		}
+		freq := 0
+		for _, start := range positions {
+			if d.phraseAt(key, clause.terms, start) {
+				freq++
+			}
+		}
+		if freq == 0 {
+			continue
+		}
+		for _, term := range clause.terms {
+			scores[key] += d.bm25(freq, d.Lengths[key], len(d.Postings[term]))
+		}
+	}
+	return scores
+}
+
+// phraseAt tells whether terms follow each other in a document from start
+func (d *searchData) phraseAt(key searchKey, terms []string, start int) bool {
+	for i, term := range terms[1:] {
+		if !slices.Contains(d.Postings[term][key], start+i+1) {
+			return false
+		}
+	}
+	return true
+}
+
+// SearchResult is a book or author found by a search
+type SearchResult struct {
+	Type  string  `json:"type"`
+	ID    int     `json:"id"`
+	Title string  `json:"title,omitempty"`
+	Name  string  `json:"name,omitempty"`
+	Score float64 `json:"score"`
+}
+
+// search returns the documents of the given kinds that match every clause
+// of q, best first
+func (d *searchData) search(q string, kinds []string) []SearchResult {
+	clauses := parseSearchQuery(q)
+	if len(clauses) == 0 || len(d.Texts) == 0 {
+		return []SearchResult{}
+	}
+
+	var total map[searchKey]float64
+	for _, clause := range clauses {
+		scores := d.score(clause, kinds)
+		if total == nil {
+			total = scores
+			continue
+		}
+		for key := range total {
+			if score, ok := scores[key]; ok {
+				total[key] += score
+			} else {
+				delete(total, key)
+			}
+		}
+	}
+
+	results := make([]SearchResult, 0, len(total))
+	for key, score := range total {
+		result := SearchResult{Type: key.Kind, ID: key.ID, Score: math.Round(score*1000) / 1000}
+		if key.Kind == searchBook {
+			result.Title = d.Texts[key]
+		} else {
+			result.Name = d.Texts[key]
+		}
+		results = append(results, result)
+	}
+	slices.SortFunc(results, func(a, b SearchResult) int {
+		return cmp.Or(cmp.Compare(b.Score, a.Score), strings.Compare(a.Type, b.Type), cmp.Compare(a.ID, b.ID))
+	})
+	return results
+}
+
+// searchIndex is the search index of a server. Handlers that change books
+// and authors update it. When it has a file, it is saved there at startup
+// and every change is appended to a log next to it, which the next start
+// replays and folds into the file.
+type searchIndex struct {
+	mu      sync.RWMutex
+	data    *searchData
+	logFile *os.File
+}
+
+// searchChange is a change to the search index as written to its log:
+// a document put with its text, or removed
+type searchChange struct {
+	Kind    string `json:"kind"`
+	ID      int    `json:"id"`
+	Text    string `json:"text,omitempty"`
+	Removed bool   `json:"removed,omitempty"`
+}
+
+func (c searchChange) apply(d *searchData) {
+	key := searchKey{c.Kind, c.ID}
+	if c.Removed {
+		d.remove(key)
+		return
+	}
+	d.put(key, c.Text)
+}
+
+// searchLogPath returns the log of the changes to the index saved at path
+func searchLogPath(path string) string {
+	return path + ".log"
+}
+
+// openSearchIndex loads the index saved at path with the changes logged
+// since or, when there is none yet, builds it from the books and authors
+// in store. Without a path the index is only kept in memory.
+func openSearchIndex(ctx context.Context, path string, store Store) (*searchIndex, error) {
+	index := &searchIndex{}
+	if path == "" {
+		data, err := buildSearchData(ctx, store)
+		if err != nil {
+			return nil, err
+		}
+		index.data = data
+		return index, nil
+	}
+
+	data, err := loadSearchData(path)
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+		data, err = buildSearchData(ctx, store)
+	case err == nil:
+		err = replaySearchLog(searchLogPath(path), data)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// Fold the log into the file, so that it only grows with the changes
+	// made while this server runs
+	if err := saveSearchData(path, data); err != nil {
+		return nil, err
+	}
+	logFile, err := os.OpenFile(searchLogPath(path), os.O_WRONLY|os.O_APPEND|os.O_CREATE|os.O_TRUNC, 0o666)
+	if err != nil {
+		return nil, err
+	}
+	index.data, index.logFile = data, logFile
+	return index, nil
+}
+
+func buildSearchData(ctx context.Context, store Store) (*searchData, error) {
+	books, err := store.AllBooks(ctx)
+	if err != nil {
+		return nil, err
+	}
+	authors, err := store.AllAuthors(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	data := newSearchData()
+	for _, book := range books {
+		data.put(searchKey{searchBook, book.ID}, book.Title)
+	}
+	for _, author := range authors {
+		data.put(searchKey{searchAuthor, author.ID}, author.Name)
+	}
+	return data, nil
+}
+
+func loadSearchData(path string) (*searchData, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var data searchData
+	if err := gob.NewDecoder(f).Decode(&data); err != nil {
+		return nil, fmt.Errorf("search index %s: %w; rebuild it with reindex", path, err)
+	}
+	if data.Version != searchIndexVersion {
+		return nil, fmt.Errorf("search index %s has version %d rather than %d; rebuild it with reindex", path, data.Version, searchIndexVersion)
+	}
+	data.grams = make(map[string]map[string]bool)
+	for term := range data.Postings {
+		data.indexGrams(term, false)
+	}
+	return &data, nil
+}
+
+// replaySearchLog applies the changes logged at path to data. A change a
+// crash cut short ends the log and is skipped.
+func replaySearchLog(path string, data *searchData) error {
+	content, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	// Every whole change ends with a newline, so the last line is empty
+	// unless it was cut short
+	lines := strings.Split(string(content), "\n")
+	for _, line := range lines[:len(lines)-1] {
+		var change searchChange
+		if err := json.Unmarshal([]byte(line), &change); err != nil {
+			return fmt.Errorf("search index log %s: %w; rebuild the index with reindex", path, err)
+		}
+		change.apply(data)
+	}
+	return nil
+}
+
+// saveSearchData writes data to a temporary file that then replaces the
+// one at path, so a crash never leaves half an index behind
+func saveSearchData(path string, data *searchData) error {
+	tmp := path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	if err := gob.NewEncoder(f).Encode(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// update applies a change to the index and appends it to the log. The
+// change has already been stored, so a failure to log it is only logged;
+// reindex repairs the file.
+func (index *searchIndex) update(change searchChange) {
+	index.mu.Lock()
+	defer index.mu.Unlock()
+
+	change.apply(index.data)
+	if index.logFile == nil {
+		return
+	}
+	line, err := json.Marshal(change)
+	if err == nil {
+		_, err = index.logFile.Write(append(line, '\n'))
+	}
+	if err != nil {
+		log.Printf("saving search index: %v", err)
+	}
+}
+
+func (index *searchIndex) putBook(book Book) {
+	index.update(searchChange{Kind: searchBook, ID: book.ID, Text: book.Title})
+}
+
+func (index *searchIndex) putAuthor(author Author) {
+	index.update(searchChange{Kind: searchAuthor, ID: author.ID, Text: author.Name})
+}
+
+func (index *searchIndex) remove(kind string, id int) {
+	index.update(searchChange{Kind: kind, ID: id, Removed: true})
+}
+
+func (index *searchIndex) search(q string, kinds []string) []SearchResult {
+	index.mu.RLock()
+	defer index.mu.RUnlock()
+
+	return index.data.search(q, kinds)
+}
+
+// search answers GET /search?q= with the books and authors that match q,
+// best first. Authors are only searched for callers allowed to read them,
+// and type limits the search to books or authors. facets adds the facet
+// counts of every book found, not just those on the page.
+func (s *server) search(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	opts, errs := parsePageRange(query, s.maxPageSize)
+	q := query.Get("q")
+	if strings.TrimSpace(q) == "" {
+		errs = append(errs, FieldError{"q", "is required"})
+	}
+
+	kinds := []string{searchBook}
+	principal, _ := principalFromContext(r.Context())
+	if s.allowed(principal, permReadAuthors) {
+		kinds = append(kinds, searchAuthor)
+	}
+	switch kind := query.Get("type"); kind {
+	case "":
+	case searchBook, searchAuthor:
+		if !slices.Contains(kinds, kind) {
+			challenge(w, r, http.StatusForbidden, "insufficient_scope", "", permReadAuthors)
+			return
+		}
+		kinds = []string{kind}
+	default:
+		errs = append(errs, FieldError{"type", "must be book or author"})
+	}
+	var facetNames []string
+	if query.Has("facets") {
+		var facetErrs []FieldError
+		facetNames, facetErrs = parseFacets(query.Get("facets"))
+		errs = append(errs, facetErrs...)
+	}
+	if len(errs) > 0 {
+		invalidParameters(w, r, errs...)
+		return
+	}
+
+	results := s.searchIndex.search(q, kinds)
+	var facets Facets
+	if facetNames != nil {
+		var err error
+		if facets, err = s.searchFacets(r.Context(), facetNames, results); err != nil {
+			internalError(w, r, err)
+			return
+		}
+	}
+	total := len(results)
+	results = results[min(opts.Offset, total):]
+	results = results[:min(opts.Limit, len(results))]
+
+	w.Header().Set("X-Total-Count", strconv.Itoa(total))
+	w.Header().Set("Content-Type", "application/json")
+	if facets != nil {
+		json.NewEncoder(w).Encode(facetedPage[SearchResult]{results, facets})
+		return
+	}
+	json.NewEncoder(w).Encode(results)
+}
+
+// runReindex rebuilds the search index file at path from the store. The
+// server saves its own index over it, so it is meant to run while the
+// server is stopped.
+func runReindex(ctx context.Context, store Store, path string, out io.Writer) error {
+	if path == "" {
+		return errors.New("reindex requires search_index to be set")
+	}
+
+	data, err := buildSearchData(ctx, store)
+	if err != nil {
+		return err
+	}
+	if err := saveSearchData(path, data); err != nil {
+		return err
+	}
+	// The file now holds every logged change
+	if err := os.Remove(searchLogPath(path)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+
+	books, authors := 0, 0
+	for key := range data.Texts {
+		if key.Kind == searchBook {
+			books++
+		} else {
+			authors++
+		}
+	}
+	fmt.Fprintf(out, "indexed %d books and %d authors in %s\n", books, authors, path)
+	return nil
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// newSearchTestServer returns a test server whose index holds these books
+// and authors besides the seeded ones
+func newSearchTestServer(t *testing.T, cfg Config) *server {
+	s := newTestServerWith(t, cfg)
+	for _, title := range []string{
+		"The Lord of the Rings",
+		"The Ring of the Lord",
+		"Running with Scissors",
+		"The Hobbit",
+		"Rings, Rings and More Rings: A Collector's Guide to Rings",
+	} {
+		if rr := serveJSON(t, s, "POST", "/books", map[string]string{"title": title}); rr.Code != http.StatusOK {
+			t.Fatalf("POST /books: got %d, expected %d", rr.Code, http.StatusOK)
+		}
+	}
+	if rr := serveJSON(t, s, "POST", "/authors", map[string]string{"name": "J. R. R. Tolkien"}); rr.Code != http.StatusOK {
+		t.Fatalf("POST /authors: got %d, expected %d", rr.Code, http.StatusOK)
+	}
+	return s
+}
+
+// search runs a search and returns its results as "type id" strings
+func search(t *testing.T, s *server, q string) []string {
+	t.Helper()
+
+	rr := serveJSON(t, s, "GET", "/search?q="+url.QueryEscape(q), nil)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("GET /search?q=%s: got %d, expected %d", q, rr.Code, http.StatusOK)
+	}
+	var results []SearchResult
+	if err := json.NewDecoder(rr.Body).Decode(&results); err != nil {
+		t.Fatal(err)
+	}
+	found := []string{}
+	for _, result := range results {
+		found = append(found, result.Type+" "+strconv.Itoa(result.ID))
+	}
+	return found
+}
+
+func TestSearch(t *testing.T) {
+	s := newSearchTestServer(t, testConfig)
+
+	tests := []struct {
+		q     string
+		found string
+	}{
+		// The title that is mostly about rings comes first
+		{"rings", "book 7, book 3, book 4"},
+		{"ring", "book 7, book 3, book 4"},
+		{"run", "book 5"},
+		{`"lord of the rings"`, "book 3"},
+		{`"the lord" ring`, "book 3, book 4"},
+		{"hobit", "book 6"},
+		{"tolkein", "author 2"},
+		{"jane", "author 1"},
+		{"first book", "book 1"},
+		{"ring hobbit", ""},
+		{"!!!", ""},
+	}
+	for _, test := range tests {
+		if found := strings.Join(search(t, s, test.q), ", "); found != test.found {
+			t.Errorf("search %s: found %q, expected %q", test.q, found, test.found)
+		}
+	}
+}
+
+func TestSearchVariants(t *testing.T) {
+	data := newSearchData()
+	for i, text := range []string{
+		"tolkien tolkein tolkin toklien tolkiens kelvin",
+		"hobbit hobbits habit hobit orbit rabbit",
+		"aaaa aaab baaa abab bbbb",
+		"mississippi missisippi misisipi",
+	} {
+		data.put(searchKey{searchBook, i}, text)
+	}
+
+	// Matching only terms with letter pairs in common finds every term
+	// comparing all of them would
+	for _, term := range []string{"tolkien", "hobbit", "aaaa", "abba", "mississippi", "misisippi", "kelvin", "xyzw"} {
+		expected := make(map[string]float64)
+		if _, ok := data.Postings[term]; ok {
+			expected[term] = 1
+		}
+		for indexed := range data.Postings {
+			if n := editDistance([]rune(term), []rune(indexed)); indexed != term && n <= maxTypos(term) {
+				expected[indexed] = 1 / float64(1+n)
+			}
+		}
+		if variants := data.variants(term); !maps.Equal(variants, expected) {
+			t.Errorf("variants of %s: got %v, expected %v", term, variants, expected)
+		}
+	}
+}
+
+func TestSearchFollowsWrites(t *testing.T) {
+	s := newSearchTestServer(t, testConfig)
+
+	serveJSON(t, s, "PUT", "/books/6", map[string]string{"title": "There and Back Again"})
+	if found := search(t, s, "hobbit"); len(found) != 0 {
+		t.Errorf("found the old title: %v", found)
+	}
+	if found := search(t, s, "again"); len(found) != 1 || found[0] != "book 6" {
+		t.Errorf("didn't find the new title: %v", found)
+	}
+
+	serveJSON(t, s, "DELETE", "/books/5", nil)
+	serveJSON(t, s, "DELETE", "/authors/2", nil)
+	if found := search(t, s, "running tolkien"); len(found) != 0 {
+		t.Errorf("found deleted documents: %v", found)
+	}
+}
+
+func TestSearchParameters(t *testing.T) {
+	cfg := testConfig
+	cfg.Roles = Roles{roleAdmin: {"*"}, "shelver": {permReadBooks}}
+	s := newSearchTestServer(t, cfg)
+
+	for _, target := range []string{"/search", "/search?q=+", "/search?q=ring&type=magazine", "/search?q=ring&limit=0"} {
+		decodeProblem(t, serveJSON(t, s, "GET", target, nil), http.StatusBadRequest, problemValidation)
+	}
+
+	rr := serveJSON(t, s, "GET", "/search?q=ring&limit=1&offset=1", nil)
+	var results []SearchResult
+	if err := json.NewDecoder(rr.Body).Decode(&results); err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 1 || results[0].ID != 3 || rr.Header().Get("X-Total-Count") != "3" {
+		t.Errorf("got %+v of %s, expected book 3 of 3", results, rr.Header().Get("X-Total-Count"))
+	}
+
+	// Authors are only found by callers who can read them
+	asShelver := func(target string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", target, nil)
+		authorizeAs(t, req, "shelver", "shelver")
+		rr := httptest.NewRecorder()
+		s.ServeHTTP(rr, req)
+		return rr
+	}
+	if rr := asShelver("/search?q=tolkien"); strings.TrimSpace(rr.Body.String()) != "[]" {
+		t.Errorf("search as shelver: got %s, expected no results", rr.Body)
+	}
+	if rr := asShelver("/search?q=tolkien&type=author"); rr.Code != http.StatusForbidden {
+		t.Errorf("search for authors as shelver: got %d, expected %d", rr.Code, http.StatusForbidden)
+	}
+}
+
+func TestSearchIndexFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "search.index")
+	cfg := testConfig
+	cfg.SearchIndex = path
+	s := newSearchTestServer(t, cfg)
+
+	// A new server loads the index rather than building it from its store
+	index, err := openSearchIndex(context.Background(), path, newMemoryStore())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if results := index.search("hobbit", []string{searchBook}); len(results) != 1 {
+		t.Errorf("loaded index found %+v, expected The Hobbit", results)
+	}
+
+	// Changes are logged next to the file, and a change a crash cut short
+	// is skipped
+	serveJSON(t, s, "PUT", "/books/6", map[string]string{"title": "There and Back Again"})
+	f, err := os.OpenFile(searchLogPath(path), os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString(`{"kind":"book","id":3,"rem`)
+	f.Close()
+	index, err = openSearchIndex(context.Background(), path, newMemoryStore())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if results := index.search("again", []string{searchBook}); len(results) != 1 || results[0].ID != 6 {
+		t.Errorf("index replaying the log found %+v, expected book 6", results)
+	}
+	if results := index.search("lord", []string{searchBook}); len(results) != 2 {
+		t.Errorf("index replaying the log found %+v, expected books 3 and 4", results)
+	}
+
+	var out bytes.Buffer
+	if err := runReindex(context.Background(), s.store, path, &out); err != nil {
+		t.Fatal(err)
+	}
+	if out.String() != "indexed 7 books and 2 authors in "+path+"\n" {
+		t.Errorf("reindex printed %q", out.String())
+	}
+	if _, err := os.Stat(searchLogPath(path)); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("expected reindex to remove the log, got %v", err)
+	}
+	if err := runReindex(context.Background(), s.store, "", &out); err == nil {
+		t.Error("reindex without search_index succeeded")
+	}
+}
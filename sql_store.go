@@ -0,0 +1,910 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/lib/pq"
+	"modernc.org/sqlite"
+	sqlite3 "modernc.org/sqlite/lib"
+)
+
+// dialect identifies the SQL flavour spoken by the database behind a sqlStore.
+type dialect int
+
+const (
+	dialectMySQL dialect = iota
+	dialectSQLite
+	dialectPostgres
+)
+
+// sqlStore is a Store backed by a database/sql connection. Queries are
+// written with ? placeholders and rewritten for the dialect when needed.
+type sqlStore struct {
+	db      *sql.DB
+	dialect dialect
+}
+
+// newMySQLStore opens and pings a MySQL database.
+func newMySQLStore(dsn string) (*sqlStore, error) {
+	return openSQLStore("mysql", dialectMySQL, dsn)
+}
+
+// newPostgresStore opens and pings a PostgreSQL database.
+func newPostgresStore(dsn string) (*sqlStore, error) {
+	return openSQLStore("postgres", dialectPostgres, dsn)
+}
+
+// newSQLiteStore opens and pings a SQLite database file, creating it if
+// needed. Foreign keys are switched on and a busy timeout is set for every
+// connection, and the pool is limited to a single connection because SQLite
+// only allows one writer at a time.
+func newSQLiteStore(path string) (*sqlStore, error) {
+	dsn := "file:" + path + "?_pragma=foreign_keys(1)&_pragma=busy_timeout(5000)"
+	s, err := openSQLStore("sqlite", dialectSQLite, dsn)
+	if err != nil {
+		return nil, err
+	}
+	s.db.SetMaxOpenConns(1)
+	return s, nil
+}
+
+func openSQLStore(driver string, dialect dialect, dsn string) (*sqlStore, error) {
+	db, err := sql.Open(driver, dsn)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := db.Ping(); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return &sqlStore{db: db, dialect: dialect}, nil
+}
+
+func (s *sqlStore) Close() error {
+	return s.db.Close()
+}
+
+// rebind rewrites the ? placeholders in query into the dialect's own form.
+func (s *sqlStore) rebind(query string) string {
+	if s.dialect != dialectPostgres {
+		return query
+	}
+
+	var b strings.Builder
+	n := 0
+	for _, c := range query {
+		if c == '?' {
+			n++
+			b.WriteString("$" + strconv.Itoa(n))
+			continue
+		}
+		b.WriteRune(c)
+	}
+	return b.String()
+}
+
+func (s *sqlStore) query(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error) {
+	return s.db.QueryContext(ctx, s.rebind(query), args...)
+}
+
+func (s *sqlStore) queryRow(ctx context.Context, query string, args ...interface{}) *sql.Row {
+	return s.db.QueryRowContext(ctx, s.rebind(query), args...)
+}
+
+func (s *sqlStore) exec(ctx context.Context, query string, args ...interface{}) (sql.Result, error) {
+	return s.db.ExecContext(ctx, s.rebind(query), args...)
+}
+
+// exists runs a SELECT EXISTS query. MySQL and SQLite return the result as
+// an integer rather than a boolean; database/sql converts 0 and 1 to bool.
+func (s *sqlStore) exists(ctx context.Context, query string, id int) (bool, error) {
+	var exists bool
+	err := s.queryRow(ctx, query, id).Scan(&exists)
+	return exists, err
+}
+
+// insert runs an INSERT statement and returns the value generated for
+// idColumn. PostgreSQL drivers don't support LastInsertId, so the ID is read
+// back with RETURNING instead.
+func (s *sqlStore) insert(ctx context.Context, idColumn, query string, args ...interface{}) (int, error) {
+	if s.dialect == dialectPostgres {
+		var ID int
+		err := s.queryRow(ctx, query+" RETURNING "+idColumn, args...).Scan(&ID)
+		return ID, err
+	}
+
+	result, err := s.exec(ctx, query, args...)
+	if err != nil {
+		return 0, err
+	}
+
+	ID, err := result.LastInsertId()
+	if err != nil {
+		return 0, err
+	}
+	return int(ID), nil
+}
+
+// list runs a SELECT of the page opts of table and returns the number of
+// rows that pass its filters. column gives the SQL expression of the fields
+// opts uses, which must have been checked; values are always passed as
+// arguments.
+func (s *sqlStore) list(ctx context.Context, table, columns string, fields sqlFields, opts ListOptions, scan func(*sql.Rows) error) (int, error) {
+	conds, args := filterConditions(fields, opts.Filters)
+	var total int
+	if err := s.queryRow(ctx, "SELECT COUNT(*) FROM "+table+whereClause(conds), args...).Scan(&total); err != nil {
+		return 0, err
+	}
+
+	// A page before a position is read backwards from it
+	keys := append(slices.Clone(opts.Sort), SortKey{Field: "id"})
+	backward := opts.Before != nil
+	if pos := cmp.Or(opts.After, opts.Before); pos != nil {
+		cond, posArgs := positionCondition(fields.column, keys, append(slices.Clone(pos.Values), pos.ID), backward)
+		conds = append(conds, cond)
+		args = append(args, posArgs...)
+	}
+	var order []string
+	for _, key := range keys {
+		direction := " ASC"
+		if key.Desc != backward {
+			direction = " DESC"
+		}
+		order = append(order, fields.column(key.Field)+direction)
+	}
+
+	query := "SELECT " + columns + " FROM " + table + whereClause(conds) + " ORDER BY " + strings.Join(order, ", ") + " LIMIT ? OFFSET ?"
+	args = append(args, opts.Limit, opts.Offset)
+
+	rows, err := s.query(ctx, query, args...)
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		if err := scan(rows); err != nil {
+			return 0, err
+		}
+	}
+	return total, rows.Err()
+}
+
+func whereClause(conds []string) string {
+	if len(conds) == 0 {
+		return ""
+	}
+	return " WHERE " + strings.Join(conds, " AND ")
+}
+
+// comparisons are the SQL operators of the range filters
+var comparisons = map[string]string{opGt: ">", opGte: ">=", opLt: "<", opLte: "<="}
+
+// sqlFields are the fields of a table that lists filter and sort by
+type sqlFields interface {
+	column(name string) string
+	// subquery returns the query that selects the IDs of the rows with a
+	// value of a field held in another table, or "" for a column of the
+	// table itself
+	subquery(name string) string
+}
+
+// filterConditions compiles filters into SQL conditions and their
+// arguments. Prefixes are matched case-insensitively with LIKE, escaping
+// its wildcards with "!".
+func filterConditions(fields sqlFields, filters []Filter) ([]string, []interface{}) {
+	var conds []string
+	var args []interface{}
+	for _, filter := range filters {
+		col := fields.column(filter.Field)
+		var cond string
+		switch filter.Op {
+		case opEq:
+			cond = col + " = ?"
+		case opIn:
+			cond = col + " IN (?" + strings.Repeat(", ?", len(filter.Values)-1) + ")"
+		case opPrefix:
+			cond = "LOWER(" + col + ") LIKE LOWER(?) ESCAPE '!'"
+		default:
+			cond = col + " " + comparisons[filter.Op] + " ?"
+			if _, text := filter.Values[0].(string); text {
+				cond = col + " <> '' AND " + cond
+			}
+		}
+		if subquery := fields.subquery(filter.Field); subquery != "" {
+			cond = "id IN (" + subquery + " WHERE " + cond + ")"
+		}
+		conds = append(conds, cond)
+
+		if filter.Op == opPrefix {
+			args = append(args, likeEscaper.Replace(filter.Values[0].(string))+"%")
+		} else {
+			args = append(args, filter.Values...)
+		}
+	}
+	return conds, args
+}
+
+var likeEscaper = strings.NewReplacer("!", "!!", "%", "!%", "_", "!_")
+
+// positionCondition compiles the condition for rows after the position
+// with values in the order of keys, or before it when backward is set. It
+// is (k1 > v1) OR (k1 = v1 AND k2 > v2) and so on, with < for descending
+// keys.
+func positionCondition(column func(string) string, keys []SortKey, values []any, backward bool) (string, []interface{}) {
+	var ors []string
+	var args []interface{}
+	for i, key := range keys {
+		var ands []string
+		for j := range i {
+			ands = append(ands, column(keys[j].Field)+" = ?")
+			args = append(args, values[j])
+		}
+		op := " > ?"
+		if key.Desc != backward {
+			op = " < ?"
+		}
+		ands = append(ands, column(key.Field)+op)
+		args = append(args, values[i])
+		ors = append(ors, "("+strings.Join(ands, " AND ")+")")
+	}
+	return "(" + strings.Join(ors, " OR ") + ")", args
+}
+
+// updatedRow returns ErrNotFound when an UPDATE matched no row. MySQL only
+// counts the rows an UPDATE actually changed, so when nothing was affected
+// existsQuery tells a missing row from an unchanged one.
+func (s *sqlStore) updatedRow(ctx context.Context, result sql.Result, existsQuery string, id int) error {
+	n, err := result.RowsAffected()
+	if err != nil || n > 0 {
+		return err
+	}
+
+	exists, err := s.exists(ctx, existsQuery, id)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// deleteRow runs a DELETE of the row with id, returning ErrNotFound when
+// there was none
+func (s *sqlStore) deleteRow(ctx context.Context, query string, id int) error {
+	result, err := s.exec(ctx, query, id)
+	if err != nil {
+		return err
+	}
+
+	n, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// uniqueConflict turns the unique constraint violation of each driver into
+// ErrConflict and returns other errors unchanged.
+func uniqueConflict(err error) error {
+	var (
+		mysqlErr    *mysql.MySQLError
+		postgresErr *pq.Error
+		sqliteErr   *sqlite.Error
+	)
+	switch {
+	case errors.As(err, &mysqlErr) && mysqlErr.Number == 1062,
+		errors.As(err, &postgresErr) && postgresErr.Code == "23505",
+		errors.As(err, &sqliteErr) && sqliteErr.Code() == sqlite3.SQLITE_CONSTRAINT_UNIQUE:
+		return fmt.Errorf("%w: %v", ErrConflict, err)
+	}
+	return err
+}
+
+func (s *sqlStore) AllBooks(ctx context.Context) ([]Book, error) {
+	rows, err := s.query(ctx, "SELECT id, title, published_year, isbn, language, genre FROM books")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	books := []Book{}
+	for rows.Next() {
+		var book Book
+		if err := rows.Scan(&book.ID, &book.Title, &book.PublishedYear, &book.ISBN, &book.Language, &book.Genre); err != nil {
+			return nil, err
+		}
+		books = append(books, book)
+	}
+	return books, rows.Err()
+}
+
+func (s *sqlStore) getBook(ctx context.Context, where string, arg interface{}) (Book, error) {
+	var book Book
+	err := s.queryRow(ctx, "SELECT id, title, published_year, isbn, language, genre FROM books WHERE "+where+" = ?", arg).Scan(&book.ID, &book.Title, &book.PublishedYear, &book.ISBN, &book.Language, &book.Genre)
+	if errors.Is(err, sql.ErrNoRows) {
+		return book, ErrNotFound
+	}
+	return book, err
+}
+
+func (s *sqlStore) ListBooks(ctx context.Context, opts ListOptions) ([]Book, int, error) {
+	if err := bookFields.check(opts); err != nil {
+		return nil, 0, err
+	}
+	return s.listBooks(ctx, bookFields, opts)
+}
+
+func (s *sqlStore) listBooks(ctx context.Context, fields listFields[Book], opts ListOptions) ([]Book, int, error) {
+	books := []Book{}
+	total, err := s.list(ctx, "books", "id, title, published_year, isbn, language, genre", fields, opts, func(rows *sql.Rows) error {
+		var book Book
+		if err := rows.Scan(&book.ID, &book.Title, &book.PublishedYear, &book.ISBN, &book.Language, &book.Genre); err != nil {
+			return err
+		}
+		books = append(books, book)
+		return nil
+	})
+	if opts.Before != nil {
+		slices.Reverse(books)
+	}
+	return books, total, err
+}
+
+// bookFacetColumns are the SQL expressions of the facets held in the books
+// table. Decades are counted by the first three digits of their years,
+// and like decade only for years of four digits.
+var bookFacetColumns = map[string]string{
+	facetYear:     "published_year",
+	facetDecade:   "CASE WHEN LENGTH(published_year) = 4 THEN SUBSTR(published_year, 1, 3) ELSE '' END",
+	facetLanguage: "language",
+	facetGenre:    "genre",
+}
+
+// BookFacets runs a GROUP BY query per facet over the books that pass
+// filters. Author countries are counted over author_books, once per book
+// whatever the number of its authors from a country.
+func (s *sqlStore) BookFacets(ctx context.Context, names []string, filters []Filter) (Facets, error) {
+	if err := bookFields.check(ListOptions{Filters: filters}); err != nil {
+		return nil, err
+	}
+	conds, args := filterConditions(bookFields, filters)
+
+	facets := make(Facets)
+	for _, name := range names {
+		var query string
+		if name == facetAuthorCountry {
+			query = "SELECT a.country, COUNT(DISTINCT ab.book_id) FROM author_books ab JOIN authors a ON a.id = ab.author_id" +
+				" WHERE a.country <> '' AND ab.book_id IN (SELECT id FROM books" + whereClause(conds) + ") GROUP BY a.country"
+		} else {
+			col, ok := bookFacetColumns[name]
+			if !ok {
+				return nil, fmt.Errorf("can't count books by %q", name)
+			}
+			query = "SELECT " + col + ", COUNT(*) FROM books" + whereClause(append(slices.Clone(conds), col+" <> ''")) + " GROUP BY " + col
+		}
+
+		counts, err := s.facetCounts(ctx, query, args...)
+		if err != nil {
+			return nil, err
+		}
+		if name == facetDecade {
+			decades := make(map[string]int, len(counts))
+			for prefix, count := range counts {
+				decades[prefix+"0s"] = count
+			}
+			counts = decades
+		}
+		facets[name] = facetCounts(name, counts)
+	}
+	return facets, nil
+}
+
+// facetCounts reads the values and counts a facet query selects
+func (s *sqlStore) facetCounts(ctx context.Context, query string, args ...interface{}) (map[string]int, error) {
+	rows, err := s.query(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	counts := make(map[string]int)
+	for rows.Next() {
+		var value string
+		var count int
+		if err := rows.Scan(&value, &count); err != nil {
+			return nil, err
+		}
+		counts[value] = count
+	}
+	return counts, rows.Err()
+}
+
+func (s *sqlStore) GetBook(ctx context.Context, id int) (Book, error) {
+	return s.getBook(ctx, "id", id)
+}
+
+func (s *sqlStore) GetBookByISBN(ctx context.Context, isbn ISBN) (Book, error) {
+	return s.getBook(ctx, "isbn", isbn)
+}
+
+func (s *sqlStore) CreateBook(ctx context.Context, book *Book) error {
+	ID, err := s.insert(ctx, "id", "INSERT INTO books (title, published_year, isbn, language, genre) VALUES (?, ?, ?, ?, ?)", book.Title, book.PublishedYear, book.ISBN, book.Language, book.Genre)
+	if err != nil {
+		return uniqueConflict(err)
+	}
+	book.ID = ID
+	return nil
+}
+
+func (s *sqlStore) UpdateBook(ctx context.Context, book *Book) error {
+	result, err := s.exec(ctx, "UPDATE books SET title = ?, published_year = ?, isbn = ?, language = ?, genre = ? WHERE id = ?", book.Title, book.PublishedYear, book.ISBN, book.Language, book.Genre, book.ID)
+	if err != nil {
+		return uniqueConflict(err)
+	}
+	return s.updatedRow(ctx, result, "SELECT EXISTS(SELECT 1 FROM books WHERE id = ?)", book.ID)
+}
+
+func (s *sqlStore) DeleteBook(ctx context.Context, id int) error {
+	return s.deleteRow(ctx, "DELETE FROM books WHERE id = ?", id)
+}
+
+func (s *sqlStore) BookExists(ctx context.Context, id int) (bool, error) {
+	return s.exists(ctx, "SELECT EXISTS(SELECT 1 FROM books WHERE id = ?)", id)
+}
+
+func (s *sqlStore) AllAuthors(ctx context.Context) ([]Author, error) {
+	rows, err := s.query(ctx, "SELECT id, name, country FROM authors")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	authors := []Author{}
+	for rows.Next() {
+		var author Author
+		if err := rows.Scan(&author.ID, &author.Name, &author.Country); err != nil {
+			return nil, err
+		}
+		authors = append(authors, author)
+	}
+	return authors, rows.Err()
+}
+
+func (s *sqlStore) ListAuthors(ctx context.Context, opts ListOptions) ([]Author, int, error) {
+	if err := authorFields.check(opts); err != nil {
+		return nil, 0, err
+	}
+	return s.listAuthors(ctx, authorFields, opts)
+}
+
+func (s *sqlStore) listAuthors(ctx context.Context, fields listFields[Author], opts ListOptions) ([]Author, int, error) {
+	authors := []Author{}
+	total, err := s.list(ctx, "authors", "id, name, country", fields, opts, func(rows *sql.Rows) error {
+		var author Author
+		if err := rows.Scan(&author.ID, &author.Name, &author.Country); err != nil {
+			return err
+		}
+		authors = append(authors, author)
+		return nil
+	})
+	if opts.Before != nil {
+		slices.Reverse(authors)
+	}
+	return authors, total, err
+}
+
+func (s *sqlStore) GetAuthor(ctx context.Context, id int) (Author, error) {
+	var author Author
+	err := s.queryRow(ctx, "SELECT id, name, country FROM authors WHERE id = ?", id).Scan(&author.ID, &author.Name, &author.Country)
+	if errors.Is(err, sql.ErrNoRows) {
+		return author, ErrNotFound
+	}
+	return author, err
+}
+
+func (s *sqlStore) CreateAuthor(ctx context.Context, author *Author) error {
+	ID, err := s.insert(ctx, "id", "INSERT INTO authors (name, country) VALUES (?, ?)", author.Name, author.Country)
+	if err != nil {
+		return err
+	}
+	author.ID = ID
+	return nil
+}
+
+func (s *sqlStore) UpdateAuthor(ctx context.Context, author *Author) error {
+	result, err := s.exec(ctx, "UPDATE authors SET name = ?, country = ? WHERE id = ?", author.Name, author.Country, author.ID)
+	if err != nil {
+		return err
+	}
+	return s.updatedRow(ctx, result, "SELECT EXISTS(SELECT 1 FROM authors WHERE id = ?)", author.ID)
+}
+
+func (s *sqlStore) DeleteAuthor(ctx context.Context, id int) error {
+	return s.deleteRow(ctx, "DELETE FROM authors WHERE id = ?", id)
+}
+
+func (s *sqlStore) AuthorExists(ctx context.Context, id int) (bool, error) {
+	return s.exists(ctx, "SELECT EXISTS(SELECT 1 FROM authors WHERE id = ?)", id)
+}
+
+func (s *sqlStore) GetAuthorBook(ctx context.Context, id int) (AuthorBook, error) {
+	var authorBook AuthorBook
+	err := s.queryRow(ctx, "SELECT author_book_id, author_id, book_id FROM author_books WHERE author_book_id = ?", id).Scan(&authorBook.AuthorBookID, &authorBook.AuthorID, &authorBook.BookID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return authorBook, ErrNotFound
+	}
+	return authorBook, err
+}
+
+func (s *sqlStore) CreateAuthorBook(ctx context.Context, authorBook *AuthorBook) error {
+	ID, err := s.insert(ctx, "author_book_id", "INSERT INTO author_books (author_id, book_id) VALUES (?, ?)", authorBook.AuthorID, authorBook.BookID)
+	if err != nil {
+		return uniqueConflict(err)
+	}
+	authorBook.AuthorBookID = ID
+	return nil
+}
+
+func (s *sqlStore) UpdateAuthorBook(ctx context.Context, authorBook *AuthorBook) error {
+	result, err := s.exec(ctx, "UPDATE author_books SET author_id = ?, book_id = ? WHERE author_book_id = ?", authorBook.AuthorID, authorBook.BookID, authorBook.AuthorBookID)
+	if err != nil {
+		return uniqueConflict(err)
+	}
+	return s.updatedRow(ctx, result, "SELECT EXISTS(SELECT 1 FROM author_books WHERE author_book_id = ?)", authorBook.AuthorBookID)
+}
+
+func (s *sqlStore) DeleteAuthorBook(ctx context.Context, id int) error {
+	return s.deleteRow(ctx, "DELETE FROM author_books WHERE author_book_id = ?", id)
+}
+
+// linkedField is the field the books of an author and the authors of a book
+// are selected by. It holds the IDs of the rows linked to through
+// author_books and isn't one clients can filter by.
+const linkedField = "linked_id"
+
+// linkedTo returns fields with linkedField, whose column and subquery
+// select by link, and opts with a filter that keeps the rows linked to id
+func linkedTo[T any](fields listFields[T], link listField[T], id int, opts ListOptions) (listFields[T], ListOptions) {
+	fields = maps.Clone(fields)
+	link.number, link.ops = true, []string{opEq}
+	fields[linkedField] = link
+	opts.Filters = append(slices.Clone(opts.Filters), Filter{Field: linkedField, Op: opEq, Values: []any{id}})
+	return fields, opts
+}
+
+func (s *sqlStore) ListBooksByAuthor(ctx context.Context, authorID int, opts ListOptions) ([]Book, int, error) {
+	if err := bookFields.check(opts); err != nil {
+		return nil, 0, err
+	}
+	fields, opts := linkedTo(bookFields, listField[Book]{column: "author_id", subquery: "SELECT book_id FROM author_books"}, authorID, opts)
+	return s.listBooks(ctx, fields, opts)
+}
+
+func (s *sqlStore) ListAuthorsOfBook(ctx context.Context, bookID int, opts ListOptions) ([]Author, int, error) {
+	if err := authorFields.check(opts); err != nil {
+		return nil, 0, err
+	}
+	fields, opts := linkedTo(authorFields, listField[Author]{column: "book_id", subquery: "SELECT author_id FROM author_books"}, bookID, opts)
+	return s.listAuthors(ctx, fields, opts)
+}
+
+// SetBookAuthors deletes the links to authors that aren't in authorIDs and
+// inserts the missing ones in a single transaction
+func (s *sqlStore) SetBookAuthors(ctx context.Context, bookID int, authorIDs []int) error {
+	exists, err := s.BookExists(ctx, bookID)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return ErrNotFound
+	}
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.QueryContext(ctx, s.rebind("SELECT author_id FROM author_books WHERE book_id = ?"), bookID)
+	if err != nil {
+		return err
+	}
+	var current []int
+	for rows.Next() {
+		var authorID int
+		if err := rows.Scan(&authorID); err != nil {
+			rows.Close()
+			return err
+		}
+		current = append(current, authorID)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, authorID := range current {
+		if slices.Contains(authorIDs, authorID) {
+			continue
+		}
+		if _, err := tx.ExecContext(ctx, s.rebind("DELETE FROM author_books WHERE book_id = ? AND author_id = ?"), bookID, authorID); err != nil {
+			return err
+		}
+	}
+	for _, authorID := range authorIDs {
+		if slices.Contains(current, authorID) {
+			continue
+		}
+		if _, err := tx.ExecContext(ctx, s.rebind("INSERT INTO author_books (author_id, book_id) VALUES (?, ?)"), authorID, bookID); err != nil {
+			return uniqueConflict(err)
+		}
+	}
+	return tx.Commit()
+}
+
+func (s *sqlStore) AllUsers(ctx context.Context) ([]User, error) {
+	rows, err := s.query(ctx, "SELECT id, username, password_hash, role, disabled FROM users")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	users := []User{}
+	for rows.Next() {
+		var user User
+		if err := rows.Scan(&user.ID, &user.Username, &user.PasswordHash, &user.Role, &user.Disabled); err != nil {
+			return nil, err
+		}
+		users = append(users, user)
+	}
+	return users, rows.Err()
+}
+
+func (s *sqlStore) getUser(ctx context.Context, where string, arg interface{}) (User, error) {
+	var user User
+	err := s.queryRow(ctx, "SELECT id, username, password_hash, role, disabled FROM users WHERE "+where+" = ?", arg).Scan(&user.ID, &user.Username, &user.PasswordHash, &user.Role, &user.Disabled)
+	if errors.Is(err, sql.ErrNoRows) {
+		return user, ErrNotFound
+	}
+	return user, err
+}
+
+func (s *sqlStore) GetUser(ctx context.Context, id int) (User, error) {
+	return s.getUser(ctx, "id", id)
+}
+
+func (s *sqlStore) GetUserByUsername(ctx context.Context, username string) (User, error) {
+	return s.getUser(ctx, "username", username)
+}
+
+func (s *sqlStore) CreateUser(ctx context.Context, user *User) error {
+	ID, err := s.insert(ctx, "id", "INSERT INTO users (username, password_hash, role, disabled) VALUES (?, ?, ?, ?)", user.Username, user.PasswordHash, user.Role, user.Disabled)
+	if err != nil {
+		return uniqueConflict(err)
+	}
+	user.ID = ID
+	return nil
+}
+
+func (s *sqlStore) UpdateUser(ctx context.Context, user *User) error {
+	result, err := s.exec(ctx, "UPDATE users SET username = ?, password_hash = ?, role = ?, disabled = ? WHERE id = ?", user.Username, user.PasswordHash, user.Role, user.Disabled, user.ID)
+	if err != nil {
+		return uniqueConflict(err)
+	}
+	return s.updatedRow(ctx, result, "SELECT EXISTS(SELECT 1 FROM users WHERE id = ?)", user.ID)
+}
+
+func (s *sqlStore) GetUserByIdentity(ctx context.Context, issuer, subject string) (User, error) {
+	var user User
+	err := s.queryRow(ctx, "SELECT u.id, u.username, u.password_hash, u.role, u.disabled FROM users u JOIN user_identities i ON i.user_id = u.id WHERE i.issuer = ? AND i.subject = ?", issuer, subject).Scan(&user.ID, &user.Username, &user.PasswordHash, &user.Role, &user.Disabled)
+	if errors.Is(err, sql.ErrNoRows) {
+		return user, ErrNotFound
+	}
+	return user, err
+}
+
+func (s *sqlStore) LinkIdentity(ctx context.Context, identity Identity) error {
+	_, err := s.exec(ctx, "INSERT INTO user_identities (user_id, issuer, subject) VALUES (?, ?, ?)", identity.UserID, identity.Issuer, identity.Subject)
+	return uniqueConflict(err)
+}
+
+func (s *sqlStore) CreateRefreshToken(ctx context.Context, token *RefreshToken) error {
+	ID, err := s.insert(ctx, "id", "INSERT INTO refresh_tokens (user_id, token_hash, expires_at, revoked) VALUES (?, ?, ?, ?)", token.UserID, token.TokenHash, token.ExpiresAt, token.Revoked)
+	if err != nil {
+		return err
+	}
+	token.ID = ID
+	return nil
+}
+
+func (s *sqlStore) GetRefreshToken(ctx context.Context, tokenHash string) (RefreshToken, error) {
+	var token RefreshToken
+	err := s.queryRow(ctx, "SELECT id, user_id, token_hash, expires_at, revoked FROM refresh_tokens WHERE token_hash = ?", tokenHash).Scan(&token.ID, &token.UserID, &token.TokenHash, &token.ExpiresAt, &token.Revoked)
+	if errors.Is(err, sql.ErrNoRows) {
+		return token, ErrNotFound
+	}
+	return token, err
+}
+
+func (s *sqlStore) RevokeRefreshToken(ctx context.Context, id int) error {
+	result, err := s.exec(ctx, "UPDATE refresh_tokens SET revoked = ? WHERE id = ? AND revoked = ?", true, id, false)
+	if err != nil {
+		return err
+	}
+
+	n, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (s *sqlStore) RevokeUserRefreshTokens(ctx context.Context, userID int) error {
+	_, err := s.exec(ctx, "UPDATE refresh_tokens SET revoked = ? WHERE user_id = ?", true, userID)
+	return err
+}
+
+func (s *sqlStore) RevokeToken(ctx context.Context, jti string, expiresAt int64) error {
+	// Entries for tokens that have expired anyway are no longer needed
+	if _, err := s.exec(ctx, "DELETE FROM revoked_tokens WHERE expires_at < ?", time.Now().Unix()); err != nil {
+		return err
+	}
+
+	_, err := s.exec(ctx, "INSERT INTO revoked_tokens (jti, expires_at) VALUES (?, ?)", jti, expiresAt)
+	return err
+}
+
+func (s *sqlStore) IsTokenRevoked(ctx context.Context, jti string) (bool, error) {
+	var revoked bool
+	err := s.queryRow(ctx, "SELECT EXISTS(SELECT 1 FROM revoked_tokens WHERE jti = ?)", jti).Scan(&revoked)
+	return revoked, err
+}
+
+// scanAPIKey reads a row of apiKeyColumns. Scopes are stored space-separated
+// in a single column and times as Unix seconds.
+func (s *sqlStore) scanAPIKey(row interface{ Scan(...interface{}) error }) (APIKey, error) {
+	var (
+		key       APIKey
+		scopes    string
+		createdAt int64
+		lastUsed  sql.NullInt64
+	)
+	err := row.Scan(&key.ID, &key.Name, &key.Prefix, &key.KeyHash, &scopes, &key.DailyQuota, &key.CreatedBy, &createdAt, &lastUsed, &key.Revoked)
+	if err != nil {
+		return key, err
+	}
+
+	key.Scopes = strings.Fields(scopes)
+	key.CreatedAt = time.Unix(createdAt, 0).UTC()
+	if lastUsed.Valid {
+		usedAt := time.Unix(lastUsed.Int64, 0).UTC()
+		key.LastUsedAt = &usedAt
+	}
+	return key, nil
+}
+
+const apiKeyColumns = "id, name, key_prefix, key_hash, scopes, daily_quota, created_by, created_at, last_used_at, revoked"
+
+func (s *sqlStore) AllAPIKeys(ctx context.Context) ([]APIKey, error) {
+	rows, err := s.query(ctx, "SELECT "+apiKeyColumns+" FROM api_keys ORDER BY id")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	keys := []APIKey{}
+	for rows.Next() {
+		key, err := s.scanAPIKey(rows)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	return keys, rows.Err()
+}
+
+func (s *sqlStore) GetAPIKeyByHash(ctx context.Context, keyHash string) (APIKey, error) {
+	key, err := s.scanAPIKey(s.queryRow(ctx, "SELECT "+apiKeyColumns+" FROM api_keys WHERE key_hash = ?", keyHash))
+	if errors.Is(err, sql.ErrNoRows) {
+		return key, ErrNotFound
+	}
+	return key, err
+}
+
+func (s *sqlStore) CreateAPIKey(ctx context.Context, key *APIKey) error {
+	ID, err := s.insert(ctx, "id", "INSERT INTO api_keys (name, key_prefix, key_hash, scopes, daily_quota, created_by, created_at, revoked) VALUES (?, ?, ?, ?, ?, ?, ?, ?)",
+		key.Name, key.Prefix, key.KeyHash, strings.Join(key.Scopes, " "), key.DailyQuota, key.CreatedBy, key.CreatedAt.Unix(), key.Revoked)
+	if err != nil {
+		return err
+	}
+	key.ID = ID
+	return nil
+}
+
+func (s *sqlStore) RevokeAPIKey(ctx context.Context, id int) error {
+	result, err := s.exec(ctx, "UPDATE api_keys SET revoked = ? WHERE id = ? AND revoked = ?", true, id, false)
+	if err != nil {
+		return err
+	}
+
+	n, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (s *sqlStore) TouchAPIKey(ctx context.Context, id int, usedAt time.Time) error {
+	_, err := s.exec(ctx, "UPDATE api_keys SET last_used_at = ? WHERE id = ?", usedAt.Unix(), id)
+	return err
+}
+
+func (s *sqlStore) GetLoginFailures(ctx context.Context, key string) (LoginFailures, error) {
+	var (
+		failures                 LoginFailures
+		lastFailure, lockedUntil int64
+	)
+	err := s.queryRow(ctx, "SELECT failures, last_failure, locked_until FROM login_failures WHERE attempt_key = ?", key).Scan(&failures.Failures, &lastFailure, &lockedUntil)
+	if errors.Is(err, sql.ErrNoRows) {
+		return failures, nil
+	}
+	if err != nil {
+		return failures, err
+	}
+
+	failures.LastFailure = time.Unix(lastFailure, 0)
+	failures.LockedUntil = time.Unix(lockedUntil, 0)
+	return failures, nil
+}
+
+func (s *sqlStore) AddLoginFailure(ctx context.Context, key string, at time.Time, resetAfter time.Duration) (int, error) {
+	// MySQL assigns left to right, so failures is computed before
+	// last_failure changes
+	upsert := "ON CONFLICT (attempt_key) DO UPDATE SET"
+	if s.dialect == dialectMySQL {
+		upsert = "ON DUPLICATE KEY UPDATE"
+	}
+	_, err := s.exec(ctx, "INSERT INTO login_failures (attempt_key, failures, last_failure, locked_until) VALUES (?, 1, ?, 0) "+upsert+
+		" failures = CASE WHEN login_failures.last_failure < ? THEN 1 ELSE login_failures.failures + 1 END, last_failure = ?",
+		key, at.Unix(), at.Add(-resetAfter).Unix(), at.Unix())
+	if err != nil {
+		return 0, err
+	}
+
+	var failures int
+	err = s.queryRow(ctx, "SELECT failures FROM login_failures WHERE attempt_key = ?", key).Scan(&failures)
+	return failures, err
+}
+
+func (s *sqlStore) LockLogin(ctx context.Context, key string, until time.Time) error {
+	_, err := s.exec(ctx, "UPDATE login_failures SET locked_until = ? WHERE attempt_key = ?", until.Unix(), key)
+	return err
+}
+
+func (s *sqlStore) ClearLoginFailures(ctx context.Context, key string) error {
+	_, err := s.exec(ctx, "DELETE FROM login_failures WHERE attempt_key = ?", key)
+	return err
+}
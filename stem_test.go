@@ -0,0 +1,37 @@
+package main
+
+import "testing"
+
+func TestStem(t *testing.T) {
+	tests := map[string]string{
+		"caresses":       "caress",
+		"ponies":         "poni",
+		"cats":           "cat",
+		"agreed":         "agre",
+		"feed":           "feed",
+		"plastered":      "plaster",
+		"motoring":       "motor",
+		"sing":           "sing",
+		"conflated":      "conflat",
+		"hopping":        "hop",
+		"falling":        "fall",
+		"filing":         "file",
+		"happy":          "happi",
+		"relational":     "relat",
+		"generalization": "gener",
+		"adjustment":     "adjust",
+		"cement":         "cement",
+		"running":        "run",
+		"runs":           "run",
+		"controlling":    "control",
+		"rings":          "ring",
+		"by":             "by",
+		"café":           "café",
+		"1984":           "1984",
+	}
+	for word, expected := range tests {
+		if got := stem(word); got != expected {
+			t.Errorf("stem(%q) = %q, expected %q", word, got, expected)
+		}
+	}
+}
@@ -0,0 +1,397 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode"
+)
+
+// suggestISBN is the kind of suggestions that complete the ISBN of a book
+const suggestISBN = "isbn"
+
+// Number of suggestions returned by default and at most
+const (
+	defaultSuggestions = 10
+	maxSuggestions     = 50
+)
+
+// trieNode is a node of a radix tree, whose edges are labelled with
+// strings rather than single letters so that long titles don't need a
+// node per letter
+type trieNode struct {
+	label string
+	// children are ordered by the first byte of their labels, which
+	// differ
+	children []*trieNode
+	// entries are the documents whose key ends here, ordered by ID
+	entries []trieEntry
+}
+
+type trieEntry struct {
+	key  searchKey
+	text string
+}
+
+// child returns where the child whose label starts with b is or would be
+func (n *trieNode) child(b byte) (int, bool) {
+	return slices.BinarySearchFunc(n.children, b, func(child *trieNode, b byte) int {
+		return cmp.Compare(child.label[0], b)
+	})
+}
+
+func (n *trieNode) insert(key string, entry trieEntry) {
+	for key != "" {
+		i, found := n.child(key[0])
+		if !found {
+			n.children = slices.Insert(n.children, i, &trieNode{label: key, entries: []trieEntry{entry}})
+			return
+		}
+
+		child := n.children[i]
+		common := 0
+		for common < len(key) && common < len(child.label) && key[common] == child.label[common] {
+			common++
+		}
+		if common < len(child.label) {
+			split := &trieNode{label: child.label[:common], children: []*trieNode{child}}
+			child.label = child.label[common:]
+			n.children[i] = split
+			child = split
+		}
+		n, key = child, key[common:]
+	}
+
+	i, _ := slices.BinarySearchFunc(n.entries, entry.key.ID, func(e trieEntry, id int) int { return cmp.Compare(e.key.ID, id) })
+	n.entries = slices.Insert(n.entries, i, entry)
+}
+
+// remove removes the entry of a document from key, merging the nodes that
+// are left with a single child
+func (n *trieNode) remove(key string, doc searchKey) {
+	if key == "" {
+		n.entries = slices.DeleteFunc(n.entries, func(e trieEntry) bool { return e.key == doc })
+		return
+	}
+
+	i, found := n.child(key[0])
+	if !found || !strings.HasPrefix(key, n.children[i].label) {
+		return
+	}
+	child := n.children[i]
+	child.remove(key[len(child.label):], doc)
+
+	switch {
+	case len(child.entries) > 0:
+	case len(child.children) == 0:
+		n.children = slices.Delete(n.children, i, i+1)
+	case len(child.children) == 1:
+		grandchild := child.children[0]
+		grandchild.label = child.label + grandchild.label
+		n.children[i] = grandchild
+	}
+}
+
+// suggestion is an entry found under a prefix with the key it was found by
+type suggestion struct {
+	key   string
+	entry trieEntry
+	// later is set when the key isn't the start of the document
+	later bool
+}
+
+// complete returns up to limit entries with keys starting with prefix, in
+// the order of their keys, skipping documents that are already in seen
+func (n *trieNode) complete(prefix string, limit int, seen map[searchKey]bool) []suggestion {
+	if limit <= 0 {
+		return nil
+	}
+	path := ""
+	for rest := prefix; rest != ""; {
+		i, found := n.child(rest[0])
+		if !found {
+			return nil
+		}
+		child := n.children[i]
+		switch {
+		case strings.HasPrefix(rest, child.label):
+			rest = rest[len(child.label):]
+		case strings.HasPrefix(child.label, rest):
+			rest = ""
+		default:
+			return nil
+		}
+		path += child.label
+		n = child
+	}
+
+	var found []suggestion
+	var visit func(n *trieNode, key string) bool
+	visit = func(n *trieNode, key string) bool {
+		for _, entry := range n.entries {
+			if seen[entry.key] {
+				continue
+			}
+			seen[entry.key] = true
+			found = append(found, suggestion{key: key, entry: entry})
+			if len(found) == limit {
+				return false
+			}
+		}
+		for _, child := range n.children {
+			if !visit(child, key+child.label) {
+				return false
+			}
+		}
+		return true
+	}
+	visit(n, path)
+	return found
+}
+
+// suggestKey normalises text for prefix matching: lower case words
+// separated by single spaces
+func suggestKey(text string) string {
+	words := strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+	return strings.Join(words, " ")
+}
+
+// suggestKeys returns the keys text is found by: its key and then its key
+// from every later word on, so that "tolk" suggests "J. R. R. Tolkien"
+func suggestKeys(text string) []string {
+	var keys []string
+	key := suggestKey(text)
+	for key != "" {
+		keys = append(keys, key)
+		_, key, _ = strings.Cut(key, " ")
+	}
+	return keys
+}
+
+// isbnKeys returns the keys of an ISBN: its ISBN-13 and then its ISBN-10
+func isbnKeys(isbn ISBN) []string {
+	if isbn == "" {
+		return nil
+	}
+	keys := []string{string(isbn)}
+	if isbn10, ok := isbn.ISBN10(); ok {
+		keys = append(keys, strings.ToLower(isbn10))
+	}
+	return keys
+}
+
+// suggester completes book titles, author names and ISBNs from radix
+// trees. It is built from the store at startup and kept up to date by the
+// handlers that change books and authors.
+type suggester struct {
+	mu sync.RWMutex
+	// first holds the first key of every document by kind and later its
+	// other keys, which are suggested after documents that start with
+	// the prefix
+	first map[string]*trieNode
+	later map[string]*trieNode
+	// keys holds the keys every document was inserted with
+	keys map[string]map[searchKey][]string
+}
+
+func newSuggester() *suggester {
+	s := &suggester{
+		first: make(map[string]*trieNode),
+		later: make(map[string]*trieNode),
+		keys:  make(map[string]map[searchKey][]string),
+	}
+	for _, kind := range []string{searchBook, searchAuthor, suggestISBN} {
+		s.first[kind] = &trieNode{}
+		s.later[kind] = &trieNode{}
+		s.keys[kind] = make(map[searchKey][]string)
+	}
+	return s
+}
+
+func buildSuggester(ctx context.Context, store Store) (*suggester, error) {
+	books, err := store.AllBooks(ctx)
+	if err != nil {
+		return nil, err
+	}
+	authors, err := store.AllAuthors(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	s := newSuggester()
+	for _, book := range books {
+		s.putBook(book)
+	}
+	for _, author := range authors {
+		s.putAuthor(author)
+	}
+	return s, nil
+}
+
+// trie returns the tree of kind the i-th key of a document goes into
+func (s *suggester) trie(kind string, i int) *trieNode {
+	if i == 0 {
+		return s.first[kind]
+	}
+	return s.later[kind]
+}
+
+// put replaces the keys of a document in the trees of kind
+func (s *suggester) put(kind string, doc searchKey, text string, keys []string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i, key := range s.keys[kind][doc] {
+		s.trie(kind, i).remove(key, doc)
+	}
+	delete(s.keys[kind], doc)
+	for i, key := range keys {
+		s.trie(kind, i).insert(key, trieEntry{doc, text})
+	}
+	if len(keys) > 0 {
+		s.keys[kind][doc] = keys
+	}
+}
+
+func (s *suggester) putBook(book Book) {
+	doc := searchKey{searchBook, book.ID}
+	s.put(searchBook, doc, book.Title, suggestKeys(book.Title))
+	s.put(suggestISBN, doc, string(book.ISBN), isbnKeys(book.ISBN))
+}
+
+func (s *suggester) putAuthor(author Author) {
+	s.put(searchAuthor, searchKey{searchAuthor, author.ID}, author.Name, suggestKeys(author.Name))
+}
+
+func (s *suggester) remove(kind string, id int) {
+	doc := searchKey{kind, id}
+	s.put(kind, doc, "", nil)
+	if kind == searchBook {
+		s.put(suggestISBN, doc, "", nil)
+	}
+}
+
+// Suggestion completes what a client has typed: the title of a book, the
+// name of an author or the ISBN-13 of a book
+type Suggestion struct {
+	Type string `json:"type"`
+	ID   int    `json:"id"`
+	Text string `json:"text"`
+}
+
+// suggest returns up to limit completions of prefix of the given kinds:
+// first the documents that start with it and then those with a later word
+// that does, each ordered by the key they matched
+func (s *suggester) suggest(prefix string, kinds []string, limit int) []Suggestion {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var found []suggestion
+	for _, kind := range kinds {
+		key := suggestKey(prefix)
+		if kind == suggestISBN {
+			key = strings.ToLower(strings.NewReplacer("-", "", " ", "").Replace(prefix))
+		}
+		if key == "" {
+			continue
+		}
+
+		seen := make(map[searchKey]bool)
+		first := s.first[kind].complete(key, limit, seen)
+		later := s.later[kind].complete(key, limit-len(first), seen)
+		for i := range later {
+			later[i].later = true
+		}
+		for _, match := range slices.Concat(first, later) {
+			if kind == suggestISBN {
+				match.entry.key.Kind = suggestISBN
+			}
+			found = append(found, match)
+		}
+	}
+	slices.SortStableFunc(found, func(a, b suggestion) int {
+		switch {
+		case a.later == b.later:
+			return strings.Compare(a.key, b.key)
+		case b.later:
+			return -1
+		}
+		return 1
+	})
+
+	suggestions := []Suggestion{}
+	for _, match := range found[:min(limit, len(found))] {
+		suggestions = append(suggestions, Suggestion{Type: match.entry.key.Kind, ID: match.entry.key.ID, Text: match.entry.text})
+	}
+	return suggestions
+}
+
+// indexBook brings the search and suggestion indexes up to date with a
+// book that has been stored
+func (s *server) indexBook(book Book) {
+	s.searchIndex.putBook(book)
+	s.suggester.putBook(book)
+}
+
+func (s *server) indexAuthor(author Author) {
+	s.searchIndex.putAuthor(author)
+	s.suggester.putAuthor(author)
+}
+
+// unindex removes a deleted book or author from the indexes
+func (s *server) unindex(kind string, id int) {
+	s.searchIndex.remove(kind, id)
+	s.suggester.remove(kind, id)
+}
+
+// suggest answers GET /suggest?prefix= with book titles, author names and
+// ISBNs that start with prefix, or have a word that does. type limits the
+// suggestions to book, author or isbn; authors are only suggested to
+// callers allowed to read them.
+func (s *server) suggest(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	var errs []FieldError
+	prefix := query.Get("prefix")
+	if strings.TrimSpace(prefix) == "" {
+		errs = append(errs, FieldError{"prefix", "is required"})
+	}
+	limit := defaultSuggestions
+	if value := query.Get("limit"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 1 {
+			errs = append(errs, FieldError{"limit", "must be a positive number"})
+		}
+		limit = min(n, maxSuggestions)
+	}
+
+	kinds := []string{searchBook, suggestISBN}
+	principal, _ := principalFromContext(r.Context())
+	if s.allowed(principal, permReadAuthors) {
+		kinds = append(kinds, searchAuthor)
+	}
+	switch kind := query.Get("type"); kind {
+	case "":
+	case searchBook, searchAuthor, suggestISBN:
+		if !slices.Contains(kinds, kind) {
+			challenge(w, r, http.StatusForbidden, "insufficient_scope", "", permReadAuthors)
+			return
+		}
+		kinds = []string{kind}
+	default:
+		errs = append(errs, FieldError{"type", "must be book, author or isbn"})
+	}
+	if len(errs) > 0 {
+		invalidParameters(w, r, errs...)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.suggester.suggest(prefix, kinds, limit))
+}
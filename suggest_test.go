@@ -0,0 +1,154 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestTrie(t *testing.T) {
+	root := &trieNode{}
+	keys := []string{"romance", "romanus", "romulus", "rubens", "ruber", "rubicon", "rubicundus"}
+	for i, key := range keys {
+		root.insert(key, trieEntry{key: searchKey{searchBook, i}, text: key})
+	}
+
+	found := func(prefix string) string {
+		var texts []string
+		for _, s := range root.complete(prefix, 10, make(map[searchKey]bool)) {
+			texts = append(texts, s.entry.text)
+		}
+		return strings.Join(texts, " ")
+	}
+	if got := found("rom"); got != "romance romanus romulus" {
+		t.Errorf("complete rom: got %q", got)
+	}
+	if got := found("rubi"); got != "rubicon rubicundus" {
+		t.Errorf("complete rubi: got %q", got)
+	}
+	if got := found("x"); got != "" {
+		t.Errorf("complete x: got %q", got)
+	}
+
+	// Removing every key but one leaves a single node labelled with it
+	for i, key := range keys[1:] {
+		root.remove(key, searchKey{searchBook, i + 1})
+	}
+	if len(root.children) != 1 || root.children[0].label != "romance" || len(root.children[0].children) != 0 {
+		t.Errorf("got children %+v, expected one romance node", root.children)
+	}
+}
+
+// suggest requests suggestions and returns them as "type id text" strings
+func suggest(t *testing.T, s *server, query string) string {
+	t.Helper()
+
+	rr := serveJSON(t, s, "GET", "/suggest?"+query, nil)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("GET /suggest?%s: got %d, expected %d", query, rr.Code, http.StatusOK)
+	}
+	var suggestions []Suggestion
+	if err := json.NewDecoder(rr.Body).Decode(&suggestions); err != nil {
+		t.Fatal(err)
+	}
+	var found []string
+	for _, s := range suggestions {
+		found = append(found, fmt.Sprintf("%s %d %s", s.Type, s.ID, s.Text))
+	}
+	return strings.Join(found, ", ")
+}
+
+func TestSuggest(t *testing.T) {
+	s := newSearchTestServer(t, testConfig)
+
+	tests := []struct {
+		query string
+		found string
+	}{
+		// Titles that start with the prefix come first
+		{"prefix=the+l", "book 3 The Lord of the Rings, book 4 The Ring of the Lord"},
+		{"prefix=Lord", "book 4 The Ring of the Lord, book 3 The Lord of the Rings"},
+		{"prefix=ring&type=book", "book 7 Rings, Rings and More Rings: A Collector's Guide to Rings, book 4 The Ring of the Lord, book 3 The Lord of the Rings"},
+		{"prefix=ring&type=book&limit=1", "book 7 Rings, Rings and More Rings: A Collector's Guide to Rings"},
+		{"prefix=collector's", "book 7 Rings, Rings and More Rings: A Collector's Guide to Rings"},
+		{"prefix=tolk", "author 2 J. R. R. Tolkien"},
+		{"prefix=" + url.QueryEscape("978-1"), "isbn 1 9781111111113"},
+		{"prefix=1111&type=isbn", "isbn 1 9781111111113"},
+		{"prefix=j", "author 2 J. R. R. Tolkien, author 1 Jane Doe"},
+		{"prefix=zz", ""},
+	}
+	for _, test := range tests {
+		if found := suggest(t, s, test.query); found != test.found {
+			t.Errorf("suggest %s: got %q, expected %q", test.query, found, test.found)
+		}
+	}
+}
+
+func TestSuggestFollowsWrites(t *testing.T) {
+	s := newSearchTestServer(t, testConfig)
+
+	serveJSON(t, s, "PUT", "/books/6", map[string]string{"title": "There and Back Again", "isbn": "0-306-40615-2"})
+	if found := suggest(t, s, "prefix=hob"); found != "" {
+		t.Errorf("suggested the old title: %s", found)
+	}
+	if found := suggest(t, s, "prefix=back"); found != "book 6 There and Back Again" {
+		t.Errorf("didn't suggest the new title: %s", found)
+	}
+	if found := suggest(t, s, "prefix=0306"); found != "isbn 6 9780306406157" {
+		t.Errorf("didn't suggest the new ISBN: %s", found)
+	}
+
+	serveJSON(t, s, "DELETE", "/books/6", nil)
+	serveJSON(t, s, "DELETE", "/authors/2", nil)
+	for _, query := range []string{"prefix=back", "prefix=0306", "prefix=tolk"} {
+		if found := suggest(t, s, query); found != "" {
+			t.Errorf("suggest %s: suggested a deleted document: %s", query, found)
+		}
+	}
+}
+
+func TestSuggestParameters(t *testing.T) {
+	cfg := testConfig
+	cfg.Roles = Roles{roleAdmin: {"*"}, "shelver": {permReadBooks}}
+	s := newSearchTestServer(t, cfg)
+
+	for _, target := range []string{"/suggest", "/suggest?prefix=+", "/suggest?prefix=a&type=magazine", "/suggest?prefix=a&limit=none"} {
+		decodeProblem(t, serveJSON(t, s, "GET", target, nil), http.StatusBadRequest, problemValidation)
+	}
+
+	// Authors are only suggested to callers who can read them
+	asShelver := func(target string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", target, nil)
+		authorizeAs(t, req, "shelver", "shelver")
+		rr := httptest.NewRecorder()
+		s.ServeHTTP(rr, req)
+		return rr
+	}
+	if rr := asShelver("/suggest?prefix=j"); strings.TrimSpace(rr.Body.String()) != "[]" {
+		t.Errorf("suggest as shelver: got %s, expected no suggestions", rr.Body)
+	}
+	if rr := asShelver("/suggest?prefix=j&type=author"); rr.Code != http.StatusForbidden {
+		t.Errorf("suggest authors as shelver: got %d, expected %d", rr.Code, http.StatusForbidden)
+	}
+}
+
+// BenchmarkSuggest measures suggestions from a million titles, which
+// should take well under 10ms each
+func BenchmarkSuggest(b *testing.B) {
+	words := []string{"lord", "ring", "history", "of", "the", "garden", "night", "river", "house", "secret", "war", "peace", "little", "world", "last", "stone"}
+	s := newSuggester()
+	for i := range 1_000_000 {
+		title := fmt.Sprintf("%s %s %s %d", words[i%16], words[i/16%16], words[i/256%16], i)
+		s.putBook(Book{ID: i + 1, Title: title})
+	}
+
+	prefixes := []string{"l", "the g", "ri", "secret war", "12345"}
+	b.ResetTimer()
+	for i := 0; b.Loop(); i++ {
+		s.suggest(prefixes[i%len(prefixes)], []string{searchBook, searchAuthor, suggestISBN}, defaultSuggestions)
+	}
+}
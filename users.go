@@ -0,0 +1,266 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// User is an account allowed to log in
+type User struct {
+	ID           int    `json:"id"`
+	Username     string `json:"username"`
+	PasswordHash string `json:"-"`
+	Role         string `json:"role"`
+	Disabled     bool   `json:"disabled"`
+}
+
+// minPasswordLength is the shortest password accepted for an account
+const minPasswordLength = 8
+
+// dummyPasswordHash is compared against when a login names an unknown user,
+// so that the response time doesn't reveal which usernames exist
+var dummyPasswordHash, _ = bcrypt.GenerateFromPassword([]byte("dummy password"), bcrypt.DefaultCost)
+
+// hashPassword returns the bcrypt hash stored for password
+func hashPassword(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	return string(hash), err
+}
+
+// checkPassword reports whether password matches the stored hash
+func checkPassword(hash, password string) bool {
+	return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
+}
+
+// ensureUser creates the account username with password and role unless an
+// account with that name already exists. It is used to bootstrap the first
+// admin.
+func ensureUser(ctx context.Context, store UserStore, username, password, role string) error {
+	_, err := store.GetUserByUsername(ctx, username)
+	if !errors.Is(err, ErrNotFound) {
+		return err
+	}
+
+	hash, err := hashPassword(password)
+	if err != nil {
+		return err
+	}
+	return store.CreateUser(ctx, &User{Username: username, PasswordHash: hash, Role: role})
+}
+
+// runSetRole gives an account a role from the command line. It is how the
+// first admins of a database created before roles are promoted, since the
+// migration that added roles made every existing account a reader.
+func runSetRole(ctx context.Context, store UserStore, roles Roles, args []string, out io.Writer) error {
+	if len(args) != 2 {
+		return errors.New("usage: set-role <username> <role>")
+	}
+	username, role := args[0], args[1]
+	if _, ok := roles[role]; !ok {
+		return fmt.Errorf("role %q does not exist", role)
+	}
+
+	user, err := store.GetUserByUsername(ctx, username)
+	if errors.Is(err, ErrNotFound) {
+		return fmt.Errorf("user %q does not exist", username)
+	}
+	if err != nil {
+		return err
+	}
+	user.Role = role
+	if err := store.UpdateUser(ctx, &user); err != nil {
+		return err
+	}
+	fmt.Fprintf(out, "%s is now %s\n", username, role)
+	return nil
+}
+
+// userFromPath loads the user named by the {id} route variable, writing a
+// 404 and returning false when there is none
+func (s *server) userFromPath(w http.ResponseWriter, r *http.Request) (User, bool) {
+	id, ok := pathID(w, r)
+	if !ok {
+		return User{}, false
+	}
+
+	user, err := s.store.GetUser(r.Context(), id)
+	if errors.Is(err, ErrNotFound) {
+		writeProblem(w, r, http.StatusNotFound, problemNotFound, "User not found")
+		return user, false
+	}
+	if err != nil {
+		internalError(w, r, err)
+		return user, false
+	}
+	return user, true
+}
+
+func (s *server) getAllUsers(w http.ResponseWriter, r *http.Request) {
+	users, err := s.store.AllUsers(r.Context())
+	if err != nil {
+		internalError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(users)
+}
+
+func (s *server) createUser(w http.ResponseWriter, r *http.Request) {
+	var creds struct {
+		Username string `json:"username"`
+		Password string `json:"password"`
+		Role     string `json:"role"`
+	}
+	if !s.decodeBody(w, r, &creds) {
+		return
+	}
+
+	if creds.Username == "" {
+		invalidFields(w, r, FieldError{"username", "is required"})
+		return
+	}
+	if len(creds.Password) < minPasswordLength {
+		invalidFields(w, r, FieldError{"password", "must be at least 8 characters"})
+		return
+	}
+	if creds.Role == "" {
+		creds.Role = roleReader
+	}
+	if _, ok := s.roles[creds.Role]; !ok {
+		invalidFields(w, r, FieldError{"role", "does not exist"})
+		return
+	}
+
+	// Check if the username is taken
+	_, err := s.store.GetUserByUsername(r.Context(), creds.Username)
+	if err == nil {
+		writeProblem(w, r, http.StatusConflict, problemConflict, "Username already exists")
+		return
+	}
+	if !errors.Is(err, ErrNotFound) {
+		internalError(w, r, err)
+		return
+	}
+
+	hash, err := hashPassword(creds.Password)
+	if err != nil {
+		internalError(w, r, err)
+		return
+	}
+
+	// Another request may have taken the username since it was checked
+	user := User{Username: creds.Username, PasswordHash: hash, Role: creds.Role}
+	err = s.store.CreateUser(r.Context(), &user)
+	if errors.Is(err, ErrConflict) {
+		writeProblem(w, r, http.StatusConflict, problemConflict, "Username already exists")
+		return
+	}
+	if err != nil {
+		internalError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(user)
+}
+
+// setUserDisabled returns a handler that disables or re-enables an account
+func (s *server) setUserDisabled(disabled bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user, ok := s.userFromPath(w, r)
+		if !ok {
+			return
+		}
+
+		user.Disabled = disabled
+		err := s.store.UpdateUser(r.Context(), &user)
+		if err != nil {
+			internalError(w, r, err)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(user)
+	}
+}
+
+// setUserRole changes the role of an account. The new role takes effect the
+// next time the user logs in or refreshes their token.
+func (s *server) setUserRole(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		Role string `json:"role"`
+	}
+	if !s.decodeBody(w, r, &body) {
+		return
+	}
+
+	if _, ok := s.roles[body.Role]; !ok {
+		invalidFields(w, r, FieldError{"role", "does not exist"})
+		return
+	}
+
+	user, ok := s.userFromPath(w, r)
+	if !ok {
+		return
+	}
+
+	user.Role = body.Role
+	err := s.store.UpdateUser(r.Context(), &user)
+	if err != nil {
+		internalError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(user)
+}
+
+// changePassword sets a new password. Users may change their own password;
+// changing anyone else's requires the write:users permission.
+func (s *server) changePassword(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		Password string `json:"password"`
+	}
+	if !s.decodeBody(w, r, &body) {
+		return
+	}
+
+	if len(body.Password) < minPasswordLength {
+		invalidFields(w, r, FieldError{"password", "must be at least 8 characters"})
+		return
+	}
+
+	user, ok := s.userFromPath(w, r)
+	if !ok {
+		return
+	}
+
+	principal, _ := principalFromContext(r.Context())
+	self := principal.APIKeyID == 0 && principal.Username == user.Username
+	if !self && !s.allowed(principal, permWriteUsers) {
+		challenge(w, r, http.StatusForbidden, "insufficient_scope", "", permWriteUsers)
+		return
+	}
+
+	hash, err := hashPassword(body.Password)
+	if err != nil {
+		internalError(w, r, err)
+		return
+	}
+	user.PasswordHash = hash
+
+	err = s.store.UpdateUser(r.Context(), &user)
+	if err != nil {
+		internalError(w, r, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
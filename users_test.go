@@ -0,0 +1,202 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"github.com/golang-jwt/jwt"
+)
+
+// loginStatus posts the credentials to /login and returns the status code
+func loginStatus(t *testing.T, router http.Handler, username, password string) int {
+	return postJSON(t, router, "/login", "", map[string]string{"username": username, "password": password}).Code
+}
+
+// serveJSON sends an authorized request with an optional JSON body
+func serveJSON(t *testing.T, router http.Handler, method, url string, body interface{}) *httptest.ResponseRecorder {
+	var buf bytes.Buffer
+	if body != nil {
+		if err := json.NewEncoder(&buf).Encode(body); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	req, err := http.NewRequest(method, url, &buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	authorize(t, req)
+
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	return rr
+}
+
+func TestUserLifecycle(t *testing.T) {
+	router := newTestServer(t)
+
+	// Create a librarian account
+	rr := serveJSON(t, router, "POST", "/users", map[string]string{"username": "librarian", "password": "s3cret-pass", "role": roleLibrarian})
+	if rr.Code != http.StatusOK {
+		t.Fatalf("CreateUser handler returned wrong status code: got %d, expected %d", rr.Code, http.StatusOK)
+	}
+	var user map[string]interface{}
+	if err := json.Unmarshal(rr.Body.Bytes(), &user); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := user["password_hash"]; ok {
+		t.Error("CreateUser handler exposed the password hash")
+	}
+	id := int(user["id"].(float64))
+
+	if code := loginStatus(t, router, "librarian", "s3cret-pass"); code != http.StatusOK {
+		t.Errorf("login with the new account returned %d, expected %d", code, http.StatusOK)
+	}
+	if code := loginStatus(t, router, "librarian", "wrong-pass"); code != http.StatusUnauthorized {
+		t.Errorf("login with a wrong password returned %d, expected %d", code, http.StatusUnauthorized)
+	}
+
+	// The same username can't be taken twice
+	rr = serveJSON(t, router, "POST", "/users", map[string]string{"username": "librarian", "password": "another-pass"})
+	if rr.Code != http.StatusConflict {
+		t.Errorf("CreateUser handler returned %d for a duplicate username, expected %d", rr.Code, http.StatusConflict)
+	}
+
+	// Changing the password invalidates the old one
+	rr = serveJSON(t, router, "PUT", "/users/"+strconv.Itoa(id)+"/password", map[string]string{"password": "new-s3cret-pass"})
+	if rr.Code != http.StatusNoContent {
+		t.Fatalf("ChangePassword handler returned %d, expected %d", rr.Code, http.StatusNoContent)
+	}
+	if code := loginStatus(t, router, "librarian", "s3cret-pass"); code != http.StatusUnauthorized {
+		t.Errorf("login with the old password returned %d, expected %d", code, http.StatusUnauthorized)
+	}
+	if code := loginStatus(t, router, "librarian", "new-s3cret-pass"); code != http.StatusOK {
+		t.Errorf("login with the new password returned %d, expected %d", code, http.StatusOK)
+	}
+
+	// Disabled accounts can't log in
+	rr = serveJSON(t, router, "POST", "/users/"+strconv.Itoa(id)+"/disable", nil)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("DisableUser handler returned %d, expected %d", rr.Code, http.StatusOK)
+	}
+	if code := loginStatus(t, router, "librarian", "new-s3cret-pass"); code != http.StatusUnauthorized {
+		t.Errorf("login with a disabled account returned %d, expected %d", code, http.StatusUnauthorized)
+	}
+
+	rr = serveJSON(t, router, "GET", "/users", nil)
+	var users []User
+	if err := json.Unmarshal(rr.Body.Bytes(), &users); err != nil {
+		t.Fatal(err)
+	}
+	if len(users) != 2 || !users[1].Disabled || users[1].Role != roleLibrarian {
+		t.Errorf("GetAllUsers handler returned %+v, expected the admin and a disabled librarian", users)
+	}
+}
+
+// racingStore is a store where another request creates every username
+// between the handler's check and its insert
+type racingStore struct {
+	Store
+}
+
+func (racingStore) GetUserByUsername(ctx context.Context, username string) (User, error) {
+	return User{}, ErrNotFound
+}
+
+func (racingStore) CreateUser(ctx context.Context, user *User) error {
+	return ErrConflict
+}
+
+func TestCreateUserRace(t *testing.T) {
+	s := newTestServer(t)
+	s.store = racingStore{s.store}
+
+	rr := serveJSON(t, s, "POST", "/users", map[string]string{"username": "librarian", "password": "s3cret-pass"})
+	decodeProblem(t, rr, http.StatusConflict, problemConflict)
+}
+
+func TestCreateUserRejectsShortPassword(t *testing.T) {
+	router := newTestServer(t)
+
+	rr := serveJSON(t, router, "POST", "/users", map[string]string{"username": "librarian", "password": "short"})
+	if rr.Code != http.StatusBadRequest {
+		t.Errorf("CreateUser handler returned %d, expected %d", rr.Code, http.StatusBadRequest)
+	}
+}
+
+func TestLoginUnknownUser(t *testing.T) {
+	router := newTestServer(t)
+
+	if code := loginStatus(t, router, "nobody", "password"); code != http.StatusUnauthorized {
+		t.Errorf("login with an unknown user returned %d, expected %d", code, http.StatusUnauthorized)
+	}
+}
+
+func TestSetUserRole(t *testing.T) {
+	router := newTestServer(t)
+
+	rr := serveJSON(t, router, "POST", "/users", map[string]string{"username": "reader", "password": "s3cret-pass"})
+	var user User
+	if err := json.Unmarshal(rr.Body.Bytes(), &user); err != nil {
+		t.Fatal(err)
+	}
+	if user.Role != roleReader {
+		t.Errorf("expected new users to default to the reader role, got %q", user.Role)
+	}
+
+	rr = serveJSON(t, router, "PUT", "/users/"+strconv.Itoa(user.ID)+"/role", map[string]string{"role": "superuser"})
+	if rr.Code != http.StatusBadRequest {
+		t.Errorf("SetUserRole handler returned %d for an unknown role, expected %d", rr.Code, http.StatusBadRequest)
+	}
+
+	rr = serveJSON(t, router, "PUT", "/users/"+strconv.Itoa(user.ID)+"/role", map[string]string{"role": roleLibrarian})
+	if rr.Code != http.StatusOK {
+		t.Fatalf("SetUserRole handler returned %d, expected %d", rr.Code, http.StatusOK)
+	}
+
+	// The role is carried in the token issued at login
+	tokens := postJSON(t, router, "/login", "", map[string]string{"username": "reader", "password": "s3cret-pass"})
+	var body map[string]string
+	if err := json.Unmarshal(tokens.Body.Bytes(), &body); err != nil {
+		t.Fatal(err)
+	}
+	claims := &Claims{}
+	if _, err := jwt.ParseWithClaims(body["token"], claims, func(token *jwt.Token) (interface{}, error) {
+		return []byte(testConfig.JWTSecret), nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if claims.Role != roleLibrarian {
+		t.Errorf("expected the token to carry the librarian role, got %q", claims.Role)
+	}
+}
+
+func TestSetRoleCommand(t *testing.T) {
+	s := newTestServer(t)
+	ctx := context.Background()
+	if err := s.store.CreateUser(ctx, &User{Username: "alice", PasswordHash: "hash", Role: roleReader}); err != nil {
+		t.Fatal(err)
+	}
+
+	var out bytes.Buffer
+	if err := runSetRole(ctx, s.store, defaultRoles(), []string{"alice", roleAdmin}, &out); err != nil {
+		t.Fatal(err)
+	}
+	if user, err := s.store.GetUserByUsername(ctx, "alice"); err != nil || user.Role != roleAdmin {
+		t.Errorf("got %+v, %v; expected alice to be an admin", user, err)
+	}
+	if out.String() != "alice is now admin\n" {
+		t.Errorf("set-role printed %q", out.String())
+	}
+
+	for _, args := range [][]string{{"alice"}, {"alice", "owner"}, {"nobody", roleAdmin}} {
+		if err := runSetRole(ctx, s.store, defaultRoles(), args, &out); err == nil {
+			t.Errorf("set-role %v succeeded", args)
+		}
+	}
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// decodeBody decodes the JSON request body into v, answering 400 and
+// returning false when it can't. In strict mode fields v doesn't have are
+// rejected instead of ignored.
+func (s *server) decodeBody(w http.ResponseWriter, r *http.Request, v any) bool {
+	decoder := json.NewDecoder(r.Body)
+	if s.strictJSON {
+		decoder.DisallowUnknownFields()
+	}
+
+	err := decoder.Decode(v)
+	if err == nil {
+		return true
+	}
+	// encoding/json has no error type for unknown fields
+	if name, ok := strings.CutPrefix(err.Error(), "json: unknown field "); ok {
+		name, _ = strconv.Unquote(name)
+		invalidFields(w, r, FieldError{name, "is not a known field"})
+		return false
+	}
+	malformedBody(w, r, err)
+	return false
+}
+
+// rule checks the value of a field, returning why it is invalid or "" when
+// it is valid
+type rule func(value any) string
+
+// field is a value of a request body with the rules it must satisfy
+type field struct {
+	path     string
+	value    any
+	required bool
+	rules    []rule
+}
+
+// required is a field that must be set and satisfy rules
+func required(path string, value any, rules ...rule) field {
+	return field{path, value, true, rules}
+}
+
+// optional is a field that may be left empty, but must satisfy rules when
+// it is set
+func optional(path string, value any, rules ...rule) field {
+	return field{path, value, false, rules}
+}
+
+// validateFields checks every field and returns all of their violations
+func validateFields(fields ...field) []FieldError {
+	var errs []FieldError
+	for _, f := range fields {
+		if reflect.ValueOf(f.value).IsZero() {
+			if f.required {
+				errs = append(errs, FieldError{f.path, "is required"})
+			}
+			continue
+		}
+		for _, check := range f.rules {
+			if message := check(f.value); message != "" {
+				errs = append(errs, FieldError{f.path, message})
+				break
+			}
+		}
+	}
+	return errs
+}
+
+// maxLength limits a string to n characters
+func maxLength(n int) rule {
+	return func(value any) string {
+		if utf8.RuneCountInString(value.(string)) > n {
+			return fmt.Sprintf("must be at most %d characters", n)
+		}
+		return ""
+	}
+}
+
+// positive requires a number above zero
+func positive(value any) string {
+	if value.(int) <= 0 {
+		return "must be positive"
+	}
+	return ""
+}
+
+// minPublishedYear is the earliest year a book can be published in
+const minPublishedYear = 1450
+
+// publishedYear requires a year from minPublishedYear up to next year, so
+// announced books can be added. Years are written as four digits, which
+// is what the column holds and what makes year filters order them.
+func publishedYear(value any) string {
+	maxYear := time.Now().Year() + 1
+	s := value.(string)
+	year, err := strconv.Atoi(s)
+	if len(s) != 4 || !allDigits(s) || err != nil || year < minPublishedYear || year > maxYear {
+		return fmt.Sprintf("must be a year from %d to %d", minPublishedYear, maxYear)
+	}
+	return ""
+}
+
+// countryCode requires an ISO 3166-1 alpha-2 country code
+func countryCode(value any) string {
+	if !countryCodes[value.(string)] {
+		return "must be an ISO 3166-1 alpha-2 country code such as GB"
+	}
+	return ""
+}
+
+// languageCode requires an ISO 639-1 language code
+func languageCode(value any) string {
+	if !languageCodes[value.(string)] {
+		return "must be an ISO 639-1 language code such as en"
+	}
+	return ""
+}
+
+// isbn requires an ISBN-10 or ISBN-13 with a correct check digit
+func isbn(value any) string {
+	if !value.(ISBN).valid() {
+		return "must be a valid ISBN-10 or ISBN-13"
+	}
+	return ""
+}
+
+// validate returns every invalid field of the book
+func (b Book) validate() []FieldError {
+	return validateFields(
+		required("title", b.Title, maxLength(255)),
+		optional("published_year", b.PublishedYear, publishedYear),
+		optional("isbn", b.ISBN, isbn),
+		optional("language", b.Language, languageCode),
+		optional("genre", b.Genre, maxLength(64)),
+	)
+}
+
+// validate returns every invalid field of the author
+func (a Author) validate() []FieldError {
+	return validateFields(
+		required("name", a.Name, maxLength(255)),
+		optional("country", a.Country, countryCode),
+	)
+}
+
+// validate returns every invalid field of the author book
+func (ab AuthorBook) validate() []FieldError {
+	return validateFields(
+		required("author_id", ab.AuthorID, positive),
+		required("book_id", ab.BookID, positive),
+	)
+}
+
+// validate requires author_ids, which may be empty to remove every author
+func (ba BookAuthors) validate() []FieldError {
+	fields := []field{required("author_ids", ba.AuthorIDs)}
+	for i, id := range ba.AuthorIDs {
+		fields = append(fields, required(fmt.Sprintf("author_ids[%d]", i), id, positive))
+	}
+	return validateFields(fields...)
+}
+
+// countryCodes holds the officially assigned ISO 3166-1 alpha-2 codes
+var countryCodes = map[string]bool{}
+
+// languageCodes holds the ISO 639-1 language codes
+var languageCodes = map[string]bool{}
+
+func init() {
+	for _, code := range strings.Fields(`
+		AD AE AF AG AI AL AM AO AQ AR AS AT AU AW AX AZ
+		BA BB BD BE BF BG BH BI BJ BL BM BN BO BQ BR BS BT BV BW BY BZ
+		CA CC CD CF CG CH CI CK CL CM CN CO CR CU CV CW CX CY CZ
+		DE DJ DK DM DO DZ
+		EC EE EG EH ER ES ET
+		FI FJ FK FM FO FR
+		GA GB GD GE GF GG GH GI GL GM GN GP GQ GR GS GT GU GW GY
+		HK HM HN HR HT HU
+		ID IE IL IM IN IO IQ IR IS IT
+		JE JM JO JP
+		KE KG KH KI KM KN KP KR KW KY KZ
+		LA LB LC LI LK LR LS LT LU LV LY
+		MA MC MD ME MF MG MH MK ML MM MN MO MP MQ MR MS MT MU MV MW MX MY MZ
+		NA NC NE NF NG NI NL NO NP NR NU NZ
+		OM
+		PA PE PF PG PH PK PL PM PN PR PS PT PW PY
+		QA
+		RE RO RS RU RW
+		SA SB SC SD SE SG SH SI SJ SK SL SM SN SO SR SS ST SV SX SY SZ
+		TC TD TF TG TH TJ TK TL TM TN TO TR TT TV TW TZ
+		UA UG UM US UY UZ
+		VA VC VE VG VI VN VU
+		WF WS
+		YE YT
+		ZA ZM ZW`) {
+		countryCodes[code] = true
+	}
+
+	for _, code := range strings.Fields(`
+		aa ab ae af ak am an ar as av ay az
+		ba be bg bi bm bn bo br bs
+		ca ce ch co cr cs cu cv cy
+		da de dv dz
+		ee el en eo es et eu
+		fa ff fi fj fo fr fy
+		ga gd gl gn gu gv
+		ha he hi ho hr ht hu hy hz
+		ia id ie ig ii ik io is it iu
+		ja jv
+		ka kg ki kj kk kl km kn ko kr ks ku kv kw ky
+		la lb lg li ln lo lt lu lv
+		mg mh mi mk ml mn mr ms mt my
+		na nb nd ne ng nl nn no nr nv ny
+		oc oj om or os
+		pa pi pl ps pt
+		qu
+		rm rn ro ru rw
+		sa sc sd se sg si sk sl sm sn so sq sr ss st su sv sw
+		ta te tg th ti tk tl tn to tr ts tt tw ty
+		ug uk ur uz
+		ve vi vo
+		wa wo
+		xh
+		yi yo
+		za zh zu`) {
+		languageCodes[code] = true
+	}
+}
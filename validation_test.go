@@ -0,0 +1,107 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestBookValidate(t *testing.T) {
+	tests := []struct {
+		book   Book
+		fields []string
+	}{
+		{Book{Title: "Valid", PublishedYear: "1999", ISBN: "9780306406157"}, nil},
+		{Book{Title: "No year or ISBN"}, nil},
+		{Book{}, []string{"title"}},
+		{Book{Title: strings.Repeat("a", 256)}, []string{"title"}},
+		{Book{Title: "Bad", PublishedYear: "soon", ISBN: "-5"}, []string{"published_year", "isbn"}},
+		{Book{Title: "Bad", PublishedYear: "1200", ISBN: "1234567890"}, []string{"published_year", "isbn"}},
+		{Book{PublishedYear: "3000"}, []string{"title", "published_year"}},
+		{Book{Title: "Signed", PublishedYear: "+1990"}, []string{"published_year"}},
+		{Book{Title: "Padded", PublishedYear: "01990"}, []string{"published_year"}},
+		{Book{Title: "Spaced", PublishedYear: " 1990"}, []string{"published_year"}},
+		{Book{Title: "Valid", Language: "en", Genre: "fantasy"}, nil},
+		{Book{Title: "Bad", Language: "english", Genre: strings.Repeat("a", 65)}, []string{"language", "genre"}},
+	}
+
+	for _, test := range tests {
+		var fields []string
+		for _, err := range test.book.validate() {
+			fields = append(fields, err.Field)
+		}
+		if !reflect.DeepEqual(fields, test.fields) {
+			t.Errorf("%+v: got invalid fields %v, expected %v", test.book, fields, test.fields)
+		}
+	}
+}
+
+func TestAuthorValidate(t *testing.T) {
+	tests := []struct {
+		author Author
+		fields []string
+	}{
+		{Author{Name: "Jane Doe", Country: "ID"}, nil},
+		{Author{Name: "Jane Doe"}, nil},
+		{Author{Country: "Indonesia"}, []string{"name", "country"}},
+		{Author{Name: "Jane Doe", Country: "gb"}, []string{"country"}},
+		{Author{Name: "Jane Doe", Country: "XX"}, []string{"country"}},
+	}
+
+	for _, test := range tests {
+		var fields []string
+		for _, err := range test.author.validate() {
+			fields = append(fields, err.Field)
+		}
+		if !reflect.DeepEqual(fields, test.fields) {
+			t.Errorf("%+v: got invalid fields %v, expected %v", test.author, fields, test.fields)
+		}
+	}
+}
+
+func TestCreateBookReportsAllInvalidFields(t *testing.T) {
+	s := newTestServer(t)
+
+	rr := serveJSON(t, s, "POST", "/books", map[string]any{"title": "", "published_year": "12", "isbn": 42})
+	problem := decodeProblem(t, rr, http.StatusBadRequest, problemValidation)
+	if len(problem.Errors) != 3 {
+		t.Errorf("got errors %+v, expected title, published_year and isbn", problem.Errors)
+	}
+
+	rr = serveJSON(t, s, "POST", "/authorbooks", map[string]int{"author_id": -1})
+	problem = decodeProblem(t, rr, http.StatusBadRequest, problemValidation)
+	if len(problem.Errors) != 2 {
+		t.Errorf("got errors %+v, expected author_id and book_id", problem.Errors)
+	}
+}
+
+func TestStrictJSON(t *testing.T) {
+	body := `{"title": "New", "subtitle": "Unknown"}`
+
+	for _, strict := range []bool{false, true} {
+		cfg := testConfig
+		cfg.StrictJSON = strict
+		s := newTestServerWith(t, cfg)
+
+		req, err := http.NewRequest("POST", "/books", strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		authorize(t, req)
+		rr := httptest.NewRecorder()
+		s.ServeHTTP(rr, req)
+
+		if !strict {
+			if rr.Code != http.StatusOK {
+				t.Errorf("lenient mode: got %d, expected %d", rr.Code, http.StatusOK)
+			}
+			continue
+		}
+		problem := decodeProblem(t, rr, http.StatusBadRequest, problemValidation)
+		if len(problem.Errors) != 1 || problem.Errors[0].Field != "subtitle" {
+			t.Errorf("strict mode: got errors %+v, expected one for subtitle", problem.Errors)
+		}
+	}
+}